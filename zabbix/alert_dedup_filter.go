@@ -0,0 +1,160 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter collapsing identical alerts. The first alert of a window is
+// re-injected right away, the repeats received during the window are
+// swallowed and summarized by a single message carrying the repeat count
+// once the window closes.
+type AlertDedupFilter struct {
+	conf   *AlertDedupFilterConfig
+	window time.Duration
+	alerts map[string]*dedupAlert
+}
+
+type dedupAlert struct {
+	first   time.Time
+	repeats int64
+	// Copy of the last repeat
+	last *message.Message
+}
+
+type AlertDedupFilterConfig struct {
+	// Message headers (Type, Logger, Hostname, Severity, Payload) and
+	// fields making two alerts identical
+	DedupFields []string `toml:"dedup_fields"`
+
+	// Window in seconds repeats are collapsed over
+	Window uint `toml:"window"`
+
+	// Name of the field holding the repeat count
+	RepeatField string `toml:"repeat_field"`
+
+	// Message type for outbound messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (adf *AlertDedupFilter) ConfigStruct() interface{} {
+	return &AlertDedupFilterConfig{
+		DedupFields: []string{"Logger", "Hostname", "Severity", "Payload"},
+		Window:      uint(300),
+		RepeatField: "repeat_count",
+		MessageType: "alert.dedup",
+	}
+}
+
+func (adf *AlertDedupFilter) Init(config interface{}) (err error) {
+	adf.conf = config.(*AlertDedupFilterConfig)
+	if adf.conf.Window == 0 {
+		return fmt.Errorf("window must be > 0")
+	}
+	if len(adf.conf.DedupFields) == 0 {
+		return fmt.Errorf("At least one dedup field must be defined.")
+	}
+	adf.window = time.Duration(adf.conf.Window) * time.Second
+	adf.alerts = make(map[string]*dedupAlert)
+	return
+}
+
+// Value of a message header or field as string, empty when missing.
+func messageValue(msg *message.Message, name string) string {
+	switch name {
+	case "Type":
+		return msg.GetType()
+	case "Logger":
+		return msg.GetLogger()
+	case "Hostname":
+		return msg.GetHostname()
+	case "Severity":
+		return fmt.Sprintf("%d", msg.GetSeverity())
+	case "Payload":
+		return msg.GetPayload()
+	}
+	if v, ok := msg.GetFieldValue(name); ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func (adf *AlertDedupFilter) identity(msg *message.Message) string {
+	values := make([]string, len(adf.conf.DedupFields))
+	for i, name := range adf.conf.DedupFields {
+		values[i] = messageValue(msg, name)
+	}
+	return strings.Join(values, "\x00")
+}
+
+func (adf *AlertDedupFilter) emit(fr FilterRunner, h PluginHelper, msgLoopCount uint,
+	msg *message.Message, repeats int64) {
+
+	pack := h.PipelinePack(msgLoopCount)
+	if pack == nil {
+		fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	pack.Message = message.CopyMessage(msg)
+	pack.Message.SetType(adf.conf.MessageType)
+
+	field, err := message.NewField(adf.conf.RepeatField, repeats, "count")
+	if err != nil {
+		fr.LogError(fmt.Errorf("Unable to add %s: %s", adf.conf.RepeatField, err))
+		pack.Recycle()
+		return
+	}
+	pack.Message.AddField(field)
+	fr.Inject(pack)
+}
+
+func (adf *AlertDedupFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = fr.InChan()
+		ticker = fr.Ticker()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			id := adf.identity(pack.Message)
+			if alert, found := adf.alerts[id]; found {
+				alert.repeats++
+				alert.last = message.CopyMessage(pack.Message)
+			} else {
+				adf.alerts[id] = &dedupAlert{first: time.Now()}
+				adf.emit(fr, h, pack.MsgLoopCount, pack.Message, 1)
+			}
+			pack.Recycle()
+
+		case now := <-ticker:
+			for id, alert := range adf.alerts {
+				if now.Sub(alert.first) < adf.window {
+					continue
+				}
+				if alert.repeats > 0 {
+					adf.emit(fr, h, 0, alert.last, alert.repeats)
+				}
+				delete(adf.alerts, id)
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("AlertDedupFilter", func() interface{} {
+		return new(AlertDedupFilter)
+	})
+}
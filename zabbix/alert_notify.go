@@ -0,0 +1,111 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Data available to the templates of the notification outputs.
+type alertData struct {
+	Type      string
+	Logger    string
+	Hostname  string
+	Severity  int32
+	Payload   string
+	Timestamp time.Time
+	Fields    map[string]interface{}
+}
+
+// Severity name (critical, error, warning or info) of a syslog severity.
+func alertSeverity(severity int32) string {
+	switch {
+	case severity <= 2:
+		return "critical"
+	case severity == 3:
+		return "error"
+	case severity == 4:
+		return "warning"
+	}
+	return "info"
+}
+
+func newAlertData(msg *message.Message) *alertData {
+	ad := &alertData{
+		Type:      msg.GetType(),
+		Logger:    msg.GetLogger(),
+		Hostname:  msg.GetHostname(),
+		Severity:  msg.GetSeverity(),
+		Payload:   msg.GetPayload(),
+		Timestamp: time.Unix(0, msg.GetTimestamp()),
+		Fields:    make(map[string]interface{}),
+	}
+	for _, f := range msg.GetFields() {
+		ad.Fields[f.GetName()] = f.GetValue()
+	}
+	return ad
+}
+
+// Parses a notification template, nil when empty.
+func parseAlertTemplate(name string, text string) (t *template.Template, err error) {
+	if text == "" {
+		return
+	}
+	if t, err = template.New(name).Parse(text); err != nil {
+		return nil, fmt.Errorf("Invalid %s template: %s", name, err)
+	}
+	return
+}
+
+func renderAlertTemplate(t *template.Template, ad *alertData) (out []byte, err error) {
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, ad); err != nil {
+		return nil, fmt.Errorf("Unable to render %s template: %s", t.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Posts a body, retrying up to retries times while the request fails or the
+// server answers with a 5xx or 429 status. Other statuses aren't retried.
+func postWithRetries(client *http.Client, url string, contentType string, headers map[string]string,
+	body []byte, retries uint, delay time.Duration) (err error) {
+
+	for attempt := uint(0); ; attempt++ {
+		var retry bool
+		if retry, err = post(client, url, contentType, headers, body); err == nil || !retry || attempt >= retries {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+func post(client *http.Client, url string, contentType string, headers map[string]string,
+	body []byte) (retry bool, err error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode >= 500 || resp.StatusCode == 429, fmt.Errorf("%s returned %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return false, nil
+}
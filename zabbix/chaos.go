@@ -0,0 +1,71 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Failure injection settings, rates are probabilities between 0 and 1.
+// Meant for staging, to exercise buffering and retries without breaking a
+// real server.
+type ZabbixChaosConfig struct {
+	// Requests failing before reaching the server
+	FailureRate float64 `toml:"failure_rate"`
+	// Requests delayed by slow_delay, bare numbers in ms, before being sent
+	SlowRate  float64        `toml:"slow_rate"`
+	SlowDelay DurationMillis `toml:"slow_delay"`
+	// Server responses replaced by garbage
+	MalformedRate float64 `toml:"malformed_rate"`
+}
+
+var errChaosFailure = errors.New("Injected failure")
+
+type zabbixChaos struct {
+	conf ZabbixChaosConfig
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func newZabbixChaos(conf ZabbixChaosConfig) (c *zabbixChaos, err error) {
+	for _, rate := range []float64{conf.FailureRate, conf.SlowRate, conf.MalformedRate} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid chaos rate %f, must be between 0 and 1", rate)
+		}
+	}
+	if conf.FailureRate == 0 && conf.SlowRate == 0 && conf.MalformedRate == 0 {
+		return nil, nil
+	}
+	return &zabbixChaos{conf: conf, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+}
+
+func (c *zabbixChaos) roll(rate float64) bool {
+	if rate == 0 {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rand.Float64() < rate
+}
+
+// Called before a request is sent.
+func (c *zabbixChaos) before() error {
+	if c.roll(c.conf.FailureRate) {
+		return errChaosFailure
+	}
+	if c.roll(c.conf.SlowRate) {
+		time.Sleep(time.Duration(c.conf.SlowDelay))
+	}
+	return nil
+}
+
+// Called with the server response.
+func (c *zabbixChaos) after(resp []byte) []byte {
+	if c.roll(c.conf.MalformedRate) && len(resp) > 0 {
+		return resp[:len(resp)/2]
+	}
+	return resp
+}
@@ -0,0 +1,73 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mathpl/active_zabbix"
+)
+
+// Key list of a host as saved to checks_cache_file
+type checksCacheHost struct {
+	Fetched time.Time                    `json:"fetched"`
+	Keys    active_zabbix.HostActiveKeys `json:"keys"`
+}
+
+// Loads the key lists saved before a restart, skipping the ones older than
+// checks_cache_max_age. They are refreshed by the fetch rounds as usual.
+func (zo *ZabbixOutput) loadChecksCache(now time.Time) (loaded int, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(zo.conf.ChecksCacheFile); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var hosts map[string]checksCacheHost
+	if err = json.Unmarshal(data, &hosts); err != nil {
+		return 0, fmt.Errorf("Invalid checks cache file %s: %s", zo.conf.ChecksCacheFile, err)
+	}
+
+	maxAge := time.Duration(zo.conf.ChecksCacheMaxAge)
+	for host, ch := range hosts {
+		if ch.Keys == nil || maxAge != 0 && now.Sub(ch.Fetched) > maxAge {
+			continue
+		}
+		zo.key_filter[host] = ch.Keys
+		zo.checks_times[host] = ch.Fetched
+		loaded++
+	}
+	return
+}
+
+// Saves the key lists fetched so far, replacing the file at once so a crash
+// doesn't leave half of it.
+func (zo *ZabbixOutput) saveChecksCache() (err error) {
+	hosts := make(map[string]checksCacheHost, len(zo.checks_times))
+	for host, fetched := range zo.checks_times {
+		if hc := zo.key_filter[host]; hc != nil {
+			hosts[host] = checksCacheHost{Fetched: fetched, Keys: hc}
+		}
+	}
+
+	var data []byte
+	if data, err = json.Marshal(hosts); err != nil {
+		return
+	}
+	if err = replaceFile(zo.conf.ChecksCacheFile, data); err != nil {
+		err = fmt.Errorf("Unable to save checks cache: %s", err)
+	}
+	return
+}
+
+// Writes a file aside then moves it over the previous one.
+func replaceFile(path string, data []byte) (err error) {
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return
+}
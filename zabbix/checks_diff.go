@@ -0,0 +1,88 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mathpl/active_zabbix"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Type of the messages injected when the key list of a host changed, with
+// inject_checks_diff
+const zabbixChecksDiffType = "zabbix.checks.diff"
+
+// Payload of the zabbix.checks.diff messages
+type checksDiff struct {
+	Host    string   `json:"host"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// Keys of the new list missing from the previous one, and the other way
+// around, sorted.
+func diffChecks(prev active_zabbix.HostActiveKeys, next active_zabbix.HostActiveKeys) (added []string, removed []string) {
+	for key, _ := range next {
+		if _, found := prev[key]; !found {
+			added = append(added, key)
+		}
+	}
+	for key, _ := range prev {
+		if _, found := next[key]; !found {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
+}
+
+// Injects a zabbix.checks.diff message when the keys of a host changed
+// since its previous list. The first list of a host isn't reported.
+func (zo *ZabbixOutput) injectChecksDiff(or OutputRunner, host string, prev active_zabbix.HostActiveKeys,
+	next active_zabbix.HostActiveKeys) {
+
+	if zo.helper == nil || prev == nil {
+		return
+	}
+	added, removed := diffChecks(prev, next)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(checksDiff{Host: host, Added: added, Removed: removed})
+	if err != nil {
+		or.LogError(fmt.Errorf("Unable to build %s message: %s", zabbixChecksDiffType, err))
+		return
+	}
+	pack := zo.helper.PipelinePack(0)
+	if pack == nil {
+		or.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", zo.helper.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	fields := []struct {
+		name  string
+		value interface{}
+	}{
+		{"host", host},
+		{"added", len(added)},
+		{"removed", len(removed)},
+	}
+	for _, f := range fields {
+		field, fieldErr := message.NewField(f.name, f.value, "")
+		if fieldErr != nil {
+			or.LogError(fmt.Errorf("Unable to build %s message: %s", zabbixChecksDiffType, fieldErr))
+			pack.Recycle()
+			return
+		}
+		pack.Message.AddField(field)
+	}
+	pack.Message.SetType(zabbixChecksDiffType)
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(string(payload))
+	or.Inject(pack)
+}
@@ -0,0 +1,81 @@
+package plugins
+
+import (
+	"sync"
+	"time"
+)
+
+// Stops sending for a cool-down period after consecutive failures, so a
+// server in maintenance isn't hit by a connection attempt per batch. Once
+// the cool-down is over the circuit is half-open: the next send probes the
+// server, closing the circuit when it succeeds and opening it again when
+// it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+// Circuit states, as reported
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Returns nil, a breaker that never opens, when threshold is 0.
+func newCircuitBreaker(threshold uint, cooldown time.Duration) *circuitBreaker {
+	if threshold == 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: int(threshold), cooldown: cooldown}
+}
+
+func (cb *circuitBreaker) state(now time.Time) string {
+	if cb == nil {
+		return circuitClosed
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch {
+	case cb.failures < cb.threshold:
+		return circuitClosed
+	case now.Before(cb.openedAt.Add(cb.cooldown)):
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+// Whether sends must be held back.
+func (cb *circuitBreaker) open(now time.Time) bool {
+	return cb.state(now) == circuitOpen
+}
+
+// Accounts the outcome of a send, returns the new state when it changed.
+func (cb *circuitBreaker) record(err error, now time.Time) (changed string) {
+	if cb == nil {
+		return
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if err == nil {
+		if cb.failures >= cb.threshold {
+			changed = circuitClosed
+		}
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		// Opening, or opening again after a failed probe
+		cb.openedAt = now
+		changed = circuitOpen
+	}
+	return
+}
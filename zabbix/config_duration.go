@@ -0,0 +1,65 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Intervals and timeouts of the configuration, given as Go duration
+// strings like "500ms" or "5m". Bare numbers are still accepted, in
+// seconds for DurationSeconds and in milliseconds for DurationMillis, as
+// the settings used to be.
+type DurationSeconds time.Duration
+type DurationMillis time.Duration
+
+func (d *DurationSeconds) UnmarshalText(text []byte) (err error) {
+	var v time.Duration
+	if v, err = parseConfigDuration(text, time.Second); err == nil {
+		*d = DurationSeconds(v)
+	}
+	return
+}
+
+func (d *DurationMillis) UnmarshalText(text []byte) (err error) {
+	var v time.Duration
+	if v, err = parseConfigDuration(text, time.Millisecond); err == nil {
+		*d = DurationMillis(v)
+	}
+	return
+}
+
+// Duration strings and bare numbers in JSON, for the reload settings.
+func (d *DurationSeconds) UnmarshalJSON(data []byte) error {
+	return d.UnmarshalText(bytes.Trim(data, `"`))
+}
+
+func (d *DurationMillis) UnmarshalJSON(data []byte) error {
+	return d.UnmarshalText(bytes.Trim(data, `"`))
+}
+
+func (d DurationSeconds) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d DurationMillis) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Parses a duration string, or a bare number of unit.
+func parseConfigDuration(text []byte, unit time.Duration) (time.Duration, error) {
+	s := strings.TrimSpace(string(text))
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration %q, a number or a duration like \"500ms\" or \"5m\" expected", s)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("Invalid duration %q, can't be negative", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,105 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Type of the messages listing the most discarded keys, with
+// discard_stats_interval
+const zabbixDiscardStatsType = "zabbix.discard.stats"
+
+type discardStatsKey struct {
+	host   string
+	key    string
+	reason string
+}
+
+type discardStatsEntry struct {
+	Host     string `json:"host"`
+	Key      string `json:"key"`
+	Reason   string `json:"reason"`
+	Discards int64  `json:"discards"`
+}
+
+// Values discarded by the filter per host, key and reason, bounded to a
+// multiple of the reported top N like the host stats. Pairs showing up once
+// the table is full are accounted under host and key "other". Only used
+// from the Run loop.
+type discardStats struct {
+	top   int
+	keys  map[discardStatsKey]int64
+	other int64
+}
+
+func newDiscardStats(top uint) *discardStats {
+	if top == 0 {
+		return nil
+	}
+	return &discardStats{top: int(top), keys: make(map[discardStatsKey]int64)}
+}
+
+func (ds *discardStats) count(host string, key string, reason string) {
+	if ds == nil {
+		return
+	}
+	k := discardStatsKey{host, key, reason}
+	if _, found := ds.keys[k]; !found && len(ds.keys) >= ds.top*hostStatsTrackedFactor {
+		ds.other++
+		return
+	}
+	ds.keys[k]++
+}
+
+type byDiscards []discardStatsEntry
+
+func (b byDiscards) Len() int           { return len(b) }
+func (b byDiscards) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDiscards) Less(i, j int) bool { return b[i].Discards > b[j].Discards }
+
+// Most discarded keys, followed by the "other" bucket if in use.
+func (ds *discardStats) topN() (entries []discardStatsEntry) {
+	if ds == nil {
+		return
+	}
+	entries = make([]discardStatsEntry, 0, len(ds.keys))
+	for k, n := range ds.keys {
+		entries = append(entries, discardStatsEntry{k.host, k.key, k.reason, n})
+	}
+	sort.Sort(byDiscards(entries))
+	if len(entries) > ds.top {
+		entries = entries[:ds.top]
+	}
+
+	if ds.other > 0 {
+		entries = append(entries, discardStatsEntry{Host: "other", Key: "other", Discards: ds.other})
+	}
+	return
+}
+
+// Injects a zabbix.discard.stats message with the most discarded keys so
+// far as a JSON array payload.
+func (zo *ZabbixOutput) injectDiscardStats(or OutputRunner, h PluginHelper) {
+	entries := zo.discard_stats.topN()
+	if len(entries) == 0 {
+		return
+	}
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		or.LogError(fmt.Errorf("Unable to build %s message: %s", zabbixDiscardStatsType, err))
+		return
+	}
+	pack := h.PipelinePack(0)
+	if pack == nil {
+		or.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	pack.Message.SetType(zabbixDiscardStatsType)
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(string(payload))
+	or.Inject(pack)
+}
@@ -0,0 +1,146 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Type of the messages listing the keys newly discarded, with
+// discarded_keys_interval
+const zabbixDiscardedKeysType = "zabbix.discarded.keys"
+
+// Distinct pairs remembered before starting over, listing them again
+const maxDiscardedKeys = 100000
+
+// Host and key pair discarded for not being in the key lists
+type discardedKey struct {
+	Host   string    `json:"host"`
+	Key    string    `json:"key"`
+	Reason string    `json:"reason"`
+	First  time.Time `json:"first_seen"`
+}
+
+// Distinct host and key pairs the filter discarded for an unknown host or
+// key, appended as JSON lines to discarded_keys_file and passed on in
+// zabbix.discarded.keys messages. Only used from the Run loop.
+type discardedKeys struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+
+	seen    map[string]map[string]bool
+	count   int
+	pending []discardedKey
+	// Whether pairs are queued for the next message
+	queue bool
+}
+
+func newDiscardedKeys(path string, maxBytes uint, queue bool) (dk *discardedKeys, err error) {
+	if path == "" && !queue {
+		return nil, nil
+	}
+	dk = &discardedKeys{path: path, maxBytes: int64(maxBytes), queue: queue, seen: make(map[string]map[string]bool)}
+	if path != "" {
+		if err = dk.open(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (dk *discardedKeys) open() (err error) {
+	if dk.file, err = os.OpenFile(dk.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return fmt.Errorf("Unable to open discarded_keys_file %s: %s", dk.path, err)
+	}
+	var fi os.FileInfo
+	if fi, err = dk.file.Stat(); err != nil {
+		return fmt.Errorf("Unable to open discarded_keys_file %s: %s", dk.path, err)
+	}
+	dk.size = fi.Size()
+	return
+}
+
+// Moves the file to path.1, replacing the previous one, and starts a new
+// one listing the pairs again.
+func (dk *discardedKeys) rotate() (err error) {
+	dk.file.Close()
+	if err = os.Rename(dk.path, dk.path+".1"); err != nil {
+		return fmt.Errorf("Unable to rotate discarded_keys_file: %s", err)
+	}
+	dk.seen, dk.count = make(map[string]map[string]bool), 0
+	return dk.open()
+}
+
+// Records a discarded pair the first time it's seen.
+func (dk *discardedKeys) add(host string, key string, reason string, now time.Time) (err error) {
+	if dk == nil || dk.seen[host][key] {
+		return
+	}
+	if dk.count >= maxDiscardedKeys {
+		dk.seen, dk.count = make(map[string]map[string]bool), 0
+	}
+	if dk.seen[host] == nil {
+		dk.seen[host] = make(map[string]bool)
+	}
+	dk.seen[host][key] = true
+	dk.count++
+
+	entry := discardedKey{host, key, reason, now}
+	if dk.queue {
+		dk.pending = append(dk.pending, entry)
+	}
+	if dk.file == nil {
+		return
+	}
+	line, _ := json.Marshal(entry)
+	line = append(line, '\n')
+	if dk.maxBytes > 0 && dk.size > 0 && dk.size+int64(len(line)) > dk.maxBytes {
+		if err = dk.rotate(); err != nil {
+			dk.file = nil
+			return
+		}
+		dk.seen[host] = map[string]bool{key: true}
+		dk.count = 1
+	}
+	n, err := dk.file.Write(line)
+	dk.size += int64(n)
+	if err != nil {
+		err = fmt.Errorf("Unable to write to discarded_keys_file: %s", err)
+	}
+	return
+}
+
+func (dk *discardedKeys) close() {
+	if dk != nil && dk.file != nil {
+		dk.file.Close()
+	}
+}
+
+// Injects a zabbix.discarded.keys message with the pairs discarded for the
+// first time since the previous one, as a JSON array payload.
+func (zo *ZabbixOutput) injectDiscardedKeys(or OutputRunner, h PluginHelper) {
+	dk := zo.discarded_keys
+	if len(dk.pending) == 0 {
+		return
+	}
+	payload, err := json.Marshal(dk.pending)
+	if err != nil {
+		or.LogError(fmt.Errorf("Unable to build %s message: %s", zabbixDiscardedKeysType, err))
+		return
+	}
+	pack := h.PipelinePack(0)
+	if pack == nil {
+		or.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	dk.pending = nil
+	pack.Message.SetType(zabbixDiscardedKeysType)
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(string(payload))
+	or.Inject(pack)
+}
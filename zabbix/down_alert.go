@@ -0,0 +1,111 @@
+package plugins
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Types of the messages injected when sends keep failing and once they
+// succeed again, with down_alert_failures
+const (
+	zabbixDownType = "zabbix.output.down"
+	zabbixUpType   = "zabbix.output.up"
+)
+
+// Consecutive failed sends, across the goroutines sending.
+type downAlert struct {
+	threshold int
+
+	lock     sync.Mutex
+	failures int
+	since    time.Time
+	down     bool
+}
+
+// Returns nil, never alerting, when threshold is 0.
+func newDownAlert(threshold uint) *downAlert {
+	if threshold == 0 {
+		return nil
+	}
+	return &downAlert{threshold: int(threshold)}
+}
+
+// Accounts the outcome of a send, returns the message type to inject when
+// the output went down or came back up, with the failures so far and the
+// time of the first one.
+func (da *downAlert) record(err error, now time.Time) (alert string, failures int, since time.Time) {
+	if da == nil {
+		return
+	}
+	da.lock.Lock()
+	defer da.lock.Unlock()
+
+	if err == nil {
+		if da.down {
+			alert, failures, since = zabbixUpType, da.failures, da.since
+		}
+		da.failures, da.down = 0, false
+		return
+	}
+
+	if da.failures == 0 {
+		da.since = now
+	}
+	da.failures++
+	if !da.down && da.failures >= da.threshold {
+		da.down = true
+		alert, failures, since = zabbixDownType, da.failures, da.since
+	}
+	return
+}
+
+// Injects a zabbix.output.down or zabbix.output.up message for the other
+// outputs to alert on.
+func (zo *ZabbixOutput) injectDownAlert(alert string, failures int, since time.Time, err error, buffered int) {
+	if zo.helper == nil {
+		return
+	}
+	server := zo.conf.Api.Url
+	if zo.servers != nil {
+		server = zo.servers.active().address
+	}
+
+	pack := zo.helper.PipelinePack(0)
+	if pack == nil {
+		zo.runner.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", zo.helper.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	type alertField struct {
+		name  string
+		value interface{}
+	}
+	fields := []alertField{
+		{"server", server},
+		{"failures", failures},
+		{"since", since.Format(time.RFC3339)},
+		{"buffered", buffered},
+	}
+	payload := fmt.Sprintf("Metrics reaching Zabbix server %s again after %d failed sends since %s",
+		server, failures, since.Format(time.RFC3339))
+	if alert == zabbixDownType {
+		fields = append(fields, alertField{"error", err.Error()})
+		payload = fmt.Sprintf("Metrics not reaching Zabbix server %s, %d failed sends since %s: %s",
+			server, failures, since.Format(time.RFC3339), err)
+	}
+	for _, f := range fields {
+		field, fieldErr := message.NewField(f.name, f.value, "")
+		if fieldErr != nil {
+			zo.runner.LogError(fmt.Errorf("Unable to build %s message: %s", alert, fieldErr))
+			pack.Recycle()
+			return
+		}
+		pack.Message.AddField(field)
+	}
+	pack.Message.SetType(alert)
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(payload)
+	zo.runner.Inject(pack)
+}
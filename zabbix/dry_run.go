@@ -0,0 +1,40 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Where the data requests go with dry_run: appended to a file, one per
+// line, or logged when no file is set.
+type dryRunLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func newDryRunLog(path string) (dl *dryRunLog, err error) {
+	dl = &dryRunLog{}
+	if path == "" {
+		return
+	}
+	if dl.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, fmt.Errorf("Unable to open dry_run_file %s: %s", path, err)
+	}
+	return
+}
+
+func (dl *dryRunLog) write(or OutputRunner, payload []byte) {
+	if dl.file == nil {
+		or.LogMessage(fmt.Sprintf("Dry run, not sent: %s", payload))
+		return
+	}
+
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if _, err := dl.file.Write(append(payload, '\n')); err != nil {
+		or.LogError(fmt.Errorf("Unable to write to dry_run_file: %s", err))
+	}
+}
@@ -0,0 +1,186 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output bridging alerts into existing escalation tooling, either running an
+// external command or posting to a generic webhook for every message.
+type EscalationOutput struct {
+	conf    *EscalationOutputConfig
+	args    []*template.Template
+	body    *template.Template
+	client  *http.Client
+	timeout time.Duration
+	delay   time.Duration
+}
+
+type EscalationOutputConfig struct {
+	// Command and arguments to run, each one being a template
+	Command []string `toml:"command"`
+
+	// Webhook receiving a POST per alert, used when command isn't set
+	WebhookUrl string `toml:"webhook_url"`
+	// Content-Type and extra headers of the POST
+	ContentType string            `toml:"content_type"`
+	Headers     map[string]string `toml:"headers"`
+
+	// Template of the POST body or of the command stdin. Has access to
+	// .Type, .Logger, .Hostname, .Severity, .Payload, .Timestamp and .Fields
+	BodyTemplate string `toml:"body_template"`
+
+	// Seconds a command or POST may take
+	Timeout uint `toml:"timeout"`
+
+	// Retries of a failed escalation and seconds between retries
+	MaxRetries uint `toml:"max_retries"`
+	RetryDelay uint `toml:"retry_delay"`
+
+	// Maximum escalations running at the same time
+	Concurrency uint `toml:"concurrency"`
+}
+
+func (eo *EscalationOutput) ConfigStruct() interface{} {
+	return &EscalationOutputConfig{
+		ContentType:  "application/json",
+		BodyTemplate: "{{.Payload}}",
+		Timeout:      uint(10),
+		MaxRetries:   uint(3),
+		RetryDelay:   uint(5),
+		Concurrency:  uint(4),
+	}
+}
+
+func (eo *EscalationOutput) Init(config interface{}) (err error) {
+	eo.conf = config.(*EscalationOutputConfig)
+
+	if (len(eo.conf.Command) == 0) == (eo.conf.WebhookUrl == "") {
+		return fmt.Errorf("Exactly one of command or webhook_url must be set.")
+	}
+	if eo.conf.Concurrency == 0 {
+		return fmt.Errorf("concurrency must be > 0")
+	}
+
+	for i, arg := range eo.conf.Command {
+		var t *template.Template
+		if t, err = parseAlertTemplate(fmt.Sprintf("command[%d]", i), arg); err != nil {
+			return
+		}
+		eo.args = append(eo.args, t)
+	}
+	if eo.body, err = parseAlertTemplate("body", eo.conf.BodyTemplate); err != nil {
+		return
+	}
+
+	eo.timeout = time.Duration(eo.conf.Timeout) * time.Second
+	eo.delay = time.Duration(eo.conf.RetryDelay) * time.Second
+	eo.client = &http.Client{Timeout: eo.timeout}
+	return
+}
+
+func (eo *EscalationOutput) run(args []string, stdin []byte) (err error) {
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-time.After(eo.timeout):
+		cmd.Process.Kill()
+		<-done
+		err = fmt.Errorf("timed out after %s", eo.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", args[0], err, bytes.TrimSpace(out.Bytes()))
+	}
+	return
+}
+
+func (eo *EscalationOutput) escalate(ad *alertData) (err error) {
+	var body []byte
+	if eo.body != nil {
+		if body, err = renderAlertTemplate(eo.body, ad); err != nil {
+			return
+		}
+	}
+
+	if eo.conf.WebhookUrl != "" {
+		return postWithRetries(eo.client, eo.conf.WebhookUrl, eo.conf.ContentType, eo.conf.Headers,
+			body, eo.conf.MaxRetries, eo.delay)
+	}
+
+	args := make([]string, len(eo.args))
+	for i, t := range eo.args {
+		var arg []byte
+		if arg, err = renderAlertTemplate(t, ad); err != nil {
+			return
+		}
+		args[i] = string(arg)
+	}
+	for attempt := uint(0); ; attempt++ {
+		if err = eo.run(args, body); err == nil || attempt >= eo.conf.MaxRetries {
+			return
+		}
+		time.Sleep(eo.delay)
+	}
+}
+
+func (eo *EscalationOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+		slots  = make(chan struct{}, eo.conf.Concurrency)
+		wg     sync.WaitGroup
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			ad := newAlertData(pack.Message)
+			pack.Recycle()
+
+			// Blocks when all the slots are in use
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				if localErr := eo.escalate(ad); localErr != nil {
+					or.LogError(fmt.Errorf("Escalation failed: %s", localErr))
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+	return
+}
+
+func init() {
+	RegisterPlugin("EscalationOutput", func() interface{} {
+		return new(EscalationOutput)
+	})
+}
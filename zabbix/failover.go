@@ -0,0 +1,109 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group of Zabbix servers used like the ServerActive list of zabbix_agentd:
+// requests go to the current server and move on to the next ones when it
+// fails. In ordered mode the primary is probed again every probe interval
+// once we've failed over, in round robin mode every request starts on the
+// next server.
+type zabbixFailover struct {
+	clients    []*zabbixClient
+	roundRobin bool
+	probe      time.Duration
+
+	lock    sync.Mutex
+	current int
+	// Last time requests failed over from the primary or probed it
+	probed time.Time
+}
+
+// Splits a comma separated server list.
+func parseServerList(addresses string) (list []string) {
+	for _, a := range strings.Split(addresses, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			list = append(list, a)
+		}
+	}
+	return
+}
+
+func newZabbixFailover(clients []*zabbixClient, mode string, probe time.Duration) (zf *zabbixFailover, err error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("At least one Zabbix server address must be set.")
+	}
+	if mode != "ordered" && mode != "round_robin" {
+		return nil, fmt.Errorf("Invalid failover_mode: %s, only 'ordered' or 'round_robin' allowed.", mode)
+	}
+	return &zabbixFailover{clients: clients, roundRobin: mode == "round_robin", probe: probe}, nil
+}
+
+// Server requests currently go to.
+func (zf *zabbixFailover) active() *zabbixClient {
+	zf.lock.Lock()
+	defer zf.lock.Unlock()
+	return zf.clients[zf.current]
+}
+
+// Index of the first server to try, and the servers.
+func (zf *zabbixFailover) start() (int, []*zabbixClient) {
+	zf.lock.Lock()
+	defer zf.lock.Unlock()
+
+	if zf.roundRobin {
+		zf.current = (zf.current + 1) % len(zf.clients)
+	} else if zf.current != 0 && time.Since(zf.probed) >= zf.probe {
+		zf.probed = time.Now()
+		return 0, zf.clients
+	}
+	return zf.current, zf.clients
+}
+
+// Runs a request against the servers in turn until one succeeds, returns
+// the last error when they all fail.
+func (zf *zabbixFailover) do(request func(zc *zabbixClient) error) (err error) {
+	first, clients := zf.start()
+	for i := 0; i < len(clients); i++ {
+		idx := (first + i) % len(clients)
+		if err = request(clients[idx]); err == nil {
+			zf.lock.Lock()
+			// Unless the servers were replaced meanwhile
+			if &zf.clients[0] == &clients[0] {
+				if !zf.roundRobin && zf.current == 0 && idx != 0 {
+					zf.probed = time.Now()
+				}
+				zf.current = idx
+			}
+			zf.lock.Unlock()
+			return
+		}
+	}
+	return
+}
+
+// Switches to a new server list, the requests in flight finish on the old
+// servers.
+func (zf *zabbixFailover) replace(clients []*zabbixClient) {
+	zf.lock.Lock()
+	old := zf.clients
+	zf.clients, zf.current, zf.probed = clients, 0, time.Time{}
+	zf.lock.Unlock()
+
+	for _, zc := range old {
+		zc.closeIdle()
+	}
+}
+
+// Closes the idle persistent connections of the servers.
+func (zf *zabbixFailover) closeIdle() {
+	zf.lock.Lock()
+	defer zf.lock.Unlock()
+	for _, zc := range zf.clients {
+		zc.closeIdle()
+	}
+}
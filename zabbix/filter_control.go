@@ -0,0 +1,73 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mathpl/active_zabbix"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Types of the messages adding keys to the key list of a host or removing
+// them, with filter_messages
+const (
+	zabbixFilterAddType    = "zabbix.filter.add"
+	zabbixFilterRemoveType = "zabbix.filter.remove"
+)
+
+// Applies a zabbix.filter.add or zabbix.filter.remove message: the keys of
+// its keys field, one per value, are added to or removed from the key list
+// of its host field. They stay so over the list refreshes, until a message
+// says otherwise.
+func (zo *ZabbixOutput) filterControl(or OutputRunner, pack *PipelinePack) {
+	host, err := fieldToString("host", pack)
+	if err != nil {
+		or.LogError(fmt.Errorf("Invalid %s message: %s", pack.Message.GetType(), err))
+		return
+	}
+	var keys []string
+	for _, field := range pack.Message.FindAllFields("keys") {
+		keys = append(keys, field.GetValueString()...)
+	}
+	if len(keys) == 0 {
+		or.LogError(fmt.Errorf("Invalid %s message: no keys", pack.Message.GetType()))
+		return
+	}
+
+	add := pack.Message.GetType() == zabbixFilterAddType
+	overrides := zo.filter_overrides[host]
+	if overrides == nil {
+		overrides = make(map[string]bool)
+		zo.filter_overrides[host] = overrides
+	}
+	for _, key := range keys {
+		overrides[key] = add
+	}
+	if zo.key_filter[host] == nil && add {
+		zo.key_filter[host] = make(active_zabbix.HostActiveKeys, len(keys))
+	}
+	zo.applyOverrides(host, zo.key_filter[host])
+	delete(zo.key_matches, host)
+
+	action := "removed from"
+	if add {
+		action = "added to"
+	}
+	or.LogMessage(fmt.Sprintf("Keys %s key list of host %s: %s", action, host, strings.Join(keys, " ")))
+}
+
+// Adds and removes the keys of the filter messages to a key list of host.
+func (zo *ZabbixOutput) applyOverrides(host string, hc active_zabbix.HostActiveKeys) {
+	if hc == nil {
+		return
+	}
+	for key, add := range zo.filter_overrides[host] {
+		if !add {
+			delete(hc, key)
+		} else if _, found := hc[key]; !found {
+			// No delay known, item_delay leaves it alone
+			hc[key] = 0
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package plugins
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter detecting keys whose value oscillates too fast. Emits a flapping
+// item set to 1 when a key starts flapping and 0 once it's stable again,
+// and optionally holds back the state changes of flapping keys, the last one
+// held is passed on once the key is stable.
+type FlappingFilter struct {
+	conf   *FlappingFilterConfig
+	window time.Duration
+	states map[string]map[string]*flapState
+}
+
+type flapState struct {
+	value       string
+	transitions []time.Time
+	flapping    bool
+	// Last state message held back with suppress
+	suppressed     *message.Message
+	suppressedLoop uint
+}
+
+type FlappingFilterConfig struct {
+	// Window in seconds transitions are counted over
+	Window uint `toml:"window"`
+
+	// Transitions within the window making a key flapping
+	Threshold uint `toml:"threshold"`
+
+	// Re-inject the received state messages with msg_type
+	PassThrough bool `toml:"pass_through"`
+
+	// Hold back the state changes of flapping keys, needs pass_through
+	Suppress bool `toml:"suppress"`
+
+	// Key of the generated items, the flapping key is added as parameter:
+	// flapping[key]
+	Key string `toml:"key"`
+
+	// Message type for outbound messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (ff *FlappingFilter) ConfigStruct() interface{} {
+	return &FlappingFilterConfig{
+		Window:      uint(600),
+		Threshold:   uint(5),
+		Key:         "flapping",
+		MessageType: "zabbix",
+	}
+}
+
+func (ff *FlappingFilter) Init(config interface{}) (err error) {
+	ff.conf = config.(*FlappingFilterConfig)
+	if ff.conf.Window == 0 || ff.conf.Threshold == 0 {
+		return fmt.Errorf("window and threshold must be > 0")
+	}
+	if ff.conf.Suppress && !ff.conf.PassThrough {
+		return fmt.Errorf("suppress requires pass_through")
+	}
+	ff.window = time.Duration(ff.conf.Window) * time.Second
+	ff.states = make(map[string]map[string]*flapState)
+	return
+}
+
+// Drops the transitions out of the window and updates the flapping state,
+// returns true when it changed.
+func (ff *FlappingFilter) update(fs *flapState, now time.Time) (changed bool) {
+	cutoff := now.Add(-ff.window)
+	i := 0
+	for i < len(fs.transitions) && fs.transitions[i].Before(cutoff) {
+		i++
+	}
+	fs.transitions = fs.transitions[i:]
+
+	flapping := len(fs.transitions) >= int(ff.conf.Threshold)
+	changed = flapping != fs.flapping
+	fs.flapping = flapping
+	return
+}
+
+func (ff *FlappingFilter) emit(fr FilterRunner, h PluginHelper, msgLoopCount uint, host string,
+	key string, flapping bool, now time.Time) {
+
+	value := "0"
+	if flapping {
+		value = "1"
+	}
+	pack, err := newZabbixMetricPack(h, msgLoopCount, ff.conf.MessageType, host,
+		fmt.Sprintf("%s[%s]", ff.conf.Key, key), value, now)
+	if err != nil {
+		fr.LogError(err)
+		return
+	}
+	fr.Inject(pack)
+}
+
+// Passes on the last state message held back while the key was flapping.
+func (ff *FlappingFilter) release(fr FilterRunner, h PluginHelper, fs *flapState) {
+	if fs.suppressed == nil {
+		return
+	}
+	msg, loop := fs.suppressed, fs.suppressedLoop
+	fs.suppressed = nil
+	pack := h.PipelinePack(loop)
+	if pack == nil {
+		fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	pack.Message = msg
+	fr.Inject(pack)
+}
+
+func (ff *FlappingFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = fr.InChan()
+		ticker = fr.Ticker()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			var host, key, value string
+			key, localErr := fieldToString("key", pack)
+			if localErr == nil {
+				if host, localErr = fieldToString("host", pack); localErr == nil {
+					value, localErr = fieldToString("value", pack)
+				}
+			}
+			if localErr != nil {
+				fr.LogError(localErr)
+				pack.Recycle()
+				continue
+			}
+
+			now := time.Now()
+			hs, found := ff.states[host]
+			if !found {
+				hs = make(map[string]*flapState)
+				ff.states[host] = hs
+			}
+			fs, found := hs[key]
+			if !found {
+				fs = &flapState{value: value}
+				hs[key] = fs
+			} else if fs.value != value {
+				fs.value = value
+				fs.transitions = append(fs.transitions, now)
+			}
+			if ff.update(fs, now) {
+				ff.emit(fr, h, pack.MsgLoopCount, host, key, fs.flapping, now)
+				if !fs.flapping {
+					ff.release(fr, h, fs)
+				}
+			}
+
+			if ff.conf.PassThrough && ff.conf.Suppress && fs.flapping {
+				fs.suppressed = message.CopyMessage(pack.Message)
+				fs.suppressed.SetType(ff.conf.MessageType)
+				fs.suppressedLoop = pack.MsgLoopCount
+			} else if ff.conf.PassThrough {
+				if pack2 := h.PipelinePack(pack.MsgLoopCount); pack2 == nil {
+					fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+				} else {
+					pack2.Message = message.CopyMessage(pack.Message)
+					pack2.Message.SetType(ff.conf.MessageType)
+					fr.Inject(pack2)
+				}
+			}
+			pack.Recycle()
+
+		case now := <-ticker:
+			// Keys going quiet become stable without new messages
+			for host, hs := range ff.states {
+				for key, fs := range hs {
+					if ff.update(fs, now) {
+						ff.emit(fr, h, 0, host, key, fs.flapping, now)
+						if !fs.flapping {
+							ff.release(fr, h, fs)
+						}
+					}
+					if !fs.flapping && len(fs.transitions) == 0 {
+						delete(hs, key)
+					}
+				}
+				if len(hs) == 0 {
+					delete(ff.states, host)
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("FlappingFilter", func() interface{} {
+		return new(FlappingFilter)
+	})
+}
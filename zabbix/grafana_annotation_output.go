@@ -0,0 +1,158 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output creating a Grafana annotation for every message, so dashboards
+// show deploys, Zabbix problems and alerts next to the metrics.
+type GrafanaAnnotationOutput struct {
+	conf    *GrafanaAnnotationOutputConfig
+	url     string
+	text    *template.Template
+	headers map[string]string
+	client  *http.Client
+	delay   time.Duration
+}
+
+type GrafanaAnnotationOutputConfig struct {
+	// Base url of Grafana
+	Url string `toml:"url"`
+	// Service account token or api key
+	ApiKey string `toml:"api_key"`
+
+	// Dashboard and panel the annotations are attached to, organization
+	// wide annotations when not set
+	DashboardUid string `toml:"dashboard_uid"`
+	PanelId      int64  `toml:"panel_id"`
+
+	// Template of the annotation text, see EscalationOutput body_template
+	TextTemplate string `toml:"text_template"`
+
+	// Tags added to every annotation
+	Tags []string `toml:"tags"`
+	// Fields whose values are added as name:value tags
+	TagFields []string `toml:"tag_fields"`
+
+	// Message field holding the end of a region annotation in nanoseconds
+	TimeEndField string `toml:"time_end_field"`
+
+	// Seconds a request may take
+	Timeout uint `toml:"timeout"`
+	// Retries of a failed request and seconds between retries
+	MaxRetries uint `toml:"max_retries"`
+	RetryDelay uint `toml:"retry_delay"`
+}
+
+type grafanaAnnotation struct {
+	DashboardUid string   `json:"dashboardUID,omitempty"`
+	PanelId      int64    `json:"panelId,omitempty"`
+	Time         int64    `json:"time"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+func (gao *GrafanaAnnotationOutput) ConfigStruct() interface{} {
+	return &GrafanaAnnotationOutputConfig{
+		TextTemplate: "{{.Payload}}",
+		Timeout:      uint(10),
+		MaxRetries:   uint(3),
+		RetryDelay:   uint(5),
+	}
+}
+
+func (gao *GrafanaAnnotationOutput) Init(config interface{}) (err error) {
+	gao.conf = config.(*GrafanaAnnotationOutputConfig)
+
+	if gao.conf.Url == "" {
+		return fmt.Errorf("url must be set")
+	}
+	gao.url = strings.TrimRight(gao.conf.Url, "/") + "/api/annotations"
+
+	if gao.text, err = parseAlertTemplate("text", gao.conf.TextTemplate); err != nil {
+		return
+	}
+	if gao.text == nil {
+		return fmt.Errorf("text_template must be set")
+	}
+
+	if gao.conf.ApiKey != "" {
+		gao.headers = map[string]string{"Authorization": "Bearer " + gao.conf.ApiKey}
+	}
+	gao.client = &http.Client{Timeout: time.Duration(gao.conf.Timeout) * time.Second}
+	gao.delay = time.Duration(gao.conf.RetryDelay) * time.Second
+	return
+}
+
+func (gao *GrafanaAnnotationOutput) annotation(ad *alertData) (a *grafanaAnnotation, err error) {
+	var text []byte
+	if text, err = renderAlertTemplate(gao.text, ad); err != nil {
+		return
+	}
+
+	a = &grafanaAnnotation{
+		DashboardUid: gao.conf.DashboardUid,
+		PanelId:      gao.conf.PanelId,
+		Time:         ad.Timestamp.UnixNano() / int64(time.Millisecond),
+		Tags:         append([]string{}, gao.conf.Tags...),
+		Text:         string(text),
+	}
+	for _, name := range gao.conf.TagFields {
+		if v, found := ad.Fields[name]; found {
+			a.Tags = append(a.Tags, fmt.Sprintf("%s:%v", name, v))
+		}
+	}
+	if gao.conf.TimeEndField != "" {
+		if end, found := ad.Fields[gao.conf.TimeEndField].(int64); found {
+			a.TimeEnd = end / int64(time.Millisecond)
+		}
+	}
+	return
+}
+
+func (gao *GrafanaAnnotationOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			a, localErr := gao.annotation(newAlertData(pack.Message))
+			pack.Recycle()
+
+			var body []byte
+			if localErr == nil {
+				if body, localErr = json.Marshal(a); localErr == nil {
+					localErr = postWithRetries(gao.client, gao.url, "application/json", gao.headers,
+						body, gao.conf.MaxRetries, gao.delay)
+				}
+			}
+			if localErr != nil {
+				or.LogError(fmt.Errorf("Unable to create annotation: %s", localErr))
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("GrafanaAnnotationOutput", func() interface{} {
+		return new(GrafanaAnnotationOutput)
+	})
+}
@@ -0,0 +1,106 @@
+package plugins
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter emitting a per host availability item, 1 when metrics for the host
+// flowed during the last alive_window seconds, 0 otherwise. Gives Zabbix an
+// availability signal for hosts only monitored through trapper data.
+type HostAliveFilter struct {
+	conf        *HostAliveFilterConfig
+	window      time.Duration
+	forgetAfter time.Duration
+	lastSeen    map[string]time.Time
+}
+
+type HostAliveFilterConfig struct {
+	// Seconds without metrics before a host is reported dead
+	AliveWindow uint `toml:"alive_window"`
+
+	// Seconds without metrics before a dead host isn't reported anymore,
+	// 0 to report dead hosts forever
+	ForgetAfter uint `toml:"forget_after"`
+
+	// Key of the generated item
+	Key string `toml:"key"`
+
+	// Message type for outbound messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (haf *HostAliveFilter) ConfigStruct() interface{} {
+	return &HostAliveFilterConfig{
+		AliveWindow: uint(120),
+		ForgetAfter: uint(86400),
+		Key:         "heka.host.alive",
+		MessageType: "zabbix",
+	}
+}
+
+func (haf *HostAliveFilter) Init(config interface{}) (err error) {
+	haf.conf = config.(*HostAliveFilterConfig)
+	if haf.conf.AliveWindow == 0 {
+		return fmt.Errorf("alive_window must be > 0")
+	}
+	haf.window = time.Duration(haf.conf.AliveWindow) * time.Second
+	haf.forgetAfter = time.Duration(haf.conf.ForgetAfter) * time.Second
+	haf.lastSeen = make(map[string]time.Time)
+	return
+}
+
+func (haf *HostAliveFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = fr.InChan()
+		ticker = fr.Ticker()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			// Ignore our own items if the matcher lets them in
+			if key, _ := fieldToString("key", pack); key != haf.conf.Key {
+				if host, localErr := fieldToString("host", pack); localErr == nil {
+					haf.lastSeen[host] = time.Now()
+				}
+			}
+			pack.Recycle()
+
+		case now := <-ticker:
+			for host, seen := range haf.lastSeen {
+				value := "1"
+				if now.Sub(seen) > haf.window {
+					value = "0"
+					if haf.forgetAfter != 0 && now.Sub(seen) > haf.forgetAfter {
+						delete(haf.lastSeen, host)
+						continue
+					}
+				}
+
+				pack2, localErr := newZabbixMetricPack(h, 0, haf.conf.MessageType, host, haf.conf.Key, value, now)
+				if localErr != nil {
+					fr.LogError(localErr)
+					break
+				}
+				fr.Inject(pack2)
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("HostAliveFilter", func() interface{} {
+		return new(HostAliveFilter)
+	})
+}
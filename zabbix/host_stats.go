@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Counters kept for a single host
+type hostCounters struct {
+	Accepted int64 `json:"accepted"`
+	Sent     int64 `json:"sent"`
+	Dropped  int64 `json:"dropped"`
+	Filtered int64 `json:"filtered"`
+	Errors   int64 `json:"errors"`
+	// Volume of the host evicted to make room for this one, counted when
+	// picking the next host to evict
+	floor int64
+}
+
+func (hc *hostCounters) volume() int64 {
+	return hc.Accepted + hc.Filtered + hc.Errors
+}
+
+func (hc *hostCounters) add(o *hostCounters) {
+	hc.Accepted += o.Accepted
+	hc.Sent += o.Sent
+	hc.Dropped += o.Dropped
+	hc.Filtered += o.Filtered
+	hc.Errors += o.Errors
+}
+
+type hostStatsEntry struct {
+	Host string `json:"host"`
+	hostCounters
+}
+
+// Per host counters, bounded to a multiple of the reported top N. Once the
+// table is full a new host replaces the one with the lowest volume, whose
+// counters move to "other", like the space-saving algorithm: the newcomer
+// starts from the evicted volume so the busy hosts stay in even among many
+// small ones. Sent records may be counted from the sender goroutine, hence
+// the lock.
+type hostStats struct {
+	lock  sync.Mutex
+	top   int
+	hosts map[string]*hostCounters
+	other hostCounters
+}
+
+const hostStatsTrackedFactor = 4
+
+func newHostStats(top uint) *hostStats {
+	if top == 0 {
+		return nil
+	}
+	return &hostStats{top: int(top), hosts: make(map[string]*hostCounters)}
+}
+
+func (hs *hostStats) get(host string) *hostCounters {
+	if hc, found := hs.hosts[host]; found {
+		return hc
+	}
+	hc := new(hostCounters)
+	if len(hs.hosts) >= hs.top*hostStatsTrackedFactor {
+		var (
+			evicted string
+			lowest  *hostCounters
+		)
+		for h, c := range hs.hosts {
+			if lowest == nil || c.volume()+c.floor < lowest.volume()+lowest.floor {
+				evicted, lowest = h, c
+			}
+		}
+		hs.other.add(lowest)
+		delete(hs.hosts, evicted)
+		hc.floor = lowest.volume() + lowest.floor
+	}
+	hs.hosts[host] = hc
+	return hc
+}
+
+type hostStatsEvent int
+
+const (
+	hostAccepted hostStatsEvent = iota
+	hostSent
+	hostDropped
+	hostFiltered
+	hostError
+)
+
+func (hs *hostStats) count(host string, ev hostStatsEvent, n int64) {
+	if hs == nil {
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hc := hs.get(host)
+	switch ev {
+	case hostAccepted:
+		hc.Accepted += n
+	case hostSent:
+		hc.Sent += n
+	case hostDropped:
+		hc.Dropped += n
+	case hostFiltered:
+		hc.Filtered += n
+	case hostError:
+		hc.Errors += n
+	}
+}
+
+// Counts encoded records, the host is read back from each record.
+func (hs *hostStats) countRecords(records [][]byte, ev hostStatsEvent) {
+	if hs == nil {
+		return
+	}
+
+	var r struct {
+		Host string `json:"host"`
+	}
+	for _, record := range records {
+		r.Host = ""
+		json.Unmarshal(record, &r)
+		hs.count(r.Host, ev, 1)
+	}
+}
+
+type byVolume []hostStatsEntry
+
+func (b byVolume) Len() int           { return len(b) }
+func (b byVolume) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byVolume) Less(i, j int) bool { return b[i].volume() > b[j].volume() }
+
+// Top hosts by volume, followed by the "other" bucket if in use.
+func (hs *hostStats) topN() (entries []hostStatsEntry) {
+	if hs == nil {
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	entries = make([]hostStatsEntry, 0, len(hs.hosts))
+	for host, hc := range hs.hosts {
+		entries = append(entries, hostStatsEntry{host, *hc})
+	}
+	sort.Sort(byVolume(entries))
+	if len(entries) > hs.top {
+		entries = entries[:hs.top]
+	}
+
+	if hs.other.volume() > 0 {
+		entries = append(entries, hostStatsEntry{"other", hs.other})
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package plugins
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Values of a key since the last one sent, with item_delay
+type itemDelayWindow struct {
+	sent  time.Time
+	sum   float64
+	count int
+	// All the values held were integers, the average is rounded
+	integral bool
+}
+
+// Whether a value comes before the delay of its item elapsed since the last
+// one sent, by the message timestamps. With item_delay "average" the numeric
+// values held back are averaged into the next one sent, the others are
+// dropped.
+func (zo *ZabbixOutput) throttled(pack *PipelinePack, host string, key string, delay time.Duration) bool {
+	if zo.item_delays == nil || delay <= 0 {
+		return false
+	}
+	ts := time.Unix(0, pack.Message.GetTimestamp())
+
+	windows := zo.item_delays[host]
+	if windows == nil {
+		windows = make(map[string]*itemDelayWindow)
+		zo.item_delays[host] = windows
+	}
+	w := windows[key]
+	if w == nil {
+		windows[key] = &itemDelayWindow{sent: ts, integral: true}
+		return false
+	}
+
+	value, integral, numeric := numericValue(pack)
+	if ts.Sub(w.sent) < delay {
+		if numeric && zo.conf.ItemDelay == "average" {
+			w.sum += value
+			w.count++
+			w.integral = w.integral && integral
+		}
+		return true
+	}
+
+	if w.count > 0 && numeric {
+		avg := (w.sum + value) / float64(w.count+1)
+		if w.integral && integral {
+			setValue(pack, int64(math.Floor(avg+0.5)))
+		} else {
+			setValue(pack, avg)
+		}
+	}
+	*w = itemDelayWindow{sent: ts, integral: true}
+	return false
+}
+
+// Value field of a message as a number, numeric is false when it isn't one.
+func numericValue(pack *PipelinePack) (value float64, integral bool, numeric bool) {
+	tmp, found := pack.Message.GetFieldValue("value")
+	if !found {
+		return
+	}
+	switch v := tmp.(type) {
+	case int64:
+		return float64(v), true, true
+	case float64:
+		return v, false, true
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return float64(n), true, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, false, true
+		}
+	}
+	return
+}
+
+// Replaces the value field of a message.
+func setValue(pack *PipelinePack, value interface{}) {
+	field, err := message.NewField("value", value, "")
+	if err != nil {
+		return
+	}
+	if prev := pack.Message.FindFirstField("value"); prev != nil {
+		pack.Message.DeleteField(prev)
+	}
+	pack.Message.AddField(field)
+}
@@ -0,0 +1,128 @@
+package plugins
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Zabbix item value types
+const (
+	ZabbixValueFloat    = 0
+	ZabbixValueChar     = 1
+	ZabbixValueLog      = 2
+	ZabbixValueUnsigned = 3
+	ZabbixValueText     = 4
+	// Not known, values are formatted from their own type
+	ZabbixValueAuto = -1
+)
+
+// Value types by configuration name
+var zabbixValueTypes = map[string]int{
+	"":          ZabbixValueAuto,
+	"float":     ZabbixValueFloat,
+	"character": ZabbixValueChar,
+	"log":       ZabbixValueLog,
+	"unsigned":  ZabbixValueUnsigned,
+	"text":      ZabbixValueText,
+}
+
+func parseValueType(name string) (int, error) {
+	if vt, ok := zabbixValueTypes[name]; ok {
+		return vt, nil
+	}
+	return ZabbixValueAuto, fmt.Errorf("Invalid value_type: %s, only 'float', 'character', 'log', 'unsigned' or 'text' allowed.", name)
+}
+
+// Item settings fetched from the Zabbix API.
+type ZabbixItemMetadata struct {
+	ItemId    string `json:"itemid"`
+	ValueType int    `json:"value_type"`
+	Units     string `json:"units"`
+	History   string `json:"history"`
+	Trends    string `json:"trends"`
+}
+
+// Per host item metadata shared by the plugins of this package. Refreshed
+// by ZabbixOutput when item_metadata_interval is set.
+type itemMetadataCache struct {
+	lock  sync.RWMutex
+	hosts map[string]map[string]ZabbixItemMetadata
+}
+
+var itemMetadata = &itemMetadataCache{
+	hosts: make(map[string]map[string]ZabbixItemMetadata),
+}
+
+// Returns the cached metadata of an item, for use by encoders and filters.
+func LookupItemMetadata(host string, key string) (md ZabbixItemMetadata, found bool) {
+	itemMetadata.lock.RLock()
+	defer itemMetadata.lock.RUnlock()
+
+	if items, ok := itemMetadata.hosts[host]; ok {
+		md, found = items[key]
+	}
+	return
+}
+
+// Whether the items of a host have been fetched.
+func (c *itemMetadataCache) known(host string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, ok := c.hosts[host]
+	return ok
+}
+
+func (c *itemMetadataCache) update(host string, items map[string]ZabbixItemMetadata) {
+	c.lock.Lock()
+	c.hosts[host] = items
+	c.lock.Unlock()
+}
+
+// Checks a value can be stored by an item of the given value type.
+func validItemValue(valueType int, value string) bool {
+	switch valueType {
+	case ZabbixValueFloat:
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case ZabbixValueUnsigned:
+		_, err := strconv.ParseUint(value, 10, 64)
+		return err == nil
+	}
+	return true
+}
+
+// Formats a message field value for an item of the given value type.
+// Strings go as is, floats keep their full precision and the integral ones
+// of unsigned items are sent without decimals.
+func formatItemValue(v interface{}, valueType int) (string, error) {
+	switch vt := v.(type) {
+	case string:
+		return vt, nil
+	case []byte:
+		return string(vt), nil
+	case bool:
+		return strconv.FormatBool(vt), nil
+	case int:
+		return formatItemValue(int64(vt), valueType)
+	case int32:
+		return formatItemValue(int64(vt), valueType)
+	case int64:
+		if valueType == ZabbixValueUnsigned && vt < 0 {
+			return "", fmt.Errorf("Value %d invalid for an unsigned item", vt)
+		}
+		return strconv.FormatInt(vt, 10), nil
+	case float32:
+		return formatItemValue(float64(vt), valueType)
+	case float64:
+		if valueType == ZabbixValueUnsigned {
+			if vt < 0 || vt != math.Trunc(vt) || vt >= math.MaxUint64 {
+				return "", fmt.Errorf("Value %v invalid for an unsigned item", vt)
+			}
+			return strconv.FormatUint(uint64(vt), 10), nil
+		}
+		return strconv.FormatFloat(vt, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("Unexpected value type %T", v)
+}
@@ -0,0 +1,65 @@
+package plugins
+
+import (
+	"strings"
+
+	"github.com/mathpl/active_zabbix"
+)
+
+// Whether a message key is in the key list of a host. With key_match
+// "prefix" it matches the listed keys starting with it, vfs.fs.size
+// matching the discovered vfs.fs.size[/,free], and with "glob" the listed
+// keys are patterns where * and ? stand for any characters and any single
+// one. The outcome is remembered per host until its list is fetched again.
+func (zo *ZabbixOutput) keyListed(host string, hc active_zabbix.HostActiveKeys, key string) bool {
+	if _, found := hc[key]; found || zo.conf.KeyMatch == "exact" {
+		return found
+	}
+
+	matches := zo.key_matches[host]
+	if matched, found := matches[key]; found {
+		return matched
+	}
+	if matches == nil {
+		matches = make(map[string]bool)
+		zo.key_matches[host] = matches
+	}
+
+	matched := false
+	for listed, _ := range hc {
+		if zo.conf.KeyMatch == "prefix" && strings.HasPrefix(listed, key) ||
+			zo.conf.KeyMatch == "glob" && globMatch(listed, key) {
+			matched = true
+			break
+		}
+	}
+	matches[key] = matched
+	return matched
+}
+
+// Matches s against a pattern where * stands for any characters and ? for
+// any single one, everything else, brackets included, matches itself.
+func globMatch(pattern string, s string) bool {
+	// Last * of the pattern and where its match ends in s, to backtrack to
+	star, retry := -1, 0
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, retry = p, i
+			p++
+		case star >= 0:
+			retry++
+			p, i = star+1, retry
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
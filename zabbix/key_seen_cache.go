@@ -0,0 +1,49 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Loads the keys seen before a restart, leaving out the ones not seen
+// within key_seen_window.
+func (zo *ZabbixOutput) loadKeySeen(now time.Time) (err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(zo.conf.KeySeenFile); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var saved map[string]HostSeenKeys
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Invalid key seen file %s: %s", zo.conf.KeySeenFile, err)
+	}
+
+	for host, hs := range saved {
+		for key, t := range hs {
+			if now.After(t.Add(zo.key_seen_window)) {
+				delete(hs, key)
+			}
+		}
+		if len(hs) > 0 {
+			zo.key_seen[host] = hs
+		}
+	}
+	return
+}
+
+// Saves the keys seen, replacing the file at once.
+func (zo *ZabbixOutput) saveKeySeen() (err error) {
+	var data []byte
+	if data, err = json.Marshal(zo.key_seen); err != nil {
+		return
+	}
+	if err = replaceFile(zo.conf.KeySeenFile, data); err != nil {
+		err = fmt.Errorf("Unable to save key seen: %s", err)
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package plugins
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Secondary Zabbix server receiving a copy of every accepted record. Each
+// mirror batches, retries and drops on its own so a failing mirror never
+// holds back the primary servers, or the other mirrors.
+type zabbixMirror struct {
+	client    *zabbixClient
+	records   chan []byte
+	retry     retryPolicy
+	batchSize int
+	maxBytes  int
+	maxBuffer int
+	interval  time.Duration
+	assemble  func([][]byte) []byte
+
+	buffered   int64
+	sent       int64
+	dropped    int64
+	sendErrors int64
+}
+
+// Mirror counters exposed in the report
+type zabbixMirrorState struct {
+	Address    string `json:"address"`
+	Buffered   int64  `json:"buffered"`
+	Sent       int64  `json:"sent"`
+	Dropped    int64  `json:"dropped"`
+	SendErrors int64  `json:"send_errors"`
+}
+
+func newZabbixMirror(client *zabbixClient, retry retryPolicy, batchSize int, maxBytes int, maxBuffer int,
+	interval time.Duration, assemble func([][]byte) []byte) *zabbixMirror {
+
+	// Flush at least every second without a ticker interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &zabbixMirror{
+		client:    client,
+		records:   make(chan []byte, batchSize),
+		retry:     retry,
+		batchSize: batchSize,
+		maxBytes:  maxBytes,
+		maxBuffer: maxBuffer,
+		interval:  interval,
+		assemble:  assemble,
+	}
+}
+
+// Queues a record without blocking, it's dropped when the mirror lags.
+func (m *zabbixMirror) push(record []byte) {
+	select {
+	case m.records <- record:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+func (m *zabbixMirror) state() zabbixMirrorState {
+	return zabbixMirrorState{
+		Address:    m.client.address,
+		Buffered:   atomic.LoadInt64(&m.buffered),
+		Sent:       atomic.LoadInt64(&m.sent),
+		Dropped:    atomic.LoadInt64(&m.dropped),
+		SendErrors: atomic.LoadInt64(&m.sendErrors),
+	}
+}
+
+// Sends the buffered records, returns the ones left after a failure.
+func (m *zabbixMirror) flush(buffer [][]byte) (left [][]byte, err error) {
+	left = buffer
+	for len(left) > 0 {
+		length := batchLength(left, m.batchSize, m.maxBytes)
+
+		var resp []byte
+		if resp, err = m.client.Send(stampRequest(m.assemble(left[:length]), time.Now())); err == nil {
+			_, err = parseSendResponse(resp)
+		}
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&m.sent, int64(length))
+		left = left[length:]
+	}
+	return
+}
+
+// Batches and sends the queued records until stop is closed.
+func (m *zabbixMirror) run(or OutputRunner, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer m.client.closeIdle()
+
+	var (
+		buffer   [][]byte
+		failures int
+		retryAt  time.Time
+	)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	send := func(force bool) {
+		if len(buffer) == 0 || (!force && failures > 0 && time.Now().Before(retryAt)) {
+			return
+		}
+
+		left, err := m.flush(buffer)
+		if err != nil {
+			atomic.AddInt64(&m.sendErrors, 1)
+			failures++
+			retryAt = time.Now().Add(m.retry.delay(failures))
+			or.LogError(fmt.Errorf("Mirror %s: %s", m.client.address, err))
+		} else {
+			failures = 0
+		}
+		buffer = append(buffer[:0], left...)
+		atomic.StoreInt64(&m.buffered, int64(len(buffer)))
+	}
+
+	for {
+		select {
+		case record := <-m.records:
+			// Keep the newest records when the buffer is full
+			if len(buffer) >= m.maxBuffer {
+				atomic.AddInt64(&m.dropped, 1)
+				buffer = append(buffer[:0], buffer[1:]...)
+			}
+			buffer = append(buffer, record)
+			atomic.StoreInt64(&m.buffered, int64(len(buffer)))
+			if len(buffer) >= m.batchSize {
+				send(false)
+			}
+		case <-ticker.C:
+			send(false)
+		case <-stop:
+			// Last attempt with what was queued
+			for len(m.records) > 0 {
+				buffer = append(buffer, <-m.records)
+			}
+			send(true)
+			return
+		}
+	}
+}
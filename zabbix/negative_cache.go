@@ -0,0 +1,116 @@
+package plugins
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keys the server rejects, unsupported items or keys without item,
+// suppressed for a while instead of being sent over and over.
+type negativeCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	reason string
+	until  time.Time
+}
+
+// Suppressed key, as reported
+type suppressedKey struct {
+	Host   string    `json:"host"`
+	Key    string    `json:"key"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// Returns nil, a cache suppressing nothing, when ttl is 0.
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	if ttl == 0 {
+		return nil
+	}
+	return &negativeCache{ttl: ttl, entries: make(map[string]map[string]negativeEntry)}
+}
+
+func (nc *negativeCache) add(host string, key string, reason string, now time.Time) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	keys, ok := nc.entries[host]
+	if !ok {
+		keys = make(map[string]negativeEntry)
+		nc.entries[host] = keys
+	}
+	keys[key] = negativeEntry{reason: reason, until: now.Add(nc.ttl)}
+}
+
+// Lifts the suppression of a key if it was for that reason.
+func (nc *negativeCache) remove(host string, key string, reason string) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	if e, ok := nc.entries[host][key]; ok && e.reason == reason {
+		delete(nc.entries[host], key)
+		if len(nc.entries[host]) == 0 {
+			delete(nc.entries, host)
+		}
+	}
+}
+
+// Whether a key is suppressed, expired entries are dropped on the way.
+func (nc *negativeCache) suppressed(host string, key string, now time.Time) bool {
+	if nc == nil {
+		return false
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	e, ok := nc.entries[host][key]
+	if ok && now.After(e.until) {
+		delete(nc.entries[host], key)
+		if len(nc.entries[host]) == 0 {
+			delete(nc.entries, host)
+		}
+		return false
+	}
+	return ok
+}
+
+func (nc *negativeCache) list(now time.Time) (l []suppressedKey) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+
+	for host, keys := range nc.entries {
+		for key, e := range keys {
+			if now.Before(e.until) {
+				l = append(l, suppressedKey{host, key, e.reason, e.until})
+			}
+		}
+	}
+	sort.Sort(bySuppressedKey(l))
+	return
+}
+
+type bySuppressedKey []suppressedKey
+
+func (l bySuppressedKey) Len() int      { return len(l) }
+func (l bySuppressedKey) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l bySuppressedKey) Less(i, j int) bool {
+	if l[i].Host != l[j].Host {
+		return l[i].Host < l[j].Host
+	}
+	return l[i].Key < l[j].Key
+}
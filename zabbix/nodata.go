@@ -0,0 +1,120 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+)
+
+// Types of the messages injected when keys in key_seen stop coming, with
+// nodata_after, and when one comes again
+const (
+	zabbixNodataType   = "zabbix.nodata"
+	zabbixNodataOkType = "zabbix.nodata.ok"
+)
+
+// Payload of the zabbix.nodata messages
+type nodataKey struct {
+	Key      string    `json:"key"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type nodataHost struct {
+	Host string      `json:"host"`
+	Keys []nodataKey `json:"keys"`
+}
+
+// Looks for the keys not seen for nodata_after, injecting a zabbix.nodata
+// message per host with the ones missing since the previous check. Only
+// called from the Run loop.
+func (zo *ZabbixOutput) checkNodata(now time.Time) {
+	after := time.Duration(zo.conf.NodataAfter)
+	for host, reported := range zo.nodata_reported {
+		for key, _ := range reported {
+			if _, found := zo.key_seen[host][key]; !found {
+				// Gone from key seen past key_seen_window
+				delete(reported, key)
+			}
+		}
+		if len(reported) == 0 {
+			delete(zo.nodata_reported, host)
+		}
+	}
+
+	for host, hs := range zo.key_seen {
+		var missing []nodataKey
+		for key, t := range hs {
+			if _, reported := zo.nodata_reported[host][key]; reported || now.Sub(t) < after {
+				continue
+			}
+			if zo.nodata_reported[host] == nil {
+				zo.nodata_reported[host] = make(map[string]time.Time)
+			}
+			zo.nodata_reported[host][key] = t
+			missing = append(missing, nodataKey{key, t})
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		sort.Sort(byNodataKey(missing))
+		payload, _ := json.Marshal(nodataHost{host, missing})
+		zo.injectNodata(zabbixNodataType, string(payload), map[string]interface{}{
+			"host":    host,
+			"missing": len(missing),
+		})
+	}
+}
+
+type byNodataKey []nodataKey
+
+func (b byNodataKey) Len() int           { return len(b) }
+func (b byNodataKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byNodataKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+
+// Injects a zabbix.nodata.ok message when a key reported missing comes
+// again.
+func (zo *ZabbixOutput) nodataSeen(host string, key string) {
+	since, found := zo.nodata_reported[host][key]
+	if !found {
+		return
+	}
+	delete(zo.nodata_reported[host], key)
+	payload := fmt.Sprintf("Key %s of host %s seen again, missing since %s", key, host, since.Format(time.RFC3339))
+	zo.injectNodata(zabbixNodataOkType, payload, map[string]interface{}{
+		"host":      host,
+		"key":       key,
+		"last_seen": since.Format(time.RFC3339),
+	})
+}
+
+func (zo *ZabbixOutput) injectNodata(typ string, payload string, fields map[string]interface{}) {
+	if zo.helper == nil {
+		return
+	}
+	pack := zo.helper.PipelinePack(0)
+	if pack == nil {
+		zo.runner.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", zo.helper.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name, _ := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, err := message.NewField(name, fields[name], "")
+		if err != nil {
+			zo.runner.LogError(fmt.Errorf("Unable to build %s message: %s", typ, err))
+			pack.Recycle()
+			return
+		}
+		pack.Message.AddField(field)
+	}
+	pack.Message.SetType(typ)
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetPayload(payload)
+	zo.runner.Inject(pack)
+}
@@ -84,6 +84,7 @@ type OpentsdbZabbixFilter struct {
 
 	metricName       string
 	valueName        string
+	valueType        int
 	tagPrefix        string
 	msgType          string
 	tagDelimiterMode string
@@ -105,6 +106,11 @@ type OpentsdbZabbixFilterConfig struct {
 	// Field in message used for the value name
 	ValueField string `toml:"value_field"`
 
+	// Value type of the generated items: float, character, log, unsigned
+	// or text, passed on as a value_type field. Empty to format the
+	// values from their own type.
+	ValueType string `toml:"value_type"`
+
 	// Prefix used in field for tags
 	TagPrefix string `toml:"tag_prefix"`
 
@@ -137,6 +143,22 @@ type OpentsdbZabbixFilterConfig struct {
 	ReplaceKey      [][]string `toml:"replace_key"`
 	ReplaceTagName  [][]string `toml:"replace_tag_name"`
 	ReplaceTagValue [][]string `toml:"replace_tag_value"`
+
+	// Where the tenant prefix comes from: "logger", "field" or empty
+	// to disable multi-tenant prefixing
+	TenantSource string `toml:"tenant_source"`
+
+	// Field holding the tenant when tenant_source is "field"
+	TenantField string `toml:"tenant_field"`
+
+	// Tenant used when the message doesn't carry one, messages without
+	// tenant are dropped if empty
+	DefaultTenant string `toml:"default_tenant"`
+
+	// Separators between the tenant and the host or key:
+	// tenantA_web01, tenantA.app.latency
+	TenantHostSeparator string `toml:"tenant_host_separator"`
+	TenantKeySeparator  string `toml:"tenant_key_separator"`
 }
 
 type SplitValueStrategy struct {
@@ -147,7 +169,9 @@ type SplitValueStrategy struct {
 
 func (ozf *OpentsdbZabbixFilter) ConfigStruct() interface{} {
 	return &OpentsdbZabbixFilterConfig{SortTags: true,
-		MaxKeyLength: ZABBIX_KEY_LENGTH_LIMIT}
+		MaxKeyLength:        ZABBIX_KEY_LENGTH_LIMIT,
+		TenantHostSeparator: "_",
+		TenantKeySeparator:  "."}
 }
 
 func mergeReplaceMaps(m [][]string) (rm map[string]string) {
@@ -182,6 +206,9 @@ func (ozf *OpentsdbZabbixFilter) Init(config interface{}) (err error) {
 	if ozf.valueName == "" {
 		ozf.valueName = "data.value"
 	}
+	if ozf.valueType, err = parseValueType(ozf.conf.ValueType); err != nil {
+		return
+	}
 	ozf.tagPrefix = ozf.conf.TagPrefix
 	if ozf.tagPrefix == "" {
 		ozf.tagPrefix = "data.tags."
@@ -195,6 +222,18 @@ func (ozf *OpentsdbZabbixFilter) Init(config interface{}) (err error) {
 		return
 	}
 
+	switch ozf.conf.TenantSource {
+	case "", "logger":
+	case "field":
+		if ozf.conf.TenantField == "" {
+			err = fmt.Errorf("tenant_source is 'field' but no tenant_field is defined.")
+			return
+		}
+	default:
+		err = fmt.Errorf("Invalid tenant source, only 'logger' or 'field' allowed.")
+		return
+	}
+
 	// Assemble the Replace maps
 	ozf.replace = mergeReplaceMaps(ozf.conf.Replace)
 	ozf.replaceKey = mergeReplaceMaps(ozf.conf.ReplaceKey)
@@ -241,6 +280,27 @@ func (ozf *OpentsdbZabbixFilter) applyShortening(keyExtension Tags) (shorter_key
 	return
 }
 
+// Returns the tenant of a message, empty when prefixing is disabled.
+func (ozf *OpentsdbZabbixFilter) tenant(pack *PipelinePack) (tenant string, err error) {
+	switch ozf.conf.TenantSource {
+	case "":
+		return
+	case "logger":
+		tenant = pack.Message.GetLogger()
+	case "field":
+		if v, ok := pack.Message.GetFieldValue(ozf.conf.TenantField); ok {
+			tenant, _ = v.(string)
+		}
+	}
+
+	if tenant == "" {
+		if tenant = ozf.conf.DefaultTenant; tenant == "" {
+			err = fmt.Errorf("Unable to find tenant in message.")
+		}
+	}
+	return
+}
+
 func (ozf *OpentsdbZabbixFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	var (
 		pack *PipelinePack
@@ -263,6 +323,14 @@ func (ozf *OpentsdbZabbixFilter) Run(fr FilterRunner, h PluginHelper) (err error
 			continue
 		}
 
+		var tenant string
+		if tenant, err = ozf.tenant(pack); err != nil {
+			fr.LogError(err)
+			pack.Recycle()
+			pack2.Recycle()
+			continue
+		}
+
 		fields := pack.Message.GetFields()
 		var host string
 		var value string
@@ -280,19 +348,7 @@ func (ozf *OpentsdbZabbixFilter) Run(fr FilterRunner, h PluginHelper) (err error
 			case "host":
 				host = v.(string)
 			case ozf.valueName:
-				switch vt := v.(type) {
-				case string:
-					value = vt
-				case int:
-				case int64:
-					value = fmt.Sprintf("%d", vt)
-				case float32:
-				case float64:
-					value = fmt.Sprintf("%f", vt)
-				default:
-					err = fmt.Errorf("Unexpected Value type %+V", v)
-					break
-				}
+				value, err = formatItemValue(v, ozf.valueType)
 			case ozf.metricName:
 				if vs, ok := v.(string); ok {
 					k = applyReplaceMap(k, ozf.replace)
@@ -349,6 +405,11 @@ func (ozf *OpentsdbZabbixFilter) Run(fr FilterRunner, h PluginHelper) (err error
 			continue
 		}
 
+		if tenant != "" {
+			host = tenant + ozf.conf.TenantHostSeparator + host
+			opentsdb_key = tenant + ozf.conf.TenantKeySeparator + opentsdb_key.(string)
+		}
+
 		zabbix_key := opentsdb_key.(string)
 		suffix := keyExtension.MakeKey(ozf.tagDelimiterMode)
 		if suffix != "" {
@@ -400,6 +461,16 @@ func (ozf *OpentsdbZabbixFilter) Run(fr FilterRunner, h PluginHelper) (err error
 		}
 		pack2.Message.AddField(field)
 
+		if ozf.conf.ValueType != "" {
+			if field, err = message.NewField("value_type", ozf.conf.ValueType, ""); err != nil {
+				err = fmt.Errorf("Unable to add value type: %s", err)
+				fr.LogError(err)
+				pack2.Recycle()
+				continue
+			}
+			pack2.Message.AddField(field)
+		}
+
 		pack2.Message.SetType(ozf.msgType)
 		pack2.Message.SetTimestamp(pack.Message.GetTimestamp())
 		fr.Inject(pack2)
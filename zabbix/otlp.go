@@ -0,0 +1,124 @@
+package plugins
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Subset of the OTLP metrics data model, in its protobuf JSON mapping as
+// used by OTLP/HTTP with the application/json content type.
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *otlpInt `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano otlpInt        `json:"timeUnixNano"`
+	AsDouble     *float64       `json:"asDouble,omitempty"`
+	AsInt        *otlpInt       `json:"asInt,omitempty"`
+}
+
+type otlpNumberPoints struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano otlpInt        `json:"timeUnixNano"`
+	Count        otlpInt        `json:"count"`
+	Sum          *float64       `json:"sum,omitempty"`
+}
+
+// Histograms and summaries are only reduced to their count and sum
+type otlpSummaryPoints struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name      string             `json:"name"`
+	Unit      string             `json:"unit,omitempty"`
+	Gauge     *otlpNumberPoints  `json:"gauge,omitempty"`
+	Sum       *otlpNumberPoints  `json:"sum,omitempty"`
+	Histogram *otlpSummaryPoints `json:"histogram,omitempty"`
+	Summary   *otlpSummaryPoints `json:"summary,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// 64 bits integers are strings in the JSON mapping, numbers are accepted
+// when decoding.
+type otlpInt int64
+
+func (i otlpInt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *otlpInt) UnmarshalJSON(b []byte) (err error) {
+	s := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err = json.Unmarshal(b, &s); err != nil {
+			return
+		}
+	}
+
+	// Unsigned fields like timestamps may not fit an int64
+	var n int64
+	if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+		var u uint64
+		if u, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return
+		}
+		n = int64(u)
+	}
+	*i = otlpInt(n)
+	return
+}
+
+func otlpString(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+// String representation of an attribute value, empty for arrays and maps.
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal gRPC over HTTP/2 for the OTLP metrics service, the messages are
+// encoded and decoded by otlp_proto.go like the OTLP/HTTP protobuf bodies.
+
+// Method path of MetricsService.Export
+const otlpGrpcExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// gRPC status codes used
+const (
+	grpcOk              = 0
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+)
+
+// Prefixes a message with the uncompressed flag and its length.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// Reads a single length prefixed message of at most max bytes, gunzipping
+// it when flagged compressed with grpc-encoding gzip.
+func readGrpcFrame(r io.Reader, encoding string, max int64) (msg []byte, err error) {
+	prefix := make([]byte, 5)
+	if _, err = io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("Unable to read message prefix: %s", err)
+	}
+	length := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if length > max {
+		return nil, fmt.Errorf("Message too large: %d bytes", length)
+	}
+	msg = make([]byte, length)
+	if _, err = io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("Unable to read message: %s", err)
+	}
+	if prefix[0] == 0 {
+		return
+	}
+
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("Unsupported message encoding: %q", encoding)
+	}
+	var gz *gzip.Reader
+	if gz, err = gzip.NewReader(bytes.NewReader(msg)); err != nil {
+		return nil, fmt.Errorf("Unable to decompress message: %s", err)
+	}
+	defer gz.Close()
+	if msg, err = ioutil.ReadAll(io.LimitReader(gz, max+1)); err != nil {
+		return nil, fmt.Errorf("Unable to decompress message: %s", err)
+	}
+	if int64(len(msg)) > max {
+		return nil, fmt.Errorf("Message too large after decompression")
+	}
+	return
+}
+
+// Answers a call with a status, and the message when the status is OK. The
+// status goes in the trailers.
+func writeGrpcResponse(w http.ResponseWriter, msg []byte, status int, message string) {
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	if status == grpcOk {
+		w.Write(grpcFrame(msg))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if message != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// Codes worth retrying the call on, as listed by the OTLP specification:
+// cancelled, deadline exceeded, resource exhausted, aborted, out of range,
+// unavailable and data loss.
+var grpcRetryable = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+// Calls a unary method, retrying like postWithRetries.
+func grpcCallWithRetries(client *http.Client, url string, headers map[string]string, msg []byte,
+	retries uint, delay time.Duration) (err error) {
+
+	for attempt := uint(0); ; attempt++ {
+		var retry bool
+		if retry, err = grpcCall(client, url, headers, msg); err == nil || !retry || attempt >= retries {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+func grpcCall(client *http.Client, callUrl string, headers map[string]string, msg []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", callUrl, bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	// Trailers are only there once the body is read
+	ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500 || resp.StatusCode == 429, fmt.Errorf("%s returned %s", callUrl, resp.Status)
+	}
+	// Calls failing right away carry the status in the headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return true, fmt.Errorf("%s returned no gRPC status", callUrl)
+	}
+	if code == grpcOk {
+		return false, nil
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return grpcRetryable[code], fmt.Errorf("%s returned gRPC status %d: %s", callUrl, code, strings.TrimSpace(message))
+}
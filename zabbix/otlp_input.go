@@ -0,0 +1,311 @@
+package plugins
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Input receiving OTLP metrics over OTLP/HTTP, both protobuf and JSON
+// encoded, and over OTLP/gRPC, flattening every data point into a
+// host/key/value message with the data point attributes as extra fields.
+type OtlpInput struct {
+	conf         *OtlpInputConfig
+	listener     net.Listener
+	grpcListener net.Listener
+	ir           InputRunner
+	h            PluginHelper
+}
+
+type OtlpInputConfig struct {
+	// Address to listen on
+	Address string `toml:"address"`
+	// Path receiving the export requests
+	Path string `toml:"path"`
+	// Address to listen on for OTLP/gRPC, without TLS, usually ":4317".
+	// Empty not to.
+	GrpcAddress string `toml:"grpc_address"`
+
+	// Resource attributes used as host, the first one found wins
+	HostAttributes []string `toml:"host_attributes"`
+	// Host of the data points without any of the host attributes
+	DefaultHost string `toml:"default_host"`
+
+	// Maximum request size in bytes, after decompression
+	MaxRequestSize int64 `toml:"max_request_size"`
+
+	// Message type for generated messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (oi *OtlpInput) ConfigStruct() interface{} {
+	return &OtlpInputConfig{
+		Address:        ":4318",
+		Path:           "/v1/metrics",
+		HostAttributes: []string{"host.name", "service.name"},
+		MaxRequestSize: int64(4 * 1024 * 1024),
+		MessageType:    "zabbix",
+	}
+}
+
+func (oi *OtlpInput) Init(config interface{}) (err error) {
+	oi.conf = config.(*OtlpInputConfig)
+	if oi.listener, err = net.Listen("tcp", oi.conf.Address); err != nil {
+		return fmt.Errorf("Listener failed to start: %s", err)
+	}
+	if oi.conf.GrpcAddress != "" {
+		if oi.grpcListener, err = net.Listen("tcp", oi.conf.GrpcAddress); err != nil {
+			oi.listener.Close()
+			return fmt.Errorf("gRPC listener failed to start: %s", err)
+		}
+	}
+	return
+}
+
+// Flattened data point
+type otlpPoint struct {
+	host       string
+	key        string
+	value      string
+	ts         int64
+	attributes []otlpKeyValue
+}
+
+func (oi *OtlpInput) host(resource otlpResource) string {
+	for _, name := range oi.conf.HostAttributes {
+		for _, kv := range resource.Attributes {
+			if kv.Key == name {
+				if v := kv.Value.String(); v != "" {
+					return v
+				}
+			}
+		}
+	}
+	return oi.conf.DefaultHost
+}
+
+func otlpNumber(dp otlpNumberDataPoint) string {
+	if dp.AsInt != nil {
+		return strconv.FormatInt(int64(*dp.AsInt), 10)
+	}
+	if dp.AsDouble != nil {
+		return strconv.FormatFloat(*dp.AsDouble, 'f', -1, 64)
+	}
+	return "0"
+}
+
+func (oi *OtlpInput) flatten(req *otlpMetricsRequest) (points []otlpPoint) {
+	for _, rm := range req.ResourceMetrics {
+		host := oi.host(rm.Resource)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				for _, np := range []*otlpNumberPoints{m.Gauge, m.Sum} {
+					if np == nil {
+						continue
+					}
+					for _, dp := range np.DataPoints {
+						points = append(points, otlpPoint{host, m.Name, otlpNumber(dp),
+							int64(dp.TimeUnixNano), dp.Attributes})
+					}
+				}
+
+				for _, sp := range []*otlpSummaryPoints{m.Histogram, m.Summary} {
+					if sp == nil {
+						continue
+					}
+					for _, dp := range sp.DataPoints {
+						points = append(points, otlpPoint{host, m.Name + ".count",
+							strconv.FormatInt(int64(dp.Count), 10), int64(dp.TimeUnixNano), dp.Attributes})
+						if dp.Sum != nil {
+							points = append(points, otlpPoint{host, m.Name + ".sum",
+								strconv.FormatFloat(*dp.Sum, 'f', -1, 64), int64(dp.TimeUnixNano), dp.Attributes})
+						}
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func (oi *OtlpInput) inject(p otlpPoint) (err error) {
+	pack := <-oi.ir.InChan()
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetType(oi.conf.MessageType)
+	pack.Message.SetLogger(oi.ir.Name())
+	ts := p.ts
+	if ts == 0 {
+		ts = time.Now().UnixNano()
+	}
+	pack.Message.SetTimestamp(ts)
+
+	fields := [][2]string{{"key", p.key}, {"host", p.host}, {"value", p.value}}
+	for _, kv := range p.attributes {
+		// Don't shadow the metric fields
+		if kv.Key != "key" && kv.Key != "host" && kv.Key != "value" {
+			fields = append(fields, [2]string{kv.Key, kv.Value.String()})
+		}
+	}
+	for _, f := range fields {
+		var field *message.Field
+		if field, err = message.NewField(f[0], f[1], ""); err != nil {
+			pack.Recycle()
+			return fmt.Errorf("Unable to add %s: %s", f[0], err)
+		}
+		pack.Message.AddField(field)
+	}
+
+	oi.ir.Inject(pack)
+	return
+}
+
+func (oi *OtlpInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(body, oi.conf.MaxRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(raw)) > oi.conf.MaxRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var (
+		req  *otlpMetricsRequest
+		resp []byte
+	)
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/json") {
+		req = &otlpMetricsRequest{}
+		err = json.Unmarshal(raw, req)
+		resp = []byte("{}")
+	} else {
+		req, err = decodeOtlpMetricsRequest(raw)
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		oi.ir.LogError(fmt.Errorf("Invalid OTLP request from %s: %s", r.RemoteAddr, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	oi.injectAll(req)
+
+	// Empty ExportMetricsServiceResponse, full success
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (oi *OtlpInput) injectAll(req *otlpMetricsRequest) {
+	for _, p := range oi.flatten(req) {
+		if err := oi.inject(p); err != nil {
+			oi.ir.LogError(err)
+		}
+	}
+}
+
+// Handles the gRPC calls, only MetricsService.Export is served.
+func (oi *OtlpInput) serveGrpc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.URL.Path != otlpGrpcExportPath {
+		writeGrpcResponse(w, nil, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+
+	raw, err := readGrpcFrame(r.Body, r.Header.Get("Grpc-Encoding"), oi.conf.MaxRequestSize)
+	if err != nil {
+		oi.ir.LogError(fmt.Errorf("Invalid OTLP gRPC request from %s: %s", r.RemoteAddr, err))
+		writeGrpcResponse(w, nil, grpcInvalidArgument, err.Error())
+		return
+	}
+	req, err := decodeOtlpMetricsRequest(raw)
+	if err != nil {
+		oi.ir.LogError(fmt.Errorf("Invalid OTLP gRPC request from %s: %s", r.RemoteAddr, err))
+		writeGrpcResponse(w, nil, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	oi.injectAll(req)
+
+	// Empty ExportMetricsServiceResponse, full success
+	writeGrpcResponse(w, nil, grpcOk, "")
+}
+
+func (oi *OtlpInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	oi.ir = ir
+	oi.h = h
+
+	grpcDone := make(chan error, 1)
+	if oi.grpcListener != nil {
+		// gRPC is HTTP/2 only, over cleartext connections
+		handler := h2c.NewHandler(http.HandlerFunc(oi.serveGrpc), &http2.Server{})
+		go func() {
+			grpcDone <- http.Serve(oi.grpcListener, handler)
+		}()
+	} else {
+		grpcDone <- nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(oi.conf.Path, oi)
+	err = http.Serve(oi.listener, mux)
+	if oi.grpcListener != nil {
+		oi.grpcListener.Close()
+	}
+	grpcErr := <-grpcDone
+
+	// Serve returns an error once the listener is closed by Stop
+	if strings.Contains(err.Error(), "use of closed network connection") {
+		err = nil
+	}
+	if err == nil && grpcErr != nil && !strings.Contains(grpcErr.Error(), "use of closed network connection") {
+		err = grpcErr
+	}
+	return
+}
+
+func (oi *OtlpInput) Stop() {
+	oi.listener.Close()
+	if oi.grpcListener != nil {
+		oi.grpcListener.Close()
+	}
+}
+
+func init() {
+	RegisterPlugin("OtlpInput", func() interface{} {
+		return new(OtlpInput)
+	})
+}
@@ -0,0 +1,250 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output exporting metric messages as OTLP gauges to an OpenTelemetry
+// collector, over OTLP/HTTP with JSON encoding or over OTLP/gRPC. The data
+// points of a failed export are kept, up to max_buffered_points, and sent
+// again on the next flush.
+type OtlpOutput struct {
+	conf     *OtlpOutputConfig
+	client   *http.Client
+	url      string
+	interval time.Duration
+	delay    time.Duration
+	hosts    map[string]map[string]*otlpMetric
+	count    uint
+	// Whether the last export failed, only retried by the flush ticker
+	failed bool
+}
+
+type OtlpOutputConfig struct {
+	// "http/json" or "grpc"
+	Protocol string `toml:"protocol"`
+	// OTLP/HTTP metrics endpoint of the collector, or its OTLP/gRPC address
+	// as http://host:4317, https:// for TLS
+	Url string `toml:"url"`
+	// Extra request headers, e.g. for authentication
+	Headers map[string]string `toml:"headers"`
+
+	// Fields holding the host, which becomes the host.name resource
+	// attribute, the metric name and its value
+	HostField  string `toml:"host_field"`
+	NameField  string `toml:"name_field"`
+	ValueField string `toml:"value_field"`
+
+	// Fields added as data point attributes
+	AttributeFields []string `toml:"attribute_fields"`
+
+	// Data points sent per request
+	FlushCount uint `toml:"flush_count"`
+	// Data points kept while exports fail, the ones over it are dropped
+	MaxBufferedPoints uint `toml:"max_buffered_points"`
+	// Seconds between flushes of incomplete requests
+	FlushInterval uint `toml:"flush_interval"`
+
+	// Seconds a request may take
+	Timeout uint `toml:"timeout"`
+	// Retries of a failed request and seconds between retries
+	MaxRetries uint `toml:"max_retries"`
+	RetryDelay uint `toml:"retry_delay"`
+}
+
+func (oo *OtlpOutput) ConfigStruct() interface{} {
+	return &OtlpOutputConfig{
+		Protocol:          "http/json",
+		Url:               "http://localhost:4318/v1/metrics",
+		HostField:         "host",
+		NameField:         "key",
+		ValueField:        "value",
+		FlushCount:        uint(500),
+		MaxBufferedPoints: uint(10000),
+		FlushInterval:     uint(10),
+		Timeout:           uint(10),
+		MaxRetries:        uint(3),
+		RetryDelay:        uint(5),
+	}
+}
+
+func (oo *OtlpOutput) Init(config interface{}) (err error) {
+	oo.conf = config.(*OtlpOutputConfig)
+
+	if oo.conf.Url == "" {
+		return fmt.Errorf("url must be set")
+	}
+	if oo.conf.FlushCount == 0 || oo.conf.FlushInterval == 0 {
+		return fmt.Errorf("flush_count and flush_interval must be > 0")
+	}
+	if oo.conf.MaxBufferedPoints < oo.conf.FlushCount {
+		return fmt.Errorf("max_buffered_points must be >= flush_count")
+	}
+
+	timeout := time.Duration(oo.conf.Timeout) * time.Second
+	switch oo.conf.Protocol {
+	case "http/json":
+		oo.client = &http.Client{Timeout: timeout}
+		oo.url = oo.conf.Url
+	case "grpc":
+		var u *url.URL
+		if u, err = url.Parse(oo.conf.Url); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Invalid url: %s, only http://host:port or https://host:port allowed with grpc.", oo.conf.Url)
+		}
+		// gRPC is HTTP/2 only, over cleartext connections for http://
+		transport := &http2.Transport{AllowHTTP: true}
+		if u.Scheme == "http" {
+			transport.DialTLS = func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, timeout)
+			}
+		}
+		oo.client = &http.Client{Timeout: timeout, Transport: transport}
+		oo.url = strings.TrimRight(oo.conf.Url, "/") + otlpGrpcExportPath
+	default:
+		return fmt.Errorf("Invalid protocol: %s, only 'http/json' or 'grpc' allowed.", oo.conf.Protocol)
+	}
+	oo.interval = time.Duration(oo.conf.FlushInterval) * time.Second
+	oo.delay = time.Duration(oo.conf.RetryDelay) * time.Second
+	oo.hosts = make(map[string]map[string]*otlpMetric)
+	return
+}
+
+// Adds the data point of a message to the pending request.
+func (oo *OtlpOutput) add(pack *PipelinePack) (err error) {
+	msg := pack.Message
+	name := messageValue(msg, oo.conf.NameField)
+	if name == "" {
+		return fmt.Errorf("Unable to find fieldname: %s", oo.conf.NameField)
+	}
+	var value float64
+	if value, err = strconv.ParseFloat(messageValue(msg, oo.conf.ValueField), 64); err != nil {
+		return fmt.Errorf("Non numeric value for %s: %s", name, err)
+	}
+	if oo.count >= oo.conf.MaxBufferedPoints {
+		return fmt.Errorf("Dropped data point of %s, %d data points buffered", name, oo.count)
+	}
+
+	dp := otlpNumberDataPoint{
+		TimeUnixNano: otlpInt(msg.GetTimestamp()),
+		AsDouble:     &value,
+	}
+	for _, f := range oo.conf.AttributeFields {
+		if v := messageValue(msg, f); v != "" {
+			dp.Attributes = append(dp.Attributes, otlpString(f, v))
+		}
+	}
+
+	host := messageValue(msg, oo.conf.HostField)
+	metrics, found := oo.hosts[host]
+	if !found {
+		metrics = make(map[string]*otlpMetric)
+		oo.hosts[host] = metrics
+	}
+	m, found := metrics[name]
+	if !found {
+		m = &otlpMetric{Name: name, Gauge: &otlpNumberPoints{}}
+		metrics[name] = m
+	}
+	m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+	oo.count++
+	return
+}
+
+// Sends the pending request, the data points are kept for the next flush
+// when it fails.
+func (oo *OtlpOutput) flush() (err error) {
+	if oo.count == 0 {
+		return
+	}
+
+	req := otlpMetricsRequest{}
+	for host, metrics := range oo.hosts {
+		rm := otlpResourceMetrics{ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "heka"}}}}
+		if host != "" {
+			rm.Resource.Attributes = []otlpKeyValue{otlpString("host.name", host)}
+		}
+		for _, m := range metrics {
+			rm.ScopeMetrics[0].Metrics = append(rm.ScopeMetrics[0].Metrics, *m)
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, rm)
+	}
+
+	if oo.conf.Protocol == "grpc" {
+		err = grpcCallWithRetries(oo.client, oo.url, oo.conf.Headers, encodeOtlpMetricsRequest(&req),
+			oo.conf.MaxRetries, oo.delay)
+	} else {
+		var body []byte
+		if body, err = json.Marshal(req); err != nil {
+			return
+		}
+		err = postWithRetries(oo.client, oo.url, "application/json", oo.conf.Headers,
+			body, oo.conf.MaxRetries, oo.delay)
+	}
+	if oo.failed = err != nil; oo.failed {
+		return fmt.Errorf("Export of %d data points failed: %s", oo.count, err)
+	}
+	oo.hosts = make(map[string]map[string]*otlpMetric)
+	oo.count = 0
+	return
+}
+
+func (oo *OtlpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+	)
+
+	flushTicker := time.NewTicker(oo.interval)
+	defer flushTicker.Stop()
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			localErr := oo.add(pack)
+			pack.Recycle()
+			if localErr != nil {
+				or.LogError(localErr)
+				continue
+			}
+			if oo.count >= oo.conf.FlushCount && !oo.failed {
+				if localErr = oo.flush(); localErr != nil {
+					or.LogError(localErr)
+				}
+			}
+
+		case <-flushTicker.C:
+			if localErr := oo.flush(); localErr != nil {
+				or.LogError(localErr)
+			}
+		}
+	}
+
+	if localErr := oo.flush(); localErr != nil {
+		or.LogError(localErr)
+		or.LogError(fmt.Errorf("Dropped %d data points on shutdown", oo.count))
+	}
+	return
+}
+
+func init() {
+	RegisterPlugin("OtlpOutput", func() interface{} {
+		return new(OtlpOutput)
+	})
+}
@@ -0,0 +1,394 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Minimal protobuf decoder for ExportMetricsServiceRequest, filling the
+// types of otlp.go. Only the fields used to flatten data points are kept,
+// everything else is skipped.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoReader struct {
+	b []byte
+}
+
+// Reads the next field, val holds the raw varint or fixed value and data
+// the length delimited content.
+func (r *protoReader) next() (field int, wire int, val uint64, data []byte, err error) {
+	var tag uint64
+	if tag, err = r.varint(); err != nil {
+		return
+	}
+	field, wire = int(tag>>3), int(tag&7)
+
+	switch wire {
+	case protoVarint:
+		val, err = r.varint()
+	case protoFixed64:
+		if len(r.b) < 8 {
+			return 0, 0, 0, nil, fmt.Errorf("truncated fixed64")
+		}
+		val = binary.LittleEndian.Uint64(r.b)
+		r.b = r.b[8:]
+	case protoFixed32:
+		if len(r.b) < 4 {
+			return 0, 0, 0, nil, fmt.Errorf("truncated fixed32")
+		}
+		val = uint64(binary.LittleEndian.Uint32(r.b))
+		r.b = r.b[4:]
+	case protoBytes:
+		var l uint64
+		if l, err = r.varint(); err != nil {
+			return
+		}
+		if uint64(len(r.b)) < l {
+			return 0, 0, 0, nil, fmt.Errorf("truncated field %d", field)
+		}
+		data = r.b[:l]
+		r.b = r.b[l:]
+	default:
+		err = fmt.Errorf("unsupported wire type %d", wire)
+	}
+	return
+}
+
+func (r *protoReader) varint() (v uint64, err error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid varint")
+	}
+	r.b = r.b[n:]
+	return
+}
+
+// Calls fn for every field of a message.
+func protoFields(b []byte, fn func(field int, wire int, val uint64, data []byte) error) (err error) {
+	r := &protoReader{b}
+	for len(r.b) > 0 {
+		var (
+			field, wire int
+			val         uint64
+			data        []byte
+		)
+		if field, wire, val, data, err = r.next(); err != nil {
+			return
+		}
+		if err = fn(field, wire, val, data); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decodeOtlpMetricsRequest(b []byte) (req *otlpMetricsRequest, err error) {
+	req = &otlpMetricsRequest{}
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if field == 1 && wire == protoBytes {
+			var rm otlpResourceMetrics
+			if rm, err = decodeOtlpResourceMetrics(data); err == nil {
+				req.ResourceMetrics = append(req.ResourceMetrics, rm)
+			}
+		}
+		return
+	})
+	return
+}
+
+func decodeOtlpResourceMetrics(b []byte) (rm otlpResourceMetrics, err error) {
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if wire != protoBytes {
+			return
+		}
+		switch field {
+		case 1:
+			err = protoFields(data, func(field int, wire int, val uint64, data []byte) (err error) {
+				if field == 1 && wire == protoBytes {
+					var kv otlpKeyValue
+					if kv, err = decodeOtlpKeyValue(data); err == nil {
+						rm.Resource.Attributes = append(rm.Resource.Attributes, kv)
+					}
+				}
+				return
+			})
+		case 2:
+			var sm otlpScopeMetrics
+			if sm, err = decodeOtlpScopeMetrics(data); err == nil {
+				rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+			}
+		}
+		return
+	})
+	return
+}
+
+func decodeOtlpScopeMetrics(b []byte) (sm otlpScopeMetrics, err error) {
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if wire != protoBytes {
+			return
+		}
+		switch field {
+		case 1:
+			err = protoFields(data, func(field int, wire int, val uint64, data []byte) error {
+				if field == 1 && wire == protoBytes {
+					sm.Scope.Name = string(data)
+				} else if field == 2 && wire == protoBytes {
+					sm.Scope.Version = string(data)
+				}
+				return nil
+			})
+		case 2:
+			var m otlpMetric
+			if m, err = decodeOtlpMetric(data); err == nil {
+				sm.Metrics = append(sm.Metrics, m)
+			}
+		}
+		return
+	})
+	return
+}
+
+func decodeOtlpMetric(b []byte) (m otlpMetric, err error) {
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if wire != protoBytes {
+			return
+		}
+		switch field {
+		case 1:
+			m.Name = string(data)
+		case 3:
+			m.Unit = string(data)
+		case 5:
+			m.Gauge, err = decodeOtlpNumberPoints(data)
+		case 7:
+			m.Sum, err = decodeOtlpNumberPoints(data)
+		case 9:
+			// HistogramDataPoint: attributes 9, count 4, sum 5
+			m.Histogram, err = decodeOtlpSummaryPoints(data, 9)
+		case 11:
+			// SummaryDataPoint: attributes 7, count 4, sum 5
+			m.Summary, err = decodeOtlpSummaryPoints(data, 7)
+		}
+		return
+	})
+	return
+}
+
+func decodeOtlpNumberPoints(b []byte) (np *otlpNumberPoints, err error) {
+	np = &otlpNumberPoints{}
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if field != 1 || wire != protoBytes {
+			return
+		}
+		var dp otlpNumberDataPoint
+		err = protoFields(data, func(field int, wire int, val uint64, data []byte) (err error) {
+			switch field {
+			case 3:
+				dp.TimeUnixNano = otlpInt(val)
+			case 4:
+				f := math.Float64frombits(val)
+				dp.AsDouble = &f
+			case 6:
+				i := otlpInt(val)
+				dp.AsInt = &i
+			case 7:
+				var kv otlpKeyValue
+				if kv, err = decodeOtlpKeyValue(data); err == nil {
+					dp.Attributes = append(dp.Attributes, kv)
+				}
+			}
+			return
+		})
+		np.DataPoints = append(np.DataPoints, dp)
+		return
+	})
+	return
+}
+
+func decodeOtlpSummaryPoints(b []byte, attributesField int) (sp *otlpSummaryPoints, err error) {
+	sp = &otlpSummaryPoints{}
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) (err error) {
+		if field != 1 || wire != protoBytes {
+			return
+		}
+		var dp otlpSummaryDataPoint
+		err = protoFields(data, func(field int, wire int, val uint64, data []byte) (err error) {
+			switch field {
+			case 3:
+				dp.TimeUnixNano = otlpInt(val)
+			case 4:
+				dp.Count = otlpInt(val)
+			case 5:
+				f := math.Float64frombits(val)
+				dp.Sum = &f
+			case attributesField:
+				var kv otlpKeyValue
+				if kv, err = decodeOtlpKeyValue(data); err == nil {
+					dp.Attributes = append(dp.Attributes, kv)
+				}
+			}
+			return
+		})
+		sp.DataPoints = append(sp.DataPoints, dp)
+		return
+	})
+	return
+}
+
+func decodeOtlpKeyValue(b []byte) (kv otlpKeyValue, err error) {
+	err = protoFields(b, func(field int, wire int, val uint64, data []byte) error {
+		if field == 1 && wire == protoBytes {
+			kv.Key = string(data)
+			return nil
+		}
+		if field != 2 || wire != protoBytes {
+			return nil
+		}
+		return protoFields(data, func(field int, wire int, val uint64, data []byte) error {
+			switch field {
+			case 1:
+				s := string(data)
+				kv.Value.StringValue = &s
+			case 2:
+				b := val != 0
+				kv.Value.BoolValue = &b
+			case 3:
+				i := otlpInt(val)
+				kv.Value.IntValue = &i
+			case 4:
+				f := math.Float64frombits(val)
+				kv.Value.DoubleValue = &f
+			}
+			return nil
+		})
+	})
+	return
+}
+
+type protoWriter struct {
+	b []byte
+}
+
+func (w *protoWriter) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.b = append(w.b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func (w *protoWriter) tag(field int, wire int) {
+	w.uvarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (w *protoWriter) varint(field int, v uint64) {
+	w.tag(field, protoVarint)
+	w.uvarint(v)
+}
+
+func (w *protoWriter) fixed64(field int, v uint64) {
+	w.tag(field, protoFixed64)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	w.b = append(w.b, buf...)
+}
+
+func (w *protoWriter) bytes(field int, data []byte) {
+	w.tag(field, protoBytes)
+	w.uvarint(uint64(len(data)))
+	w.b = append(w.b, data...)
+}
+
+// Writes a string field, left out when empty like proto3 does.
+func (w *protoWriter) string(field int, s string) {
+	if s != "" {
+		w.bytes(field, []byte(s))
+	}
+}
+
+// Writes an embedded message filled by fn.
+func (w *protoWriter) message(field int, fn func(w *protoWriter)) {
+	sub := &protoWriter{}
+	fn(sub)
+	w.bytes(field, sub.b)
+}
+
+// Encodes a request to ExportMetricsServiceRequest, only the gauges and sums
+// OtlpOutput builds, histograms and summaries aren't.
+func encodeOtlpMetricsRequest(req *otlpMetricsRequest) []byte {
+	w := &protoWriter{}
+	for _, rm := range req.ResourceMetrics {
+		w.message(1, func(w *protoWriter) {
+			w.message(1, func(w *protoWriter) {
+				encodeOtlpKeyValues(w, 1, rm.Resource.Attributes)
+			})
+			for _, sm := range rm.ScopeMetrics {
+				w.message(2, func(w *protoWriter) {
+					w.message(1, func(w *protoWriter) {
+						w.string(1, sm.Scope.Name)
+						w.string(2, sm.Scope.Version)
+					})
+					for _, m := range sm.Metrics {
+						w.message(2, func(w *protoWriter) {
+							encodeOtlpMetric(w, m)
+						})
+					}
+				})
+			}
+		})
+	}
+	return w.b
+}
+
+func encodeOtlpMetric(w *protoWriter, m otlpMetric) {
+	w.string(1, m.Name)
+	w.string(3, m.Unit)
+	for i, np := range []*otlpNumberPoints{m.Gauge, m.Sum} {
+		if np == nil {
+			continue
+		}
+		// Metric.gauge is 5, Metric.sum 7
+		w.message(5+2*i, func(w *protoWriter) {
+			for _, dp := range np.DataPoints {
+				w.message(1, func(w *protoWriter) {
+					w.fixed64(3, uint64(dp.TimeUnixNano))
+					if dp.AsDouble != nil {
+						w.fixed64(4, math.Float64bits(*dp.AsDouble))
+					}
+					if dp.AsInt != nil {
+						w.fixed64(6, uint64(*dp.AsInt))
+					}
+					encodeOtlpKeyValues(w, 7, dp.Attributes)
+				})
+			}
+		})
+	}
+}
+
+func encodeOtlpKeyValues(w *protoWriter, field int, kvs []otlpKeyValue) {
+	for _, kv := range kvs {
+		w.message(field, func(w *protoWriter) {
+			w.string(1, kv.Key)
+			w.message(2, func(w *protoWriter) {
+				v := kv.Value
+				switch {
+				case v.StringValue != nil:
+					w.bytes(1, []byte(*v.StringValue))
+				case v.BoolValue != nil && *v.BoolValue:
+					w.varint(2, 1)
+				case v.BoolValue != nil:
+					w.varint(2, 0)
+				case v.IntValue != nil:
+					w.varint(3, uint64(*v.IntValue))
+				case v.DoubleValue != nil:
+					w.fixed64(4, math.Float64bits(*v.DoubleValue))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output sending trigger, acknowledge and resolve events to the PagerDuty
+// Events v2 API, the action being taken from a state field of the message.
+type PagerDutyOutput struct {
+	conf    *PagerDutyOutputConfig
+	actions map[string]string
+	dedup   *template.Template
+	summary *template.Template
+	source  *template.Template
+	client  *http.Client
+	delay   time.Duration
+}
+
+type PagerDutyOutputConfig struct {
+	// Integration key of the service
+	RoutingKey string `toml:"routing_key"`
+	// Events API endpoint
+	Url string `toml:"url"`
+
+	// Field holding the alert state
+	StateField string `toml:"state_field"`
+	// State values mapped to a trigger, acknowledge or resolve action,
+	// compared case insensitively
+	Actions map[string]string `toml:"actions"`
+
+	// Templates of the dedup key, the summary and the source of the events,
+	// see EscalationOutput body_template
+	DedupKeyTemplate string `toml:"dedup_key_template"`
+	SummaryTemplate  string `toml:"summary_template"`
+	SourceTemplate   string `toml:"source_template"`
+
+	// Seconds a request may take
+	Timeout uint `toml:"timeout"`
+	// Retries of a failed request and seconds between retries
+	MaxRetries uint `toml:"max_retries"`
+	RetryDelay uint `toml:"retry_delay"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp"`
+	Class         string                 `json:"class,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+func (pdo *PagerDutyOutput) ConfigStruct() interface{} {
+	return &PagerDutyOutputConfig{
+		Url:        "https://events.pagerduty.com/v2/enqueue",
+		StateField: "state",
+		Actions: map[string]string{
+			"problem":     "trigger",
+			"alert":       "trigger",
+			"trigger":     "trigger",
+			"ack":         "acknowledge",
+			"acknowledge": "acknowledge",
+			"ok":          "resolve",
+			"resolve":     "resolve",
+			"resolved":    "resolve",
+		},
+		DedupKeyTemplate: "{{.Logger}}/{{.Hostname}}",
+		SummaryTemplate:  "{{.Payload}}",
+		SourceTemplate:   "{{.Hostname}}",
+		Timeout:          uint(10),
+		MaxRetries:       uint(3),
+		RetryDelay:       uint(5),
+	}
+}
+
+func (pdo *PagerDutyOutput) Init(config interface{}) (err error) {
+	pdo.conf = config.(*PagerDutyOutputConfig)
+
+	if pdo.conf.RoutingKey == "" {
+		return fmt.Errorf("routing_key must be set")
+	}
+
+	pdo.actions = make(map[string]string, len(pdo.conf.Actions))
+	for state, action := range pdo.conf.Actions {
+		if action != "trigger" && action != "acknowledge" && action != "resolve" {
+			return fmt.Errorf("Invalid action %s for state %s, only trigger, acknowledge or resolve allowed.",
+				action, state)
+		}
+		pdo.actions[strings.ToLower(state)] = action
+	}
+
+	for _, t := range []struct {
+		name string
+		text string
+		dst  **template.Template
+	}{
+		{"dedup_key", pdo.conf.DedupKeyTemplate, &pdo.dedup},
+		{"summary", pdo.conf.SummaryTemplate, &pdo.summary},
+		{"source", pdo.conf.SourceTemplate, &pdo.source},
+	} {
+		if *t.dst, err = parseAlertTemplate(t.name, t.text); err != nil {
+			return
+		}
+		if *t.dst == nil {
+			return fmt.Errorf("%s_template must be set", t.name)
+		}
+	}
+
+	pdo.client = &http.Client{Timeout: time.Duration(pdo.conf.Timeout) * time.Second}
+	pdo.delay = time.Duration(pdo.conf.RetryDelay) * time.Second
+	return
+}
+
+func (pdo *PagerDutyOutput) event(ad *alertData) (ev *pagerDutyEvent, err error) {
+	state := fmt.Sprint(ad.Fields[pdo.conf.StateField])
+	action, found := pdo.actions[strings.ToLower(state)]
+	if !found {
+		return nil, fmt.Errorf("No action for %s %q", pdo.conf.StateField, state)
+	}
+
+	var dedup []byte
+	if dedup, err = renderAlertTemplate(pdo.dedup, ad); err != nil {
+		return
+	}
+	ev = &pagerDutyEvent{
+		RoutingKey:  pdo.conf.RoutingKey,
+		EventAction: action,
+		DedupKey:    string(dedup),
+	}
+	if action != "trigger" {
+		return
+	}
+
+	var summary, source []byte
+	if summary, err = renderAlertTemplate(pdo.summary, ad); err != nil {
+		return
+	}
+	if source, err = renderAlertTemplate(pdo.source, ad); err != nil {
+		return
+	}
+	ev.Payload = &pagerDutyPayload{
+		Summary:       string(summary),
+		Source:        string(source),
+		Severity:      alertSeverity(ad.Severity),
+		Timestamp:     ad.Timestamp.UTC().Format(time.RFC3339),
+		Class:         ad.Type,
+		CustomDetails: ad.Fields,
+	}
+	return
+}
+
+func (pdo *PagerDutyOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			ev, localErr := pdo.event(newAlertData(pack.Message))
+			pack.Recycle()
+
+			var body []byte
+			if localErr == nil {
+				if body, localErr = json.Marshal(ev); localErr == nil {
+					localErr = postWithRetries(pdo.client, pdo.conf.Url, "application/json", nil,
+						body, pdo.conf.MaxRetries, pdo.delay)
+				}
+			}
+			if localErr != nil {
+				or.LogError(fmt.Errorf("Unable to send PagerDuty event: %s", localErr))
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("PagerDutyOutput", func() interface{} {
+		return new(PagerDutyOutput)
+	})
+}
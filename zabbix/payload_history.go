@@ -0,0 +1,69 @@
+package plugins
+
+import (
+	"sync"
+	"time"
+)
+
+// A batch as sent to the server, with the outcome.
+type sentPayload struct {
+	Time     time.Time `json:"time"`
+	Address  string    `json:"address"`
+	Payload  string    `json:"payload"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Bounded ring buffer of the last sent payloads, kept for postmortems.
+type payloadHistory struct {
+	lock    sync.Mutex
+	entries []sentPayload
+	next    int
+	full    bool
+}
+
+func newPayloadHistory(size uint) *payloadHistory {
+	if size == 0 {
+		return nil
+	}
+	return &payloadHistory{entries: make([]sentPayload, size)}
+}
+
+func (ph *payloadHistory) add(address string, payload []byte, resp []byte, err error) {
+	if ph == nil {
+		return
+	}
+
+	sp := sentPayload{
+		Time:     time.Now(),
+		Address:  address,
+		Payload:  string(payload),
+		Response: string(resp),
+	}
+	if err != nil {
+		sp.Error = err.Error()
+	}
+
+	ph.lock.Lock()
+	ph.entries[ph.next] = sp
+	ph.next = (ph.next + 1) % len(ph.entries)
+	if ph.next == 0 {
+		ph.full = true
+	}
+	ph.lock.Unlock()
+}
+
+// Entries from the oldest to the newest.
+func (ph *payloadHistory) list() (l []sentPayload) {
+	if ph == nil {
+		return
+	}
+
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	if ph.full {
+		l = append(l, ph.entries[ph.next:]...)
+	}
+	return append(l, ph.entries[:ph.next]...)
+}
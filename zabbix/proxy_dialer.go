@@ -0,0 +1,168 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Outbound proxy the server connections go through, SOCKS5 or HTTP CONNECT.
+type zabbixProxy struct {
+	kind     string
+	address  string
+	user     string
+	password string
+}
+
+// Returns nil when no proxy type is set.
+func newZabbixProxy(kind string, address string, user string, password string) (p *zabbixProxy, err error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("Invalid proxy_type: %s, only 'socks5' or 'http' allowed.", kind)
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid proxy_address %s: %s", address, err)
+	}
+	return &zabbixProxy{kind, address, user, password}, nil
+}
+
+// Connects to target through the proxy, the handshake is bound by the
+// dialer timeout.
+func (p *zabbixProxy) dial(dialer *net.Dialer, target string) (conn net.Conn, err error) {
+	if conn, err = dialer.Dial("tcp", p.address); err != nil {
+		return nil, fmt.Errorf("Unable to reach proxy: %s", err)
+	}
+	if dialer.Timeout != 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	if p.kind == "socks5" {
+		err = p.socks5(conn, target)
+	} else {
+		err = p.connect(conn, target)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s: %s", p.address, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+// HTTP CONNECT tunnel.
+func (p *zabbixProxy) connect(conn net.Conn, target string) (err error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if p.user != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.user + ":" + p.password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err = io.WriteString(conn, req+"\r\n"); err != nil {
+		return
+	}
+
+	// The server only talks once we've sent a request, nothing is lost in
+	// the buffered reader
+	var resp *http.Response
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("CONNECT refused: %s", resp.Status)
+	}
+	return
+}
+
+// SOCKS5 CONNECT, RFC 1928, with optional RFC 1929 authentication.
+func (p *zabbixProxy) socks5(conn net.Conn, target string) (err error) {
+	host, portStr, _ := net.SplitHostPort(target)
+	var port int
+	if port, err = strconv.Atoi(portStr); err != nil {
+		return fmt.Errorf("Invalid port %s", portStr)
+	}
+
+	method := byte(0x00)
+	if p.user != "" {
+		method = 0x02
+	}
+	if _, err = conn.Write([]byte{5, 1, method}); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return fmt.Errorf("authentication method refused")
+	}
+
+	if method == 0x02 {
+		auth := []byte{1, byte(len(p.user))}
+		auth = append(auth, p.user...)
+		auth = append(auth, byte(len(p.password)))
+		auth = append(auth, p.password...)
+		if _, err = conn.Write(auth); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("authentication failed")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("connect failed with code %d", header[1])
+	}
+
+	// Skip the bound address and port
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = 4 + 2
+	case 4:
+		skip = 16 + 2
+	case 3:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(conn, l); err != nil {
+			return
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("invalid address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return
+}
@@ -0,0 +1,88 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Daily time window, optionally restricted to one day of the week.
+// Windows ending before they start span midnight.
+type quietPeriod struct {
+	weekday time.Weekday
+	anyDay  bool
+	start   int // minutes since midnight
+	end     int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(s string) (minutes int, err error) {
+	var t time.Time
+	if t, err = time.Parse("15:04", s); err != nil {
+		return
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Parses windows such as "02:00-03:30" or "sun 04:00-06:00", in local time.
+func parseQuietPeriods(periods []string) (qps []quietPeriod, err error) {
+	for _, p := range periods {
+		qp := quietPeriod{anyDay: true}
+		fields := strings.Fields(strings.ToLower(p))
+		if len(fields) == 2 {
+			var ok bool
+			if qp.weekday, ok = weekdays[fields[0]]; !ok {
+				return nil, fmt.Errorf("Invalid day in quiet period: %s", p)
+			}
+			qp.anyDay = false
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("Invalid quiet period: %s", p)
+		}
+
+		bounds := strings.Split(fields[0], "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid quiet period: %s", p)
+		}
+		if qp.start, err = parseClock(bounds[0]); err != nil {
+			return nil, fmt.Errorf("Invalid quiet period start: %s", p)
+		}
+		if qp.end, err = parseClock(bounds[1]); err != nil {
+			return nil, fmt.Errorf("Invalid quiet period end: %s", p)
+		}
+		qps = append(qps, qp)
+	}
+	return
+}
+
+func (qp quietPeriod) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if qp.start <= qp.end {
+		return (qp.anyDay || day == qp.weekday) && m >= qp.start && m < qp.end
+	}
+
+	// Spans midnight, the part after midnight belongs to the previous day
+	if m >= qp.start {
+		return qp.anyDay || day == qp.weekday
+	}
+	if m < qp.end {
+		return qp.anyDay || (day+6)%7 == qp.weekday
+	}
+	return false
+}
+
+func inQuietPeriod(qps []quietPeriod, t time.Time) bool {
+	for _, qp := range qps {
+		if qp.contains(t) {
+			return true
+		}
+	}
+	return false
+}
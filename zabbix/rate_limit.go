@@ -0,0 +1,77 @@
+package plugins
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket bounding the values sent per second, refilled continuously
+// up to a second worth of values.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil, an unlimited bucket, when rate is 0.
+func newTokenBucket(rate uint) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Bucket of perMinute tokens refilled over a minute, nil for no limit
+// when perMinute is 0.
+func newMinuteBucket(perMinute uint) *tokenBucket {
+	if perMinute == 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(perMinute) / 60, burst: float64(perMinute),
+		tokens: float64(perMinute), last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last).Seconds(); elapsed > 0 {
+		tb.tokens += elapsed * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+}
+
+// Takes n tokens only if they are all there, returns whether it did.
+func (tb *tokenBucket) takeAll(n int, now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(now)
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// Takes up to n tokens, returns how many were granted.
+func (tb *tokenBucket) take(n int, now time.Time) int {
+	if tb == nil {
+		return n
+	}
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(now)
+	if granted := int(tb.tokens); granted < n {
+		n = granted
+	}
+	tb.tokens -= float64(n)
+	return n
+}
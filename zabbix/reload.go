@@ -0,0 +1,175 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Type of the messages changing settings at runtime, with reload_messages
+const zabbixReloadType = "zabbix.reload"
+
+// Settings changed without restarting Heka, read from reload_file on
+// SIGHUP or from the payload of zabbix.reload messages as a JSON object.
+// Settings left out keep their value.
+type zabbixReload struct {
+	Address                  *string          `json:"address"`
+	ZabbixChecksPollInterval *DurationSeconds `json:"zabbix_checks_poll_interval"`
+	SendTimeout              *DurationMillis  `json:"send_timeout"`
+	ReceiveTimeout           *DurationMillis  `json:"receive_timeout"`
+	SendKeyCount             *uint            `json:"send_key_count"`
+}
+
+func parseReload(data []byte) (r zabbixReload, err error) {
+	if err = json.Unmarshal(data, &r); err != nil {
+		err = fmt.Errorf("Unable to decode reload settings: %s", err)
+	}
+	return
+}
+
+func readReload(file string) (r zabbixReload, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(file); err != nil {
+		return r, fmt.Errorf("Unable to read reload_file: %s", err)
+	}
+	return parseReload(data)
+}
+
+// Records per batch, send_key_count as last reloaded.
+func (zo *ZabbixOutput) sendKeyCount() int {
+	return int(atomic.LoadUint32(&zo.send_key_count))
+}
+
+// Interval between key list fetches, zabbix_checks_poll_interval as last
+// reloaded.
+func (zo *ZabbixOutput) checksInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&zo.checks_interval))
+}
+
+// Applies reloaded settings, all of them or none when one is invalid. Only
+// called from the Run loop.
+func (zo *ZabbixOutput) reload(r zabbixReload) (err error) {
+	conf := *zo.conf
+	if r.Address != nil {
+		conf.Address = *r.Address
+	}
+	if r.ZabbixChecksPollInterval != nil {
+		conf.ZabbixChecksPollInterval = *r.ZabbixChecksPollInterval
+	}
+	if r.SendTimeout != nil {
+		conf.SendTimeout = *r.SendTimeout
+	}
+	if r.ReceiveTimeout != nil {
+		conf.ReceiveTimeout = *r.ReceiveTimeout
+	}
+	if r.SendKeyCount != nil {
+		conf.SendKeyCount = *r.SendKeyCount
+	}
+
+	poll, receive := time.Duration(conf.ZabbixChecksPollInterval), time.Duration(conf.ReceiveTimeout)
+	switch {
+	case (poll == 0) != (zo.conf.ZabbixChecksPollInterval == 0):
+		return fmt.Errorf("zabbix_checks_poll_interval can't be turned on or off by a reload")
+	case poll != 0 && poll <= receive:
+		return fmt.Errorf("Invalid combinason of zabbix_checks_poll_interval and receive_timeout: %s must > %s", poll, receive)
+	case zo.checks_next != nil && time.Duration(conf.ChecksRefreshMin) <= receive:
+		return fmt.Errorf("Invalid combinason of checks_refresh_min and receive_timeout: %s must > %s",
+			time.Duration(conf.ChecksRefreshMin), receive)
+	case conf.MaxKeyCount < conf.SendKeyCount || conf.SendKeyCount < 1:
+		return fmt.Errorf("Invalid combinason of send_key_count and max_key_count: %d must be <= %d", conf.SendKeyCount, conf.MaxKeyCount)
+	case zo.buffered_out != nil && int(conf.SendKeyCount) >= zo.helper.PipelineConfig().Globals.PoolSize:
+		return fmt.Errorf("send_key_count must be below poolsize with use_buffering")
+	case zo.spool != nil && conf.MaxValuesPerSecond != 0 && conf.MaxValuesPerSecond < conf.SendKeyCount:
+		return fmt.Errorf("max_values_per_second must be >= send_key_count with spool_dir, spool segments are sent whole")
+	}
+
+	var checksRetry retryPolicy
+	if poll != 0 {
+		maxBackoff := time.Duration(conf.ChecksBackoffMax)
+		if maxBackoff < poll {
+			maxBackoff = poll
+		}
+		if checksRetry, err = newRetryPolicy(poll, conf.RetryMultiplier, maxBackoff, conf.RetryJitter); err != nil {
+			return
+		}
+	}
+
+	// New server clients when their address or timeouts changed, the
+	// overrides per address apply as usual. Only the reloadable settings
+	// are written, the sender goroutines read the others.
+	prevSend, prevReceive := zo.conf.SendTimeout, zo.conf.ReceiveTimeout
+	zo.conf.SendTimeout, zo.conf.ReceiveTimeout = conf.SendTimeout, conf.ReceiveTimeout
+	var clients []*zabbixClient
+	if zo.servers != nil && (conf.Address != zo.conf.Address || conf.SendTimeout != prevSend ||
+		conf.ReceiveTimeout != prevReceive) {
+
+		for _, address := range parseServerList(conf.Address) {
+			var zc *zabbixClient
+			if zc, err = zo.server_client(address); err != nil {
+				break
+			}
+			clients = append(clients, zc)
+		}
+		if err == nil && len(clients) == 0 {
+			err = fmt.Errorf("At least one Zabbix server address must be set.")
+		}
+		if err != nil {
+			zo.conf.SendTimeout, zo.conf.ReceiveTimeout = prevSend, prevReceive
+			return
+		}
+	}
+
+	zo.conf.Address = conf.Address
+	zo.conf.ZabbixChecksPollInterval = conf.ZabbixChecksPollInterval
+	zo.conf.SendKeyCount = conf.SendKeyCount
+	if poll != 0 {
+		zo.checks_retry = checksRetry
+	}
+	atomic.StoreInt64(&zo.checks_interval, int64(poll))
+	atomic.StoreUint32(&zo.send_key_count, uint32(conf.SendKeyCount))
+	if clients != nil {
+		zo.servers.replace(clients)
+	}
+	return
+}
+
+// Applies the settings of a reload message payload, or of reload_file when
+// it's empty, and logs the outcome.
+func (zo *ZabbixOutput) reloadFrom(or OutputRunner, payload string) {
+	var (
+		r   zabbixReload
+		err error
+	)
+	switch {
+	case payload != "":
+		r, err = parseReload([]byte(payload))
+	case zo.conf.ReloadFile != "":
+		r, err = readReload(zo.conf.ReloadFile)
+	default:
+		err = fmt.Errorf("empty reload message and no reload_file set")
+	}
+	if err == nil {
+		err = zo.reload(r)
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("Reload failed, settings unchanged: %s", err))
+		return
+	}
+	or.LogMessage("Settings reloaded: " + zo.reloadSummary())
+}
+
+// Describes the settings in effect after a reload, for the log.
+func (zo *ZabbixOutput) reloadSummary() string {
+	return strings.Join([]string{
+		fmt.Sprintf("address=%s", zo.conf.Address),
+		fmt.Sprintf("zabbix_checks_poll_interval=%s", time.Duration(zo.conf.ZabbixChecksPollInterval)),
+		fmt.Sprintf("send_timeout=%s", time.Duration(zo.conf.SendTimeout)),
+		fmt.Sprintf("receive_timeout=%s", time.Duration(zo.conf.ReceiveTimeout)),
+		fmt.Sprintf("send_key_count=%d", zo.conf.SendKeyCount),
+	}, " ")
+}
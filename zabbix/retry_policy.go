@@ -0,0 +1,50 @@
+package plugins
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Exponential backoff between attempts, with random jitter so a fleet of
+// senders doesn't retry in lockstep.
+type retryPolicy struct {
+	initial    time.Duration
+	multiplier float64
+	max        time.Duration
+	// Fraction of the delay added or removed at random, 0 to 1
+	jitter float64
+}
+
+func newRetryPolicy(initial time.Duration, multiplier float64, max time.Duration, jitter float64) (rp retryPolicy, err error) {
+	if initial <= 0 || max < initial {
+		return rp, fmt.Errorf("Invalid retry intervals: initial %s must be > 0 and <= max %s", initial, max)
+	}
+	if multiplier < 1 {
+		return rp, fmt.Errorf("Invalid retry multiplier %g, must be >= 1", multiplier)
+	}
+	if jitter < 0 || jitter > 1 {
+		return rp, fmt.Errorf("Invalid retry jitter %g, must be between 0 and 1", jitter)
+	}
+	return retryPolicy{initial, multiplier, max, jitter}, nil
+}
+
+// Delay before the next attempt after failures consecutive failures.
+func (rp retryPolicy) delay(failures int) time.Duration {
+	d := float64(rp.initial)
+	for i := 1; i < failures && d < float64(rp.max); i++ {
+		d *= rp.multiplier
+	}
+	if d > float64(rp.max) {
+		d = float64(rp.max)
+	}
+	return jittered(time.Duration(d), rp.jitter)
+}
+
+// Adds or removes up to fraction of d at random.
+func jittered(d time.Duration, fraction float64) time.Duration {
+	if fraction > 0 {
+		d += time.Duration(float64(d) * fraction * (2*rand.Float64() - 1))
+	}
+	return d
+}
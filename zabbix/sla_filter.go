@@ -0,0 +1,207 @@
+package plugins
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Rolling SLA windows
+var slaWindows = map[string]time.Duration{
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+}
+
+// Filter consuming availability/status messages and emitting the rolling
+// uptime percentage of every service as plain Zabbix items.
+type SlaFilter struct {
+	conf      *SlaFilterConfig
+	upValues  map[string]bool
+	maxWindow time.Duration
+	services  map[string][]stateChange
+}
+
+// Service state since t
+type stateChange struct {
+	t  time.Time
+	up bool
+}
+
+type SlaFilterConfig struct {
+	// Field identifying the service
+	ServiceField string `toml:"service_field"`
+
+	// Field holding the status
+	StatusField string `toml:"status_field"`
+
+	// Status values meaning the service is up
+	UpValues []string `toml:"up_values"`
+
+	// Windows to compute the SLA over: daily, weekly and/or monthly
+	Windows []string `toml:"windows"`
+
+	// Zabbix host receiving the items, defaults to the service itself.
+	// When set the service is added as first key parameter.
+	Host string `toml:"host"`
+
+	// Key of the generated items, the window is added as key parameter:
+	// sla.uptime[daily] or sla.uptime[service,daily]
+	Key string `toml:"key"`
+
+	// Message type for outbound messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (sf *SlaFilter) ConfigStruct() interface{} {
+	return &SlaFilterConfig{
+		ServiceField: "host",
+		StatusField:  "value",
+		UpValues:     []string{"1"},
+		Windows:      []string{"daily", "weekly", "monthly"},
+		Key:          "sla.uptime",
+		MessageType:  "zabbix",
+	}
+}
+
+func (sf *SlaFilter) Init(config interface{}) (err error) {
+	sf.conf = config.(*SlaFilterConfig)
+
+	for _, w := range sf.conf.Windows {
+		d, found := slaWindows[w]
+		if !found {
+			return fmt.Errorf("Invalid SLA window %s, only daily, weekly or monthly allowed.", w)
+		}
+		if d > sf.maxWindow {
+			sf.maxWindow = d
+		}
+	}
+	if len(sf.conf.Windows) == 0 {
+		return fmt.Errorf("At least one SLA window must be defined.")
+	}
+
+	sf.upValues = make(map[string]bool, len(sf.conf.UpValues))
+	for _, v := range sf.conf.UpValues {
+		sf.upValues[v] = true
+	}
+	sf.services = make(map[string][]stateChange)
+	return
+}
+
+// Records a status, only state changes are kept.
+func (sf *SlaFilter) record(service string, t time.Time, up bool) {
+	changes := sf.services[service]
+	if n := len(changes); n > 0 && (changes[n-1].up == up || t.Before(changes[n-1].t)) {
+		return
+	}
+	sf.services[service] = append(changes, stateChange{t, up})
+}
+
+// Drops the changes not needed anymore for the largest window, keeping the
+// one giving the state at the start of the window.
+func (sf *SlaFilter) prune(service string, now time.Time) {
+	changes := sf.services[service]
+	cutoff := now.Add(-sf.maxWindow)
+	i := 0
+	for i+1 < len(changes) && !changes[i+1].t.After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		sf.services[service] = append(changes[:0], changes[i:]...)
+	}
+}
+
+// Percentage of the observed part of the window the service was up.
+func uptime(changes []stateChange, now time.Time, window time.Duration) (pct float64, observed bool) {
+	start := now.Add(-window)
+	var up, total time.Duration
+
+	for i, c := range changes {
+		from := c.t
+		to := now
+		if i+1 < len(changes) {
+			to = changes[i+1].t
+		}
+		if !to.After(start) {
+			continue
+		}
+		if from.Before(start) {
+			from = start
+		}
+		total += to.Sub(from)
+		if c.up {
+			up += to.Sub(from)
+		}
+	}
+
+	if total == 0 {
+		return
+	}
+	return 100 * float64(up) / float64(total), true
+}
+
+func (sf *SlaFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = fr.InChan()
+		ticker = fr.Ticker()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			service, localErr := fieldToString(sf.conf.ServiceField, pack)
+			if localErr == nil {
+				var status string
+				if status, localErr = fieldToString(sf.conf.StatusField, pack); localErr == nil {
+					sf.record(service, time.Unix(0, pack.Message.GetTimestamp()), sf.upValues[status])
+				}
+			}
+			if localErr != nil {
+				fr.LogError(localErr)
+			}
+			pack.Recycle()
+
+		case now := <-ticker:
+			for service, _ := range sf.services {
+				sf.prune(service, now)
+				changes := sf.services[service]
+
+				host, param := service, ""
+				if sf.conf.Host != "" {
+					host, param = sf.conf.Host, service+","
+				}
+
+				for _, w := range sf.conf.Windows {
+					pct, observed := uptime(changes, now, slaWindows[w])
+					if !observed {
+						continue
+					}
+
+					key := fmt.Sprintf("%s[%s%s]", sf.conf.Key, param, w)
+					pack2, localErr := newZabbixMetricPack(h, 0, sf.conf.MessageType, host, key,
+						fmt.Sprintf("%.4f", pct), now)
+					if localErr != nil {
+						fr.LogError(localErr)
+						continue
+					}
+					fr.Inject(pack2)
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("SlaFilter", func() interface{} {
+		return new(SlaFilter)
+	})
+}
@@ -0,0 +1,171 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output posting formatted notifications to Slack compatible incoming
+// webhooks, the channel and color depending on the message severity.
+type SlackOutput struct {
+	conf   *SlackOutputConfig
+	title  *template.Template
+	text   *template.Template
+	client *http.Client
+	delay  time.Duration
+}
+
+type SlackOutputConfig struct {
+	// Incoming webhook url
+	WebhookUrl string `toml:"webhook_url"`
+
+	// Channel, overriding the webhook one when set
+	Channel   string `toml:"channel"`
+	Username  string `toml:"username"`
+	IconEmoji string `toml:"icon_emoji"`
+
+	// Templates of the notification title and text, see EscalationOutput
+	// body_template
+	TitleTemplate string `toml:"title_template"`
+	TextTemplate  string `toml:"text_template"`
+
+	// Channels and attachment colors by severity: critical, error, warning
+	// or info
+	SeverityChannels map[string]string `toml:"severity_channels"`
+	SeverityColors   map[string]string `toml:"severity_colors"`
+
+	// Seconds a request may take
+	Timeout uint `toml:"timeout"`
+	// Retries of a failed request and seconds between retries
+	MaxRetries uint `toml:"max_retries"`
+	RetryDelay uint `toml:"retry_delay"`
+}
+
+type slackAttachment struct {
+	Fallback string `json:"fallback"`
+	Color    string `json:"color,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Text     string `json:"text"`
+	Ts       int64  `json:"ts"`
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+func (so *SlackOutput) ConfigStruct() interface{} {
+	return &SlackOutputConfig{
+		Username:      "heka",
+		TitleTemplate: "{{.Hostname}}: {{.Logger}}",
+		TextTemplate:  "{{.Payload}}",
+		SeverityColors: map[string]string{
+			"critical": "danger",
+			"error":    "danger",
+			"warning":  "warning",
+			"info":     "good",
+		},
+		Timeout:    uint(10),
+		MaxRetries: uint(3),
+		RetryDelay: uint(5),
+	}
+}
+
+func (so *SlackOutput) Init(config interface{}) (err error) {
+	so.conf = config.(*SlackOutputConfig)
+
+	if so.conf.WebhookUrl == "" {
+		return fmt.Errorf("webhook_url must be set")
+	}
+	if so.title, err = parseAlertTemplate("title", so.conf.TitleTemplate); err != nil {
+		return
+	}
+	if so.text, err = parseAlertTemplate("text", so.conf.TextTemplate); err != nil {
+		return
+	}
+	if so.text == nil {
+		return fmt.Errorf("text_template must be set")
+	}
+
+	so.client = &http.Client{Timeout: time.Duration(so.conf.Timeout) * time.Second}
+	so.delay = time.Duration(so.conf.RetryDelay) * time.Second
+	return
+}
+
+func (so *SlackOutput) message(ad *alertData) (sm *slackMessage, err error) {
+	var title, text []byte
+	if so.title != nil {
+		if title, err = renderAlertTemplate(so.title, ad); err != nil {
+			return
+		}
+	}
+	if text, err = renderAlertTemplate(so.text, ad); err != nil {
+		return
+	}
+
+	severity := alertSeverity(ad.Severity)
+	channel := so.conf.Channel
+	if c, found := so.conf.SeverityChannels[severity]; found {
+		channel = c
+	}
+
+	sm = &slackMessage{
+		Channel:   channel,
+		Username:  so.conf.Username,
+		IconEmoji: so.conf.IconEmoji,
+		Attachments: []slackAttachment{{
+			Fallback: string(text),
+			Color:    so.conf.SeverityColors[severity],
+			Title:    string(title),
+			Text:     string(text),
+			Ts:       ad.Timestamp.Unix(),
+		}},
+	}
+	return
+}
+
+func (so *SlackOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			sm, localErr := so.message(newAlertData(pack.Message))
+			pack.Recycle()
+
+			var body []byte
+			if localErr == nil {
+				if body, localErr = json.Marshal(sm); localErr == nil {
+					localErr = postWithRetries(so.client, so.conf.WebhookUrl, "application/json", nil,
+						body, so.conf.MaxRetries, so.delay)
+				}
+			}
+			if localErr != nil {
+				or.LogError(fmt.Errorf("Unable to post notification: %s", localErr))
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("SlackOutput", func() interface{} {
+		return new(SlackOutput)
+	})
+}
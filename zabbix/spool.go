@@ -0,0 +1,318 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	spoolSegmentExt   = ".seg"
+	spoolEncryptedExt = ".enc"
+
+	// Length prefixes above it are damage, records are single metrics
+	spoolMaxRecordSize = 16 * 1024 * 1024
+)
+
+// On-disk FIFO of metric batches backing the disk buffering of ZabbixOutput.
+// Each batch is written to its own segment file, records are length prefixed.
+type diskSpool struct {
+	dir         string
+	compression string
+	maxBytes    int64
+	aead        cipher.AEAD
+
+	seq      uint64
+	size     int64
+	segments []spoolSegment
+}
+
+type spoolSegment struct {
+	name string
+	size int64
+}
+
+// Segments are encrypted with AES-GCM when a key is provided.
+func newDiskSpool(dir string, compression string, maxBytes int64, key []byte) (s *diskSpool, err error) {
+	switch compression {
+	case "", "none", "gzip", "snappy":
+	default:
+		return nil, fmt.Errorf("Invalid spool compression: %s", compression)
+	}
+
+	s = &diskSpool{dir: dir, compression: compression, maxBytes: maxBytes}
+
+	if key != nil {
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("Invalid spool encryption key: %s", err)
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		seq, ok := parseSegmentName(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		if s.aead == nil && strings.HasSuffix(f.Name(), spoolEncryptedExt) {
+			// It would block the segments behind it for good
+			return nil, fmt.Errorf("Spool segment %s is encrypted but no key is configured, set spool_key_file", f.Name())
+		}
+		s.segments = append(s.segments, spoolSegment{f.Name(), f.Size()})
+		s.size += f.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+	sort.Sort(bySegmentName(s.segments))
+
+	return
+}
+
+type bySegmentName []spoolSegment
+
+func (b bySegmentName) Len() int           { return len(b) }
+func (b bySegmentName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySegmentName) Less(i, j int) bool { return b[i].name < b[j].name }
+
+// Segment names are a zero padded sequence number followed by the segment
+// extension and the compression used, if any.
+func parseSegmentName(name string) (seq uint64, ok bool) {
+	i := strings.Index(name, spoolSegmentExt)
+	if i <= 0 {
+		return
+	}
+	seq, err := strconv.ParseUint(name[:i], 10, 64)
+	return seq, err == nil
+}
+
+func (s *diskSpool) segmentName(seq uint64) string {
+	name := fmt.Sprintf("%020d%s", seq, spoolSegmentExt)
+	switch s.compression {
+	case "gzip":
+		name += ".gz"
+	case "snappy":
+		name += ".snappy"
+	}
+	if s.aead != nil {
+		name += spoolEncryptedExt
+	}
+	return name
+}
+
+// Reads an AES key from a file, either raw or hex encoded. The key length
+// selects AES-128, AES-192 or AES-256.
+func loadSpoolKey(path string) (key []byte, err error) {
+	if key, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+	if trimmed := bytes.TrimSpace(key); len(trimmed) == 32 || len(trimmed) == 48 || len(trimmed) == 64 {
+		if decoded, hexErr := hex.DecodeString(string(trimmed)); hexErr == nil {
+			return decoded, nil
+		}
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Invalid spool key length in %s", path)
+}
+
+// Number of batches currently spooled.
+func (s *diskSpool) Len() int {
+	return len(s.segments)
+}
+
+// Bytes currently used on disk.
+func (s *diskSpool) Size() int64 {
+	return s.size
+}
+
+// Writes a batch as a new segment. The oldest segments are removed when
+// the spool grows over its size limit, their count is returned.
+func (s *diskSpool) Push(records [][]byte) (dropped int, err error) {
+	name := s.segmentName(s.seq)
+	path := filepath.Join(s.dir, name)
+
+	var buf bytes.Buffer
+	if err = s.writeSegment(&buf, records); err != nil {
+		return
+	}
+	data := buf.Bytes()
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return
+		}
+		data = s.aead.Seal(nonce, nonce, data, []byte(name))
+	}
+
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(path)
+		return
+	}
+
+	var fi os.FileInfo
+	if fi, err = os.Stat(path); err != nil {
+		return
+	}
+	s.seq++
+	s.segments = append(s.segments, spoolSegment{name, fi.Size()})
+	s.size += fi.Size()
+
+	// Size based retention, always keep the newest segment
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.segments) > 1 {
+		if err = s.Remove(); err != nil {
+			return
+		}
+		dropped++
+	}
+
+	return
+}
+
+func (s *diskSpool) writeSegment(buf io.Writer, records [][]byte) (err error) {
+	var (
+		w      io.Writer
+		closer io.Closer
+	)
+	switch s.compression {
+	case "gzip":
+		gw := gzip.NewWriter(buf)
+		w, closer = gw, gw
+	case "snappy":
+		sw := snappy.NewBufferedWriter(buf)
+		w, closer = sw, sw
+	default:
+		w = buf
+	}
+
+	var lenBuf [4]byte
+	for _, r := range records {
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(r)))
+		if _, err = w.Write(lenBuf[:]); err != nil {
+			return
+		}
+		if _, err = w.Write(r); err != nil {
+			return
+		}
+	}
+
+	if closer != nil {
+		err = closer.Close()
+	}
+	return
+}
+
+// Reads the oldest batch without removing it.
+func (s *diskSpool) Peek() (records [][]byte, err error) {
+	if len(s.segments) == 0 {
+		return nil, io.EOF
+	}
+	name := s.segments[0].name
+
+	var data []byte
+	if data, err = ioutil.ReadFile(filepath.Join(s.dir, name)); err != nil {
+		return
+	}
+
+	compressed := name
+	if strings.HasSuffix(name, spoolEncryptedExt) {
+		if s.aead == nil {
+			return nil, fmt.Errorf("Spool segment %s is encrypted but no key is configured", name)
+		}
+		ns := s.aead.NonceSize()
+		if len(data) < ns {
+			return nil, corruptSegmentError{fmt.Errorf("Corrupted spool segment %s: too short", name)}
+		}
+		if data, err = s.aead.Open(nil, data[:ns], data[ns:], []byte(name)); err != nil {
+			return nil, corruptSegmentError{fmt.Errorf("Unable to decrypt spool segment %s: %s", name, err)}
+		}
+		compressed = strings.TrimSuffix(name, spoolEncryptedExt)
+	}
+
+	plain := bytes.NewReader(data)
+	var r io.Reader = plain
+	switch {
+	case strings.HasSuffix(compressed, ".gz"):
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(r); err != nil {
+			return nil, corruptSegmentError{fmt.Errorf("Corrupted spool segment %s: %s", name, err)}
+		}
+		defer gr.Close()
+		r = gr
+	case strings.HasSuffix(compressed, ".snappy"):
+		r = snappy.NewReader(r)
+	}
+
+	var lenBuf [4]byte
+	for {
+		if _, err = io.ReadFull(r, lenBuf[:]); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, corruptSegmentError{fmt.Errorf("Corrupted spool segment %s: %s", name, err)}
+		}
+		length := int64(binary.BigEndian.Uint32(lenBuf[:]))
+		if length > spoolMaxRecordSize || r == plain && length > int64(plain.Len()) {
+			return nil, corruptSegmentError{fmt.Errorf("Corrupted spool segment %s: record of %d bytes", name, length)}
+		}
+		record := make([]byte, length)
+		if _, err = io.ReadFull(r, record); err != nil {
+			return nil, corruptSegmentError{fmt.Errorf("Corrupted spool segment %s: %s", name, err)}
+		}
+		records = append(records, record)
+	}
+}
+
+// Error of a segment that can't ever be read back: it doesn't decode, or
+// doesn't decrypt with its authentication tag
+type corruptSegmentError struct {
+	error
+}
+
+// Removes the oldest batch.
+func (s *diskSpool) Remove() (err error) {
+	if len(s.segments) == 0 {
+		return
+	}
+	seg := s.segments[0]
+	if err = os.Remove(filepath.Join(s.dir, seg.name)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	return nil
+}
@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Filter enriching messages referencing a Zabbix event or trigger with the
+// trigger description, severity, tags and host inventory fetched from the
+// Zabbix API, so notification outputs have the full context.
+type TriggerContextFilter struct {
+	conf       *TriggerContextFilterConfig
+	api        *ZabbixApiClient
+	cacheTTL   time.Duration
+	failureTTL time.Duration
+	inventory  map[string]bool
+	cache      map[string]*cachedTriggerContext
+	events     map[string]*cachedEventTrigger
+}
+
+// Fetched trigger context, or the error fetching it
+type cachedTriggerContext struct {
+	fetched time.Time
+	tc      *ZabbixTriggerContext
+	err     error
+}
+
+// Trigger id of an event, or the error looking it up
+type cachedEventTrigger struct {
+	fetched   time.Time
+	triggerId string
+	err       error
+}
+
+type TriggerContextFilterConfig struct {
+	// Zabbix api connection
+	Api ZabbixApiConfig `toml:"api"`
+
+	// Field holding the event id, looked up first
+	EventField string `toml:"event_field"`
+
+	// Field holding the trigger id
+	TriggerField string `toml:"trigger_field"`
+
+	// Inventory fields to attach, all when empty
+	InventoryFields []string `toml:"inventory_fields"`
+
+	// Prefix of the added fields
+	FieldPrefix string `toml:"field_prefix"`
+
+	// Seconds a trigger context or the trigger of an event is cached
+	CacheTTL uint `toml:"cache_ttl"`
+
+	// Seconds a failed lookup isn't tried again, its error is returned
+	// meanwhile
+	FailureTTL uint `toml:"failure_ttl"`
+
+	// Message type for outbound messages
+	MessageType string `toml:"msg_type"`
+}
+
+func (tcf *TriggerContextFilter) ConfigStruct() interface{} {
+	return &TriggerContextFilterConfig{
+		Api:          ZabbixApiConfig{Timeout: DurationSeconds(10 * time.Second)},
+		EventField:   "eventid",
+		TriggerField: "triggerid",
+		FieldPrefix:  "zabbix_",
+		CacheTTL:     uint(300),
+		FailureTTL:   uint(60),
+		MessageType:  "zabbix.alert",
+	}
+}
+
+func (tcf *TriggerContextFilter) Init(config interface{}) (err error) {
+	tcf.conf = config.(*TriggerContextFilterConfig)
+	if tcf.api, err = NewZabbixApiClient(tcf.conf.Api); err != nil {
+		return
+	}
+	if tcf.conf.EventField == "" && tcf.conf.TriggerField == "" {
+		return fmt.Errorf("Either event_field or trigger_field must be set.")
+	}
+
+	tcf.cacheTTL = time.Duration(tcf.conf.CacheTTL) * time.Second
+	tcf.failureTTL = time.Duration(tcf.conf.FailureTTL) * time.Second
+	if len(tcf.conf.InventoryFields) > 0 {
+		tcf.inventory = make(map[string]bool, len(tcf.conf.InventoryFields))
+		for _, f := range tcf.conf.InventoryFields {
+			tcf.inventory[f] = true
+		}
+	}
+	tcf.cache = make(map[string]*cachedTriggerContext)
+	tcf.events = make(map[string]*cachedEventTrigger)
+	return
+}
+
+// How long an entry fetched with err stays cached.
+func (tcf *TriggerContextFilter) ttl(err error) time.Duration {
+	if err != nil {
+		return tcf.failureTTL
+	}
+	return tcf.cacheTTL
+}
+
+// Id of the trigger referenced by a message, empty when there's none.
+func (tcf *TriggerContextFilter) triggerId(msg *message.Message) (id string, err error) {
+	if tcf.conf.EventField != "" {
+		if eventId := messageValue(msg, tcf.conf.EventField); eventId != "" {
+			return tcf.eventTriggerId(eventId)
+		}
+	}
+	if tcf.conf.TriggerField != "" {
+		id = messageValue(msg, tcf.conf.TriggerField)
+	}
+	return
+}
+
+func (tcf *TriggerContextFilter) eventTriggerId(eventId string) (id string, err error) {
+	if c, found := tcf.events[eventId]; found && time.Since(c.fetched) < tcf.ttl(c.err) {
+		return c.triggerId, c.err
+	}
+	id, err = tcf.api.EventTriggerId(eventId)
+	tcf.events[eventId] = &cachedEventTrigger{time.Now(), id, err}
+	return
+}
+
+func (tcf *TriggerContextFilter) context(triggerId string) (tc *ZabbixTriggerContext, err error) {
+	if c, found := tcf.cache[triggerId]; found && time.Since(c.fetched) < tcf.ttl(c.err) {
+		return c.tc, c.err
+	}
+	tc, err = tcf.api.FetchTriggerContext(triggerId)
+	tcf.cache[triggerId] = &cachedTriggerContext{time.Now(), tc, err}
+	return
+}
+
+func (tcf *TriggerContextFilter) addFields(msg *message.Message, tc *ZabbixTriggerContext) (err error) {
+	fields := [][2]string{
+		{"trigger_description", tc.Description},
+		{"trigger_comments", tc.Comments},
+		{"trigger_severity", tc.Severity},
+		{"hosts", strings.Join(tc.Hosts, ",")},
+	}
+	for tag, value := range tc.Tags {
+		fields = append(fields, [2]string{"tag_" + tag, value})
+	}
+	for name, value := range tc.Inventory {
+		if value == "" || (tcf.inventory != nil && !tcf.inventory[name]) {
+			continue
+		}
+		fields = append(fields, [2]string{"inventory_" + name, value})
+	}
+
+	for _, f := range fields {
+		var field *message.Field
+		if field, err = message.NewField(tcf.conf.FieldPrefix+f[0], f[1], ""); err != nil {
+			return fmt.Errorf("Unable to add %s: %s", f[0], err)
+		}
+		msg.AddField(field)
+	}
+
+	var field *message.Field
+	if field, err = message.NewField(tcf.conf.FieldPrefix+"trigger_priority", tc.Priority, ""); err != nil {
+		return fmt.Errorf("Unable to add trigger_priority: %s", err)
+	}
+	msg.AddField(field)
+	return
+}
+
+func (tcf *TriggerContextFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = fr.InChan()
+		ticker = fr.Ticker()
+	)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			pack2 := h.PipelinePack(pack.MsgLoopCount)
+			if pack2 == nil {
+				fr.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+				pack.Recycle()
+				continue
+			}
+			pack2.Message = message.CopyMessage(pack.Message)
+			pack2.Message.SetType(tcf.conf.MessageType)
+			pack.Recycle()
+
+			// Messages are forwarded even when the context can't be fetched
+			triggerId, localErr := tcf.triggerId(pack2.Message)
+			if localErr == nil && triggerId != "" {
+				var tc *ZabbixTriggerContext
+				if tc, localErr = tcf.context(triggerId); localErr == nil {
+					localErr = tcf.addFields(pack2.Message, tc)
+				}
+			}
+			if localErr != nil {
+				fr.LogError(localErr)
+			}
+			fr.Inject(pack2)
+
+		case now := <-ticker:
+			for id, c := range tcf.cache {
+				if now.Sub(c.fetched) >= tcf.ttl(c.err) {
+					delete(tcf.cache, id)
+				}
+			}
+			for id, c := range tcf.events {
+				if now.Sub(c.fetched) >= tcf.ttl(c.err) {
+					delete(tcf.events, id)
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func init() {
+	RegisterPlugin("TriggerContextFilter", func() interface{} {
+		return new(TriggerContextFilter)
+	})
+}
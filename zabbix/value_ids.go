@@ -0,0 +1,98 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Ids reserved in the state file at once, a restart carries on past them
+const valueIdsReserve = 100000
+
+// Session and per value ids of the agent data requests. Zabbix 4.4 or
+// later skips the values of a session with ids it already got, a batch
+// sent again after a lost response isn't stored twice. Values must reach
+// the server in id order for that, those sent after a higher id are
+// skipped too.
+type valueIds struct {
+	session string
+	file    string
+
+	lock     sync.Mutex
+	last     int64
+	reserved int64
+}
+
+type valueIdsState struct {
+	Session string `json:"session"`
+	LastId  int64  `json:"last_id"`
+}
+
+// Picks up the session and ids of the state file when there's one, so the
+// values spooled before a restart are still deduplicated.
+func newValueIds(file string) (vi *valueIds, err error) {
+	vi = &valueIds{file: file}
+	if file != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(file); err == nil {
+			var st valueIdsState
+			if err = json.Unmarshal(data, &st); err != nil {
+				return nil, fmt.Errorf("Invalid value ids file %s: %s", file, err)
+			}
+			vi.session, vi.last, vi.reserved = st.Session, st.LastId, st.LastId
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		err = nil
+	}
+	if vi.session == "" {
+		vi.session = strings.Replace(uuid.NewRandom().String(), "-", "", -1)
+	}
+	return
+}
+
+func (vi *valueIds) next() (id int64, err error) {
+	vi.lock.Lock()
+	defer vi.lock.Unlock()
+
+	vi.last++
+	if vi.file != "" && vi.last > vi.reserved {
+		st := valueIdsState{Session: vi.session, LastId: vi.last + valueIdsReserve}
+		data, _ := json.Marshal(st)
+		tmp := vi.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, vi.file)
+		}
+		if err != nil {
+			vi.last--
+			return 0, fmt.Errorf("Unable to save value ids: %s", err)
+		}
+		vi.reserved = st.LastId
+	}
+	return vi.last, nil
+}
+
+// Adds the next id to an encoded record.
+func (vi *valueIds) tag(record []byte) ([]byte, error) {
+	if len(record) < 2 || record[0] != '{' {
+		return nil, fmt.Errorf("invalid JSON record %q", record)
+	}
+	id, err := vi.next()
+	if err != nil {
+		return nil, err
+	}
+
+	tagged := make([]byte, 0, len(record)+24)
+	tagged = append(tagged, `{"id":`...)
+	tagged = strconv.AppendInt(tagged, id, 10)
+	if record[1] != '}' {
+		tagged = append(tagged, ',')
+	}
+	return append(tagged, record[1:]...), nil
+}
@@ -0,0 +1,735 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mathpl/active_zabbix"
+)
+
+// Minimal client for the Zabbix JSON-RPC API.
+type ZabbixApiClient struct {
+	url      string
+	token    string
+	user     string
+	password string
+	client   *http.Client
+
+	id      int64
+	lock    sync.Mutex
+	session string
+	// Server version from apiinfo.version, picking how to log in and pass
+	// the session or token, 0 until known
+	version int
+
+	// Global macros are shared by all hosts, refreshed at most every macroTTL
+	globalMacros     map[string]string
+	globalMacrosTime time.Time
+}
+
+const macroTTL = 60 * time.Second
+
+// Config sub-section shared by the plugins talking to the Zabbix API.
+type ZabbixApiConfig struct {
+	// Url of api_jsonrpc.php
+	Url string `toml:"url"`
+	// Api token, used in priority over user and password, needs Zabbix
+	// 5.4 or later. The session or token goes in the Authorization header
+	// from 6.4 on and in the request auth field before.
+	Token string `toml:"token"`
+	// Credentials used to get a session through user.login
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+	// Request timeout, bare numbers in seconds
+	Timeout DurationSeconds `toml:"timeout"`
+}
+
+type zabbixApiRequest struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Auth    string      `json:"auth,omitempty"`
+	Id      int64       `json:"id"`
+}
+
+// Versions as major*100+minor, from which the api takes user.login username
+// and api tokens, and the Authorization header instead of the auth field
+const (
+	zabbixApiVersionUsername = 504
+	zabbixApiVersionBearer   = 604
+)
+
+type zabbixApiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+func (e *zabbixApiError) Error() string {
+	return fmt.Sprintf("Zabbix api error %d: %s %s", e.Code, e.Message, e.Data)
+}
+
+type zabbixApiResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *zabbixApiError `json:"error"`
+}
+
+func NewZabbixApiClient(conf ZabbixApiConfig) (api *ZabbixApiClient, err error) {
+	if conf.Url == "" {
+		return nil, fmt.Errorf("api url must be set")
+	}
+	if conf.Token == "" && conf.User == "" {
+		return nil, fmt.Errorf("Either api token or user must be set")
+	}
+
+	api = &ZabbixApiClient{
+		url:      conf.Url,
+		token:    conf.Token,
+		user:     conf.User,
+		password: conf.Password,
+		client:   &http.Client{Timeout: time.Duration(conf.Timeout)},
+	}
+	return
+}
+
+// Calls an api method, decoding its result in the value pointed by result.
+func (api *ZabbixApiClient) Call(method string, params interface{}, result interface{}) (err error) {
+	var token string
+	if token, err = api.auth(); err != nil {
+		return
+	}
+
+	err = api.do(method, params, token, result)
+	if apiErr, ok := err.(*zabbixApiError); ok && api.token == "" && strings.Contains(apiErr.Data, "re-login") {
+		// Session expired, get a new one on the next call
+		api.lock.Lock()
+		api.session = ""
+		api.lock.Unlock()
+	}
+	return
+}
+
+// Returns the api token, logging in first when using credentials. The server
+// version is looked up first, once.
+func (api *ZabbixApiClient) auth() (token string, err error) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	if api.version == 0 {
+		var version string
+		if err = api.do("apiinfo.version", []string{}, "", &version); err != nil {
+			return "", fmt.Errorf("Unable to get Zabbix api version: %s", err)
+		}
+		if api.version, err = parseZabbixApiVersion(version); err != nil {
+			return
+		}
+	}
+	if api.token != "" {
+		if api.version < zabbixApiVersionUsername {
+			return "", fmt.Errorf("Api tokens need Zabbix 5.4 or later, use user and password")
+		}
+		return api.token, nil
+	}
+
+	if api.session == "" {
+		params := map[string]string{"username": api.user, "password": api.password}
+		if api.version < zabbixApiVersionUsername {
+			params = map[string]string{"user": api.user, "password": api.password}
+		}
+		if err = api.do("user.login", params, "", &api.session); err != nil {
+			return "", fmt.Errorf("Zabbix api login failed: %s", err)
+		}
+	}
+	return api.session, nil
+}
+
+func (api *ZabbixApiClient) do(method string, params interface{}, token string, result interface{}) (err error) {
+	req := zabbixApiRequest{JsonRpc: "2.0", Method: method, Params: params, Id: atomic.AddInt64(&api.id, 1)}
+	bearer := api.version >= zabbixApiVersionBearer
+	if token != "" && !bearer {
+		req.Auth = token
+	}
+
+	var body []byte
+	if body, err = json.Marshal(req); err != nil {
+		return
+	}
+
+	var httpReq *http.Request
+	if httpReq, err = http.NewRequest("POST", api.url, bytes.NewReader(body)); err != nil {
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json-rpc")
+	if token != "" && bearer {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	var httpResp *http.Response
+	if httpResp, err = api.client.Do(httpReq); err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Zabbix api returned http status %d", httpResp.StatusCode)
+	}
+
+	var resp zabbixApiResponse
+	if err = json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("Unable to decode Zabbix api response: %s", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil {
+		err = json.Unmarshal(resp.Result, result)
+	}
+	return
+}
+
+// Version as major*100+minor, from "6.4.12" or "5.0.0".
+func parseZabbixApiVersion(version string) (v int, err error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) >= 2 {
+		var major, minor int
+		if major, err = strconv.Atoi(parts[0]); err == nil {
+			if minor, err = strconv.Atoi(parts[1]); err == nil {
+				return major*100 + minor, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Invalid Zabbix api version: %q", version)
+}
+
+// Zabbix item types accepting values pushed by Heka
+const (
+	zabbixItemTypeTrapper     = 2
+	zabbixItemTypeActiveAgent = 7
+	zabbixItemStatusEnabled   = 0
+	// State of the items the server failed to get values for
+	zabbixItemStateNotSupported = "1"
+	zabbixDefaultItemDelay      = 60 * time.Second
+)
+
+type zabbixApiItem struct {
+	ItemId string `json:"itemid"`
+	HostId string `json:"hostid"`
+	Key    string `json:"key_"`
+	Delay  string `json:"delay"`
+	State  string `json:"state"`
+}
+
+// Fetches the enabled trapper and active agent items of a host, in the same
+// form as the active check list returned by the server. User macros in the
+// keys are resolved when resolveMacros is set.
+func (api *ZabbixApiClient) FetchHostItems(host string, resolveMacros bool) (
+	hc active_zabbix.HostActiveKeys, unsupported []string, err error) {
+
+	params := map[string]interface{}{
+		"output": []string{"hostid", "key_", "delay", "state"},
+		"host":   host,
+		"filter": map[string]interface{}{
+			"type":   []int{zabbixItemTypeTrapper, zabbixItemTypeActiveAgent},
+			"status": zabbixItemStatusEnabled,
+		},
+	}
+
+	var items []zabbixApiItem
+	if err = api.Call("item.get", params, &items); err != nil {
+		return
+	}
+
+	var macros map[string]string
+	if resolveMacros && len(items) > 0 {
+		if macros, err = api.UserMacros(items[0].HostId); err != nil {
+			return
+		}
+	}
+
+	hc = make(active_zabbix.HostActiveKeys, len(items))
+	for _, item := range items {
+		key := item.Key
+		delay := item.Delay
+		if macros != nil {
+			key = resolveUserMacros(key, macros)
+			delay = resolveUserMacros(delay, macros)
+		}
+		hc[key] = parseZabbixDelay(delay)
+		if item.State == zabbixItemStateNotSupported {
+			unsupported = append(unsupported, key)
+		}
+	}
+	return
+}
+
+type zabbixApiMacro struct {
+	Macro string `json:"macro"`
+	Value string `json:"value"`
+}
+
+func (api *ZabbixApiClient) fetchMacros(params map[string]interface{}) (macros map[string]string, err error) {
+	params["output"] = []string{"macro", "value"}
+
+	var ms []zabbixApiMacro
+	if err = api.Call("usermacro.get", params, &ms); err != nil {
+		return
+	}
+	macros = make(map[string]string, len(ms))
+	for _, m := range ms {
+		macros[m.Macro] = m.Value
+	}
+	return
+}
+
+// Returns the user macros visible from a host, host level macros
+// overriding global ones.
+func (api *ZabbixApiClient) UserMacros(hostId string) (macros map[string]string, err error) {
+	api.lock.Lock()
+	globals := api.globalMacros
+	if time.Since(api.globalMacrosTime) > macroTTL {
+		globals = nil
+	}
+	api.lock.Unlock()
+
+	if globals == nil {
+		if globals, err = api.fetchMacros(map[string]interface{}{"globalmacro": true}); err != nil {
+			return
+		}
+		api.lock.Lock()
+		api.globalMacros, api.globalMacrosTime = globals, time.Now()
+		api.lock.Unlock()
+	}
+
+	var hostMacros map[string]string
+	if hostMacros, err = api.fetchMacros(map[string]interface{}{"hostids": []string{hostId}}); err != nil {
+		return
+	}
+
+	macros = make(map[string]string, len(globals)+len(hostMacros))
+	for m, v := range globals {
+		macros[m] = v
+	}
+	for m, v := range hostMacros {
+		macros[m] = v
+	}
+	return
+}
+
+var userMacroRegexp = regexp.MustCompile(`\{\$[A-Z0-9_.]+(:[^}]*)?\}`)
+
+// Replaces {$MACRO} and {$MACRO:context} placeholders, a context macro
+// without a specific value falls back on the plain macro.
+func resolveUserMacros(s string, macros map[string]string) string {
+	if !strings.Contains(s, "{$") {
+		return s
+	}
+	return userMacroRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := macros[m]; ok {
+			return v
+		}
+		if i := strings.Index(m, ":"); i >= 0 {
+			if v, ok := macros[m[:i]+"}"]; ok {
+				return v
+			}
+		}
+		return m
+	})
+}
+
+// Parses a Zabbix time value with an optional suffix (s, m, h, d, w).
+// Macros and flexible intervals fall back to the default item delay.
+func parseZabbixDelay(delay string) time.Duration {
+	// Drop custom intervals, "30s;50s/1-5,09:00-18:00"
+	if i := strings.Index(delay, ";"); i >= 0 {
+		delay = delay[:i]
+	}
+	if delay == "" {
+		return zabbixDefaultItemDelay
+	}
+
+	unit := time.Second
+	switch delay[len(delay)-1] {
+	case 's':
+		delay = delay[:len(delay)-1]
+	case 'm':
+		unit = time.Minute
+		delay = delay[:len(delay)-1]
+	case 'h':
+		unit = time.Hour
+		delay = delay[:len(delay)-1]
+	case 'd':
+		unit = 24 * time.Hour
+		delay = delay[:len(delay)-1]
+	case 'w':
+		unit = 7 * 24 * time.Hour
+		delay = delay[:len(delay)-1]
+	}
+
+	n, err := strconv.Atoi(delay)
+	if err != nil {
+		return zabbixDefaultItemDelay
+	}
+	return time.Duration(n) * unit
+}
+
+// Resolves names to ids using a get method filtering on nameField.
+func (api *ZabbixApiClient) resolveIds(method string, nameField string, idField string, names []string) (ids []string, err error) {
+	if len(names) == 0 {
+		return
+	}
+
+	params := map[string]interface{}{
+		"output": []string{idField, nameField},
+		"filter": map[string]interface{}{nameField: names},
+	}
+
+	var objs []map[string]string
+	if err = api.Call(method, params, &objs); err != nil {
+		return
+	}
+	if len(objs) != len(names) {
+		return nil, fmt.Errorf("%s: only %d of %v found", method, len(objs), names)
+	}
+
+	for _, obj := range objs {
+		ids = append(ids, obj[idField])
+	}
+	return
+}
+
+func (api *ZabbixApiClient) HostGroupIds(names []string) ([]string, error) {
+	return api.resolveIds("hostgroup.get", "name", "groupid", names)
+}
+
+func (api *ZabbixApiClient) TemplateIds(names []string) ([]string, error) {
+	return api.resolveIds("template.get", "host", "templateid", names)
+}
+
+// Returns the id of a host, empty if it doesn't exist.
+func (api *ZabbixApiClient) HostId(host string) (id string, err error) {
+	params := map[string]interface{}{
+		"output": []string{"hostid"},
+		"filter": map[string]interface{}{"host": []string{host}},
+	}
+
+	var hosts []map[string]string
+	if err = api.Call("host.get", params, &hosts); err != nil || len(hosts) == 0 {
+		return
+	}
+	return hosts[0]["hostid"], nil
+}
+
+// Hosts currently in maintenance, as evaluated by the server from the
+// periods of the maintenance.get maintenances.
+func (api *ZabbixApiClient) MaintenanceHosts() (hosts map[string]bool, err error) {
+	params := map[string]interface{}{
+		"output": []string{"host"},
+		"filter": map[string]interface{}{"maintenance_status": "1"},
+	}
+
+	var res []map[string]string
+	if err = api.Call("host.get", params, &res); err != nil {
+		return
+	}
+	hosts = make(map[string]bool, len(res))
+	for _, h := range res {
+		hosts[h["host"]] = true
+	}
+	return
+}
+
+// Agent interface added to created hosts
+type ZabbixHostInterface struct {
+	Ip   string `toml:"ip"`
+	Dns  string `toml:"dns"`
+	Port string `toml:"port"`
+}
+
+// Creates a host unless it already exists, returns whether it was created.
+func (api *ZabbixApiClient) EnsureHost(host string, groupIds []string, templateIds []string,
+	iface *ZabbixHostInterface) (created bool, err error) {
+
+	var id string
+	if id, err = api.HostId(host); err != nil || id != "" {
+		return
+	}
+
+	groups := make([]map[string]string, 0, len(groupIds))
+	for _, gid := range groupIds {
+		groups = append(groups, map[string]string{"groupid": gid})
+	}
+	templates := make([]map[string]string, 0, len(templateIds))
+	for _, tid := range templateIds {
+		templates = append(templates, map[string]string{"templateid": tid})
+	}
+	params := map[string]interface{}{
+		"host":      host,
+		"groups":    groups,
+		"templates": templates,
+	}
+
+	if iface != nil && (iface.Ip != "" || iface.Dns != "") {
+		useip := 0
+		if iface.Ip != "" {
+			useip = 1
+		}
+		params["interfaces"] = []map[string]interface{}{{
+			"type":  1,
+			"main":  1,
+			"useip": useip,
+			"ip":    iface.Ip,
+			"dns":   iface.Dns,
+			"port":  iface.Port,
+		}}
+	}
+
+	if err = api.Call("host.create", params, nil); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// Returns the id of an application of a host or template, applications
+// are gone from Zabbix 5.4.
+func (api *ZabbixApiClient) ApplicationId(hostId string, name string) (id string, err error) {
+	params := map[string]interface{}{
+		"output":  []string{"applicationid"},
+		"hostids": []string{hostId},
+		"filter":  map[string]interface{}{"name": []string{name}},
+	}
+
+	var apps []map[string]string
+	if err = api.Call("application.get", params, &apps); err != nil {
+		return
+	}
+	if len(apps) == 0 {
+		return "", fmt.Errorf("application.get: %s not found", name)
+	}
+	return apps[0]["applicationid"], nil
+}
+
+// Item created on a host or template, named after its key.
+type ZabbixItemCreate struct {
+	HostId         string
+	Key            string
+	Type           int
+	ValueType      int
+	Delay          string
+	ApplicationIds []string
+}
+
+func (api *ZabbixApiClient) CreateItem(item ZabbixItemCreate) (err error) {
+	params := map[string]interface{}{
+		"name":       item.Key,
+		"key_":       item.Key,
+		"hostid":     item.HostId,
+		"type":       item.Type,
+		"value_type": item.ValueType,
+	}
+	if item.Type != zabbixItemTypeTrapper {
+		params["delay"] = item.Delay
+	}
+	if len(item.ApplicationIds) > 0 {
+		params["applications"] = item.ApplicationIds
+	}
+	return api.Call("item.create", params, nil)
+}
+
+type zabbixApiItemMetadata struct {
+	ItemId    string `json:"itemid"`
+	Key       string `json:"key_"`
+	ValueType string `json:"value_type"`
+	Units     string `json:"units"`
+	History   string `json:"history"`
+	Trends    string `json:"trends"`
+}
+
+// Fetches ids, units, value type and storage settings of all items of a host.
+func (api *ZabbixApiClient) FetchItemMetadata(host string) (items map[string]ZabbixItemMetadata, err error) {
+	params := map[string]interface{}{
+		"output": []string{"itemid", "key_", "value_type", "units", "history", "trends"},
+		"host":   host,
+	}
+
+	var res []zabbixApiItemMetadata
+	if err = api.Call("item.get", params, &res); err != nil {
+		return
+	}
+
+	items = make(map[string]ZabbixItemMetadata, len(res))
+	for _, item := range res {
+		vt, _ := strconv.Atoi(item.ValueType)
+		items[item.Key] = ZabbixItemMetadata{
+			ItemId:    item.ItemId,
+			ValueType: vt,
+			Units:     item.Units,
+			History:   item.History,
+			Trends:    item.Trends,
+		}
+	}
+	return
+}
+
+// Trigger severities, indexed by priority
+var zabbixSeverities = []string{"Not classified", "Information", "Warning", "Average", "High", "Disaster"}
+
+// Context of a trigger, used to enrich alerts.
+type ZabbixTriggerContext struct {
+	TriggerId   string
+	Description string
+	Comments    string
+	Priority    int
+	Severity    string
+	Tags        map[string]string
+	Hosts       []string
+	Inventory   map[string]string
+}
+
+type zabbixApiTag struct {
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+type zabbixApiTrigger struct {
+	TriggerId   string         `json:"triggerid"`
+	Description string         `json:"description"`
+	Comments    string         `json:"comments"`
+	Priority    string         `json:"priority"`
+	Tags        []zabbixApiTag `json:"tags"`
+	Hosts       []struct {
+		HostId string `json:"hostid"`
+		Host   string `json:"host"`
+	} `json:"hosts"`
+}
+
+// Returns the id of the trigger which generated an event.
+func (api *ZabbixApiClient) EventTriggerId(eventId string) (id string, err error) {
+	params := map[string]interface{}{
+		"output":   []string{"objectid"},
+		"eventids": []string{eventId},
+		"source":   0,
+		"object":   0,
+	}
+
+	var events []map[string]string
+	if err = api.Call("event.get", params, &events); err != nil {
+		return
+	}
+	if len(events) == 0 {
+		return "", fmt.Errorf("Event %s not found", eventId)
+	}
+	return events[0]["objectid"], nil
+}
+
+// Fetches description, severity, tags and the inventory of the first host
+// of a trigger.
+func (api *ZabbixApiClient) FetchTriggerContext(triggerId string) (tc *ZabbixTriggerContext, err error) {
+	params := map[string]interface{}{
+		"output":            []string{"triggerid", "description", "comments", "priority"},
+		"triggerids":        []string{triggerId},
+		"selectTags":        "extend",
+		"selectHosts":       []string{"hostid", "host"},
+		"expandDescription": true,
+	}
+
+	var triggers []zabbixApiTrigger
+	if err = api.Call("trigger.get", params, &triggers); err != nil {
+		return
+	}
+	if len(triggers) == 0 {
+		return nil, fmt.Errorf("Trigger %s not found", triggerId)
+	}
+
+	t := triggers[0]
+	tc = &ZabbixTriggerContext{
+		TriggerId:   t.TriggerId,
+		Description: t.Description,
+		Comments:    t.Comments,
+		Tags:        make(map[string]string, len(t.Tags)),
+	}
+	tc.Priority, _ = strconv.Atoi(t.Priority)
+	if tc.Priority >= 0 && tc.Priority < len(zabbixSeverities) {
+		tc.Severity = zabbixSeverities[tc.Priority]
+	}
+	for _, tag := range t.Tags {
+		tc.Tags[tag.Tag] = tag.Value
+	}
+	for _, h := range t.Hosts {
+		tc.Hosts = append(tc.Hosts, h.Host)
+	}
+	if len(t.Hosts) == 0 {
+		return
+	}
+
+	hostParams := map[string]interface{}{
+		"output":          []string{"hostid"},
+		"hostids":         []string{t.Hosts[0].HostId},
+		"selectInventory": "extend",
+	}
+	var hosts []struct {
+		Inventory json.RawMessage `json:"inventory"`
+	}
+	if err = api.Call("host.get", hostParams, &hosts); err != nil {
+		return
+	}
+	// Hosts with inventory disabled return an empty array
+	if len(hosts) > 0 && bytes.HasPrefix(bytes.TrimSpace(hosts[0].Inventory), []byte("{")) {
+		if err = json.Unmarshal(hosts[0].Inventory, &tc.Inventory); err != nil {
+			return nil, fmt.Errorf("Unable to decode inventory of %s: %s", tc.Hosts[0], err)
+		}
+	}
+	return
+}
+
+// Value pushed through history.push. Value is kept as encoded, a string or
+// a number.
+type ZabbixHistoryValue struct {
+	Host  string          `json:"host"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Clock int64           `json:"clock,omitempty"`
+	Ns    int64           `json:"ns,omitempty"`
+}
+
+type zabbixHistoryPushResult struct {
+	Response string `json:"response"`
+	Data     []struct {
+		ItemId string `json:"itemid"`
+		Error  string `json:"error"`
+	} `json:"data"`
+}
+
+// Sends values to trapper and HTTP agent items over the api, Zabbix 7.0 or
+// later. Returns the counts like a trapper response along with the errors
+// of the failed values.
+func (api *ZabbixApiClient) PushHistory(values []ZabbixHistoryValue) (res zabbixSendResult, err error) {
+	var result zabbixHistoryPushResult
+	if err = api.Call("history.push", values, &result); err != nil {
+		return
+	}
+	if result.Response != "success" {
+		return res, fmt.Errorf("history.push failed: %s", result.Response)
+	}
+
+	res.Total = len(values)
+	for i, d := range result.Data {
+		if d.Error == "" {
+			res.Processed++
+			continue
+		}
+		res.Failed++
+		if i < len(values) {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s:%s: %s", values[i].Host, values[i].Key, d.Error))
+			res.FailedItems = append(res.FailedItems, zabbixFailedItem{values[i].Host, values[i].Key, d.Error})
+		}
+	}
+	return
+}
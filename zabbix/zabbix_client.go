@@ -0,0 +1,608 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mathpl/active_zabbix"
+)
+
+// Zabbix protocol header flags
+const (
+	zbxdFlagProtocol   = 0x01
+	zbxdFlagCompressed = 0x02
+	zbxdFlagLarge      = 0x04
+
+	// Upper bound of the responses we accept from the server
+	zbxdMaxResponseSize = 128 * 1024 * 1024
+
+	// Idle persistent connections kept per server by default
+	zabbixMaxIdleConns = 4
+)
+
+var zbxdMagic = []byte("ZBXD")
+
+// Timeouts of the operations on a Zabbix server.
+type zabbixTimeouts struct {
+	// Dial
+	connect time.Duration
+	// Whole exchange of an active check request and of a data send.
+	// When zero the write and read deadlines apply separately.
+	checks time.Duration
+	data   time.Duration
+	// Write and read deadlines
+	send    time.Duration
+	receive time.Duration
+}
+
+// Timeouts, bare numbers in ms, overriding the plugin wide ones for a
+// single server, zero values are inherited.
+type ZabbixTargetTimeouts struct {
+	ConnectTimeout DurationMillis `toml:"connect_timeout"`
+	ChecksTimeout  DurationMillis `toml:"checks_timeout"`
+	DataTimeout    DurationMillis `toml:"data_timeout"`
+	SendTimeout    DurationMillis `toml:"send_timeout"`
+	ReceiveTimeout DurationMillis `toml:"receive_timeout"`
+}
+
+func (t zabbixTimeouts) override(o ZabbixTargetTimeouts) zabbixTimeouts {
+	ms := func(v DurationMillis, d time.Duration) time.Duration {
+		if v == 0 {
+			return d
+		}
+		return time.Duration(v)
+	}
+	return zabbixTimeouts{
+		connect: ms(o.ConnectTimeout, t.connect),
+		checks:  ms(o.ChecksTimeout, t.checks),
+		data:    ms(o.DataTimeout, t.data),
+		send:    ms(o.SendTimeout, t.send),
+		receive: ms(o.ReceiveTimeout, t.receive),
+	}
+}
+
+// Client side of the Zabbix agent/sender protocol, one connection per request
+// unless connections are persistent.
+type zabbixClient struct {
+	address  string
+	timeouts zabbixTimeouts
+	chaos    *zabbixChaos
+	tls      *zabbixTLS
+	proxy    *zabbixProxy
+	// Local address connections are made from, nil for any
+	source *net.TCPAddr
+
+	// Compress data requests of compressMin bytes or more. Once a server
+	// rejects them, compressionRefused holds when in unix nanoseconds and
+	// they are tried again after compressRetry.
+	compress           bool
+	compressMin        int
+	compressRetry      time.Duration
+	compressionRefused int64
+	// Counts the request bytes, nil not to
+	bytes *zabbixByteCounters
+
+	// Rotates the first address tried when the name resolves to several
+	rotation uint32
+
+	// Keep up to maxIdle connections open between requests, closing them
+	// after idleTimeout without use. keepalive is the TCP keepalive period.
+	persistent  bool
+	maxIdle     int
+	keepalive   time.Duration
+	idleTimeout time.Duration
+	idleLock    sync.Mutex
+	idle        []zabbixIdleConn
+
+	// Socket options, buffer sizes of 0 keep the system defaults
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+// Request bytes before compression and as sent, shared by the clients of
+// the servers so reloads don't reset them.
+type zabbixByteCounters struct {
+	uncompressed int64
+	sent         int64
+}
+
+type zabbixIdleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func newZabbixClient(address string, timeouts zabbixTimeouts) (zc *zabbixClient, err error) {
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid Zabbix server address %s, IPv6 addresses go in brackets: %s", address, err)
+	}
+	return &zabbixClient{address: address, timeouts: timeouts, maxIdle: zabbixMaxIdleConns, noDelay: true}, nil
+}
+
+// Resolves the server name on every connection so DNS changes are picked
+// up. When it has several A/AAAA records each connection starts on the
+// next one.
+func (zc *zabbixClient) resolve() (addrs []string, err error) {
+	host, port, _ := net.SplitHostPort(zc.address)
+	if net.ParseIP(host) != nil {
+		return []string{zc.address}, nil
+	}
+
+	var ips []string
+	if ips, err = lookupHost(host, zc.timeouts.connect); err != nil {
+		return nil, fmt.Errorf("Unable to resolve %s: %s", host, err)
+	}
+	first := int(atomic.AddUint32(&zc.rotation, 1) % uint32(len(ips)))
+	for i := range ips {
+		addrs = append(addrs, net.JoinHostPort(ips[(first+i)%len(ips)], port))
+	}
+	return
+}
+
+// Name lookup bound by timeout, the resolver may otherwise hang for
+// long on an unreachable DNS server. 0 for no timeout.
+func lookupHost(host string, timeout time.Duration) ([]string, error) {
+	if timeout == 0 {
+		return net.LookupHost(host)
+	}
+
+	type lookup struct {
+		ips []string
+		err error
+	}
+	done := make(chan lookup, 1)
+	go func() {
+		ips, err := net.LookupHost(host)
+		done <- lookup{ips, err}
+	}()
+	select {
+	case l := <-done:
+		return l.ips, l.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("lookup timed out after %s", timeout)
+	}
+}
+
+func (zc *zabbixClient) dial() (conn net.Conn, err error) {
+	dialer := net.Dialer{Timeout: zc.timeouts.connect, KeepAlive: zc.keepalive}
+	if zc.timeouts.connect != 0 {
+		// Bounds the connection as a whole, over all the addresses tried
+		dialer.Deadline = time.Now().Add(zc.timeouts.connect)
+	}
+	if zc.source != nil {
+		dialer.LocalAddr = zc.source
+	}
+	if zc.proxy != nil {
+		// The proxy resolves the name
+		conn, err = zc.proxy.dial(&dialer, zc.address)
+	} else {
+		var addrs []string
+		if addrs, err = zc.resolve(); err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			if conn, err = dialer.Dial("tcp", addr); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	zc.setSocketOptions(conn)
+	if zc.tls == nil {
+		return
+	}
+	return zc.tls.client(conn), nil
+}
+
+// Applies the socket options to a new connection, on the TCP connection
+// to the proxy when going through one.
+func (zc *zabbixClient) setSocketOptions(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(zc.noDelay)
+	if zc.readBuffer != 0 {
+		tc.SetReadBuffer(zc.readBuffer)
+	}
+	if zc.writeBuffer != 0 {
+		tc.SetWriteBuffer(zc.writeBuffer)
+	}
+}
+
+// Most recently used idle connection, nil when there's none left open.
+func (zc *zabbixClient) idleConn() net.Conn {
+	zc.idleLock.Lock()
+	defer zc.idleLock.Unlock()
+
+	for len(zc.idle) > 0 {
+		ic := zc.idle[len(zc.idle)-1]
+		zc.idle = zc.idle[:len(zc.idle)-1]
+		if (zc.idleTimeout == 0 || time.Since(ic.since) < zc.idleTimeout) && connAlive(ic.conn) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+	return nil
+}
+
+// Servers closing connections after each request, like the Zabbix trapper
+// does, show up as a pending EOF. Nothing else is readable between requests.
+func connAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Keeps a connection for the next requests, or closes it.
+func (zc *zabbixClient) release(conn net.Conn) {
+	if !zc.persistent {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	zc.idleLock.Lock()
+	defer zc.idleLock.Unlock()
+	if len(zc.idle) >= zc.maxIdle {
+		conn.Close()
+		return
+	}
+	zc.idle = append(zc.idle, zabbixIdleConn{conn, time.Now()})
+}
+
+// Closes the idle persistent connections.
+func (zc *zabbixClient) closeIdle() {
+	zc.idleLock.Lock()
+	defer zc.idleLock.Unlock()
+	for _, ic := range zc.idle {
+		ic.conn.Close()
+	}
+	zc.idle = nil
+}
+
+// Sends a request and returns the server response. A non zero total timeout
+// bounds the whole exchange, otherwise send and receive deadlines are used.
+func (zc *zabbixClient) request(payload []byte, total time.Duration, compress bool) (resp []byte, err error) {
+	if zc.chaos != nil {
+		if err = zc.chaos.before(); err != nil {
+			return
+		}
+	}
+
+	var conn net.Conn
+	if zc.persistent {
+		conn = zc.idleConn()
+	}
+	reused := conn != nil
+	if conn == nil {
+		if conn, err = zc.dial(); err != nil {
+			return
+		}
+	}
+	if resp, err = zc.exchange(conn, payload, total, compress); err != nil {
+		conn.Close()
+		if err == errZbxdClosed && reused {
+			// Likely closed while idle, says nothing about the request
+			err = fmt.Errorf("Idle connection closed: %s", err)
+		}
+		return
+	}
+	zc.release(conn)
+
+	if zc.chaos != nil {
+		resp = zc.chaos.after(resp)
+	}
+	return
+}
+
+func (zc *zabbixClient) exchange(conn net.Conn, payload []byte, total time.Duration, compress bool) (resp []byte, err error) {
+	if total != 0 {
+		conn.SetDeadline(time.Now().Add(total))
+	} else if zc.timeouts.send != 0 {
+		conn.SetWriteDeadline(time.Now().Add(zc.timeouts.send))
+	}
+
+	var sent int
+	if sent, err = writeZbxdPacket(conn, payload, compress); err != nil {
+		return
+	}
+	if zc.bytes != nil {
+		atomic.AddInt64(&zc.bytes.uncompressed, int64(len(payload)))
+		atomic.AddInt64(&zc.bytes.sent, int64(sent))
+	}
+
+	if total == 0 && zc.timeouts.receive != 0 {
+		conn.SetReadDeadline(time.Now().Add(zc.timeouts.receive))
+	}
+	return readZbxdPacket(conn)
+}
+
+// Writes a packet, compressed packets carry the uncompressed length in
+// the reserved field. Returns the size of the payload as written.
+func writeZbxdPacket(w io.Writer, payload []byte, compress bool) (sent int, err error) {
+	header := make([]byte, 13)
+	copy(header, zbxdMagic)
+	header[4] = zbxdFlagProtocol
+
+	if compress {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err = zw.Write(payload); err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Unable to compress request: %s", err)
+		}
+		header[4] |= zbxdFlagCompressed
+		binary.LittleEndian.PutUint32(header[9:13], uint32(len(payload)))
+		payload = buf.Bytes()
+	}
+	binary.LittleEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+	if _, err = w.Write(payload); err != nil {
+		return
+	}
+	return len(payload), nil
+}
+
+// The server closed the connection without responding, what servers older
+// than 4.0 do with compressed requests
+var errZbxdClosed = errors.New("Connection closed by the server without a response")
+
+func readZbxdPacket(r io.Reader) (payload []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.EOF || connReset(err) {
+			return nil, errZbxdClosed
+		}
+		return nil, fmt.Errorf("Unable to read response header: %s", err)
+	}
+	if !bytes.Equal(header[:4], zbxdMagic) || header[4]&zbxdFlagProtocol == 0 {
+		return nil, fmt.Errorf("Invalid response header: %q", header)
+	}
+	flags := header[4]
+
+	var dataLen, reserved uint64
+	if flags&zbxdFlagLarge != 0 {
+		lens := make([]byte, 16)
+		if _, err = io.ReadFull(r, lens); err != nil {
+			return nil, fmt.Errorf("Unable to read response header: %s", err)
+		}
+		dataLen, reserved = binary.LittleEndian.Uint64(lens[:8]), binary.LittleEndian.Uint64(lens[8:])
+	} else {
+		lens := make([]byte, 8)
+		if _, err = io.ReadFull(r, lens); err != nil {
+			return nil, fmt.Errorf("Unable to read response header: %s", err)
+		}
+		dataLen = uint64(binary.LittleEndian.Uint32(lens[:4]))
+		reserved = uint64(binary.LittleEndian.Uint32(lens[4:]))
+	}
+	if dataLen > zbxdMaxResponseSize || reserved > zbxdMaxResponseSize {
+		return nil, fmt.Errorf("Response too large: %d bytes", dataLen)
+	}
+
+	payload = make([]byte, dataLen)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("Unable to read response: %s", err)
+	}
+
+	if flags&zbxdFlagCompressed != 0 {
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(bytes.NewReader(payload)); err != nil {
+			return nil, fmt.Errorf("Unable to decompress response: %s", err)
+		}
+		defer zr.Close()
+		if payload, err = ioutil.ReadAll(io.LimitReader(zr, int64(reserved))); err != nil {
+			return nil, fmt.Errorf("Unable to decompress response: %s", err)
+		}
+	}
+	return
+}
+
+func connReset(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ECONNRESET
+		}
+	}
+	return false
+}
+
+// Adds the clock and ns of the request to an encoded data request, right
+// before it goes out. The server shifts the value clocks by the difference
+// with its own clock, so values buffered during an outage keep accurate
+// timestamps even when the clocks drift apart.
+func stampRequest(payload []byte, now time.Time) []byte {
+	if len(payload) < 2 || payload[0] != '{' {
+		return payload
+	}
+	stamped := []byte(fmt.Sprintf(`{"clock":%d,"ns":%d,`, now.Unix(), now.Nanosecond()))
+	return append(stamped, payload[1:]...)
+}
+
+// Sends an encoded data request, returning the raw server response. Servers
+// older than 4.0 close the connection on compressed requests, only then is
+// the request sent again uncompressed, and compression turned off for
+// compressRetry if that goes through. Any other failure, a timeout included,
+// may have reached the server and isn't sent again.
+func (zc *zabbixClient) Send(payload []byte) (resp []byte, err error) {
+	if !zc.compressing(time.Now()) || len(payload) < zc.compressMin {
+		return zc.request(payload, zc.timeouts.data, false)
+	}
+
+	if resp, err = zc.request(payload, zc.timeouts.data, true); err == nil {
+		atomic.StoreInt64(&zc.compressionRefused, 0)
+		return
+	}
+	if err != errZbxdClosed {
+		return
+	}
+	if plainResp, plainErr := zc.request(payload, zc.timeouts.data, false); plainErr == nil {
+		atomic.StoreInt64(&zc.compressionRefused, time.Now().UnixNano())
+		return plainResp, nil
+	}
+	return
+}
+
+// Whether data requests are currently compressed.
+func (zc *zabbixClient) compressing(now time.Time) bool {
+	if !zc.compress {
+		return false
+	}
+	refused := atomic.LoadInt64(&zc.compressionRefused)
+	return refused == 0 || now.Sub(time.Unix(0, refused)) >= zc.compressRetry
+}
+
+// Outcome of a data request, from the info string of the response
+type zabbixSendResult struct {
+	Processed int
+	Failed    int
+	Total     int
+	// Why items failed, only known when pushing over the api or as a proxy
+	Errors      []string
+	FailedItems []zabbixFailedItem
+}
+
+// Item the server rejected a value of
+type zabbixFailedItem struct {
+	Host  string
+	Key   string
+	Error string
+}
+
+type zabbixSendResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+var zabbixSendInfoRegexp = regexp.MustCompile(`processed: (\d+); failed: (\d+); total: (\d+)`)
+
+// Parses a data request response:
+// {"response":"success","info":"processed: 2; failed: 1; total: 3; seconds spent: 0.000120"}
+func parseSendResponse(resp []byte) (res zabbixSendResult, err error) {
+	var sr zabbixSendResponse
+	if err = json.Unmarshal(resp, &sr); err != nil {
+		return res, fmt.Errorf("Unable to decode send response: %s", err)
+	}
+	if sr.Response != "success" {
+		return res, fmt.Errorf("Send failed: %s %s", sr.Response, sr.Info)
+	}
+
+	m := zabbixSendInfoRegexp.FindStringSubmatch(sr.Info)
+	if m == nil {
+		return res, fmt.Errorf("Unexpected send response info: %s", sr.Info)
+	}
+	res.Processed, _ = strconv.Atoi(m[1])
+	res.Failed, _ = strconv.Atoi(m[2])
+	res.Total, _ = strconv.Atoi(m[3])
+	return
+}
+
+type zabbixActiveChecksRequest struct {
+	Request      string `json:"request"`
+	Host         string `json:"host"`
+	HostMetadata string `json:"host_metadata,omitempty"`
+}
+
+// Active checks refused because the server doesn't know the host
+type zabbixHostNotFoundError struct {
+	info string
+}
+
+func (e *zabbixHostNotFoundError) Error() string {
+	return fmt.Sprintf("Active checks request failed: %s", e.info)
+}
+
+type zabbixActiveCheck struct {
+	Key   string          `json:"key"`
+	Delay json.RawMessage `json:"delay"`
+}
+
+type zabbixActiveChecksResponse struct {
+	Response string              `json:"response"`
+	Info     string              `json:"info"`
+	Data     []zabbixActiveCheck `json:"data"`
+	// When to ask for the list again, only sent by some servers and proxies
+	Refresh json.RawMessage `json:"refresh"`
+}
+
+// Fetches the list of active checks of a host, with the refresh interval
+// the server asks for, 0 when it doesn't.
+func (zc *zabbixClient) FetchActiveChecks(host string) (hc active_zabbix.HostActiveKeys, refresh time.Duration, err error) {
+	var req, resp []byte
+	if req, err = json.Marshal(zabbixActiveChecksRequest{Request: "active checks", Host: host}); err != nil {
+		return
+	}
+	if resp, err = zc.request(req, zc.timeouts.checks, false); err != nil {
+		return
+	}
+
+	var checks zabbixActiveChecksResponse
+	if err = json.Unmarshal(resp, &checks); err != nil {
+		return nil, 0, fmt.Errorf("Unable to decode active checks: %s", err)
+	}
+	if checks.Response != "success" {
+		if strings.Contains(checks.Info, "not found") {
+			return nil, 0, &zabbixHostNotFoundError{checks.Info}
+		}
+		return nil, 0, fmt.Errorf("Active checks request failed: %s", checks.Info)
+	}
+	if len(checks.Refresh) > 0 {
+		refresh = parseActiveCheckDelay(checks.Refresh)
+	}
+
+	hc = make(active_zabbix.HostActiveKeys, len(checks.Data))
+	for _, check := range checks.Data {
+		hc[check.Key] = parseActiveCheckDelay(check.Delay)
+	}
+	return
+}
+
+// Asks the server to auto-register a host, like an agent does with its
+// HostMetadata. The server answers the host isn't found yet and runs its
+// auto-registration actions in the background.
+func (zc *zabbixClient) Register(host string, metadata string) (err error) {
+	var req []byte
+	if req, err = json.Marshal(zabbixActiveChecksRequest{Request: "active checks", Host: host, HostMetadata: metadata}); err != nil {
+		return
+	}
+	_, err = zc.request(req, zc.timeouts.checks, false)
+	return
+}
+
+// Older servers send the delay as a number of seconds, newer ones as a
+// string with an optional time suffix.
+func parseActiveCheckDelay(raw json.RawMessage) time.Duration {
+	var seconds int64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return parseZabbixDelay(s)
+	}
+	return zabbixDefaultItemDelay
+}
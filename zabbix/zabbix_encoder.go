@@ -17,6 +17,7 @@ package plugins
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/mathpl/active_zabbix"
@@ -25,10 +26,17 @@ import (
 )
 
 type ZabbixEncoder struct {
-	config *ZabbixEncoderConfig
+	config    *ZabbixEncoderConfig
+	valueType int
 }
 
 type ZabbixEncoderConfig struct {
+	// Reject values not matching the item value type from the metadata cache
+	ValidateValueType bool `toml:"validate_value_type"`
+	// Value type numeric value fields are formatted for when the message
+	// has no value_type field: float, character, log, unsigned or text.
+	// Empty to use the metadata cache, then the field type.
+	ValueType string `toml:"value_type"`
 }
 
 func (ze *ZabbixEncoder) ConfigStruct() interface{} {
@@ -37,6 +45,7 @@ func (ze *ZabbixEncoder) ConfigStruct() interface{} {
 
 func (ze *ZabbixEncoder) Init(config interface{}) (err error) {
 	ze.config = config.(*ZabbixEncoderConfig)
+	ze.valueType, err = parseValueType(ze.config.ValueType)
 
 	return
 }
@@ -60,10 +69,85 @@ func fieldToString(fieldName string, pack *pipeline.PipelinePack) (val string, e
 	return
 }
 
+// Value type of a metric: from its value_type field, the configuration or
+// the metadata cache, in that order.
+func (ze *ZabbixEncoder) itemValueType(pack *pipeline.PipelinePack, host string, key string) (int, error) {
+	if tmp, ok := pack.Message.GetFieldValue("value_type"); ok {
+		name, _ := tmp.(string)
+		return parseValueType(name)
+	}
+	if ze.valueType != ZabbixValueAuto {
+		return ze.valueType, nil
+	}
+	if md, found := LookupItemMetadata(host, key); found {
+		return md.ValueType, nil
+	}
+	return ZabbixValueAuto, nil
+}
+
+// Integer field, found is false when the message doesn't have it.
+func fieldToInt64(fieldName string, pack *pipeline.PipelinePack) (val int64, found bool, err error) {
+	var tmp interface{}
+	if tmp, found = pack.Message.GetFieldValue(fieldName); !found {
+		return
+	}
+
+	switch v := tmp.(type) {
+	case int64:
+		val = v
+	case float64:
+		val = int64(v)
+	case string:
+		if val, err = strconv.ParseInt(v, 10, 64); err != nil {
+			err = fmt.Errorf("Unable to parse field %s: %s", fieldName, err)
+		}
+	default:
+		err = fmt.Errorf("Unable to cast field to integer: %s", fieldName)
+	}
+	return
+}
+
+// Value with the nanoseconds of its clock, Zabbix 3.0 or later orders
+// values of the same second with them
+type zabbixMetricJson struct {
+	active_zabbix.ZabbixMetricKeyJson
+	Ns int64 `json:"ns"`
+	// Log item fields, only sent when the message has them: the size and
+	// modification time of the log file past the value, and the event
+	// log source, severity and event id
+	LastLogSize *int64 `json:"lastlogsize,omitempty"`
+	Mtime       *int64 `json:"mtime,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Severity    *int64 `json:"severity,omitempty"`
+	EventId     *int64 `json:"eventid,omitempty"`
+}
+
+// Sets the log item fields the message carries.
+func (zm *zabbixMetricJson) setLogFields(pack *pipeline.PipelinePack) error {
+	for name, dst := range map[string]**int64{
+		"lastlogsize": &zm.LastLogSize,
+		"mtime":       &zm.Mtime,
+		"severity":    &zm.Severity,
+		"eventid":     &zm.EventId,
+	} {
+		if v, found, err := fieldToInt64(name, pack); err != nil {
+			return err
+		} else if found {
+			*dst = &v
+		}
+	}
+	if tmp, found := pack.Message.GetFieldValue("source"); found {
+		zm.Source, _ = tmp.(string)
+	}
+	return nil
+}
+
 func (ze *ZabbixEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
-	var zm active_zabbix.ZabbixMetricKeyJson
+	var zm zabbixMetricJson
 
-	zm.Clock = fmt.Sprintf("%d", time.Unix(0, pack.Message.GetTimestamp()).UTC().Unix())
+	ts := time.Unix(0, pack.Message.GetTimestamp()).UTC()
+	zm.Clock = fmt.Sprintf("%d", ts.Unix())
+	zm.Ns = int64(ts.Nanosecond())
 
 	if zm.Key, err = fieldToString("key", pack); err != nil {
 		return nil, err
@@ -71,9 +155,25 @@ func (ze *ZabbixEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err
 	if zm.Host, err = fieldToString("host", pack); err != nil {
 		return nil, err
 	}
-	if zm.Value, err = fieldToString("value", pack); err != nil {
+	var valueType int
+	if valueType, err = ze.itemValueType(pack, zm.Host, zm.Key); err != nil {
 		return nil, err
 	}
+	if tmp, ok := pack.Message.GetFieldValue("value"); !ok {
+		return nil, fmt.Errorf("Unable to find fieldname: value")
+	} else if zm.Value, err = formatItemValue(tmp, valueType); err != nil {
+		return nil, fmt.Errorf("%s:%s: %s", zm.Host, zm.Key, err)
+	}
+
+	if err = zm.setLogFields(pack); err != nil {
+		return nil, err
+	}
+
+	if ze.config.ValidateValueType {
+		if md, found := LookupItemMetadata(zm.Host, zm.Key); found && !validItemValue(md.ValueType, zm.Value) {
+			return nil, fmt.Errorf("Value %q invalid for item %s:%s of value type %d", zm.Value, zm.Host, zm.Key, md.ValueType)
+		}
+	}
 
 	output, err = json.Marshal(zm)
 
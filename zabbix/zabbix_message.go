@@ -0,0 +1,32 @@
+package plugins
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Builds a pack holding a Zabbix metric, with the fields ZabbixEncoder
+// expects. Returns nil and an error when the pack can't be built.
+func newZabbixMetricPack(h PluginHelper, msgLoopCount uint, msgType string,
+	host string, key string, value string, ts time.Time) (pack *PipelinePack, err error) {
+
+	if pack = h.PipelinePack(msgLoopCount); pack == nil {
+		return nil, fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops)
+	}
+
+	for _, f := range [][2]string{{"key", key}, {"host", host}, {"value", value}} {
+		var field *message.Field
+		if field, err = message.NewField(f[0], f[1], ""); err != nil {
+			pack.Recycle()
+			return nil, fmt.Errorf("Unable to add %s: %s", f[0], err)
+		}
+		pack.Message.AddField(field)
+	}
+
+	pack.Message.SetType(msgType)
+	pack.Message.SetTimestamp(ts.UnixNano())
+	return
+}
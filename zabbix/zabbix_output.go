@@ -1,11 +1,19 @@
 package plugins
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/mathpl/active_zabbix"
@@ -14,70 +22,878 @@ import (
 	. "github.com/mozilla-services/heka/pipeline"
 )
 
+// Item errors logged after a send, the rest are only counted
+const maxLoggedItemErrors = 10
+
+// Key list fetches of new hosts going on at once
+const maxNewHostFetches = 4
+
 // Output plugin that sends messages via TCP using the Heka protocol.
 type ZabbixOutput struct {
-	conf            *ZabbixOutputConfig
+	conf *ZabbixOutputConfig
+	// Key list per host, nil until fetched. Only used from the Run loop,
+	// Filter included, so reading it takes no lock: the fetches run aside
+	// and their lists are swapped in by the Run loop.
 	key_filter      map[string]active_zabbix.HostActiveKeys
+	key_matches     map[string]map[string]bool
 	key_seen_window time.Duration
 	key_seen        map[string]HostSeenKeys
-	zabbix_client   active_zabbix.ZabbixActiveClient
+	servers         *zabbixFailover
+	mirrors         []*zabbixMirror
+	api_client      *ZabbixApiClient
+	hosts_created   map[string]bool
+	host_create     chan string
+	hosts_failed    chan string
+	items_requested map[string]bool
+	item_create     chan itemCreateRequest
+	items_failed    chan string
+	// Value type of the created items, ZabbixValueAuto to pick it per item
+	item_value_type int
+	checks_failures map[string]*checksFailure
+	quiet_periods   []quietPeriod
+	history         *payloadHistory
+	host_stats      *hostStats
+	discard_stats   *discardStats
+	discarded_keys  *discardedKeys
+	priority_keys   []*regexp.Regexp
+	key_allow       []*regexp.Regexp
+	key_deny        []*regexp.Regexp
+	requeues        uint
+	item_errors     []string
+	proxy_data      *zabbixProxyData
+	item_failures   *itemIdsFailures
+	// Hosts records were accepted for, getting heartbeats
+	heartbeat_hosts map[string]bool
+	send_retry      retryPolicy
+	send_failures   int
+	batch_failures  uint // Failed sends of the head batch
+	send_retry_at   time.Time
+	checks_retry    retryPolicy
 	report_chan     chan chan reportMsg
+	breaker         *circuitBreaker
+	limiter         *tokenBucket
+	retry_budget    *tokenBucket
+	down_alert      *downAlert
+	// Last on-demand key list fetch per host, the fetches going on and
+	// their outcomes
+	host_fetches   map[string]time.Time
+	fetch_slots    chan struct{}
+	checks_fetched chan checksFetch
+	// When the key lists were last fetched, saved with them to
+	// checks_cache_file
+	checks_times map[string]time.Time
+	// Last metric per host, with host_idle_ttl
+	host_last_seen map[string]time.Time
+	// When the key lists are due, with checks_refresh_min and max
+	checks_next map[string]time.Time
+	// Values held back per host and key, with item_delay
+	item_delays map[string]map[string]*itemDelayWindow
+	// When the keys reported missing with nodata_after were last seen
+	nodata_reported map[string]map[string]time.Time
+	// Keys added, true, or removed by the filter messages per host
+	filter_overrides map[string]map[string]bool
+	// Creates the server clients, again when reloaded
+	server_client func(address string) (*zabbixClient, error)
+	server_bytes  zabbixByteCounters
+	// send_key_count and zabbix_checks_poll_interval, also read outside
+	// the Run loop once reloaded
+	send_key_count  uint32
+	checks_interval int64
+	// Hosts in maintenance, and the records held for them
+	maintenance  map[string]bool
+	held_records map[string][][]byte
+	// Keys rejected by the server, and the unsupported keys per host
+	negative    *negativeCache
+	unsupported map[string]map[string]bool
+	// Used by the sender only, the report reads spool_segments and
+	// spool_bytes
+	spool          *diskSpool
+	spool_segments int64
+	spool_bytes    int64
+	// Counters written by the sender are guarded by stats_lock, the sender
+	// runs in its own goroutine when send_queue_size is set
+	stats_lock sync.Mutex
+	stats      zabbixOutputStats
+	// Batches and priority records handed to the sender goroutine, and
+	// records it holds
+	send_queue     chan [][]byte
+	priority_queue chan []byte
+	send_pending   int64
+	// Heka's checkpointed output queue with use_buffering, the batches are
+	// sent from its own goroutine
+	buffered_out *BufferedOutput
+	// Session and ids of the values with value_ids
+	value_ids *valueIds
+	// Where the data requests go instead of the servers with dry_run
+	dry_run *dryRunLog
+	// Set by Run for the sends and dead letters outside the Run loop
+	runner OutputRunner
+	helper PluginHelper
 }
 
 type reportMsg struct {
 	name   string
 	values []string
+	json   []byte
+}
+
+// Counters maintained by the Run loop
+type zabbixOutputStats struct {
+	Buffered     int   `json:"buffered"`
+	Sent         int64 `json:"sent"`
+	PrioritySent int64 `json:"priority_sent"`
+	Discarded    int64 `json:"discarded"`
+	Truncated    int64 `json:"truncated"`
+	SendErrors   int64 `json:"send_errors"`
+	EncodeErrors int64 `json:"encode_errors"`
+	FilterErrors int64 `json:"filter_errors"`
+	ChecksErrors int64 `json:"checks_errors"`
+	// Item counters from the server responses
+	ItemsProcessed int64 `json:"items_processed"`
+	ItemsFailed    int64 `json:"items_failed"`
+	// Auto-registration requests sent
+	Registrations int64 `json:"registrations"`
+	// Records written to the spool and sent from it
+	Spooled   int64 `json:"spooled"`
+	Unspooled int64 `json:"unspooled"`
+	// Batches dropped after max_send_retries failed sends
+	RetriesExhausted int64 `json:"retries_exhausted"`
+	// Failed batches spooled or dropped over max_retries_per_minute
+	RetryBudgetExceeded int64 `json:"retry_budget_exceeded"`
+	// Records of hosts in maintenance dropped or held
+	Maintenance int64 `json:"maintenance"`
+	// Held records dropped over max_key_count per host
+	MaintenanceDropped int64 `json:"maintenance_dropped"`
+	// Failed records re-injected as zabbix.failed messages
+	DeadLettered int64 `json:"dead_lettered"`
+	// Messages held during the warm-up
+	WarmupHeld int64 `json:"warmup_held"`
+	// Times reading stopped with block_on_full
+	Blocked int64 `json:"blocked"`
+	// Hosts forgotten after host_idle_ttl without metrics
+	HostsEvicted int64 `json:"hosts_evicted"`
+	// Messages held until the key list of their host was fetched
+	UnknownHostHeld int64 `json:"unknown_host_held"`
+}
+
+// Plugin state exposed as a single JSON field in the report
+type zabbixOutputState struct {
+	ActiveChecks map[string][]string `json:"active_checks"`
+	KeySeen      map[string][]string `json:"key_seen"`
+	// Consecutive key list fetch failures per host
+	ChecksFailures map[string]int    `json:"checks_failures"`
+	Stats          zabbixOutputStats `json:"stats"`
+	HostStats      []hostStatsEntry  `json:"host_stats,omitempty"`
+	// Most discarded host and key pairs
+	DiscardStats []discardStatsEntry `json:"discard_stats,omitempty"`
+	// Server requests currently go to
+	Server  string              `json:"server"`
+	Mirrors []zabbixMirrorState `json:"mirrors,omitempty"`
+	// Whether data requests are sent compressed
+	Compressing bool `json:"compressing"`
+	// Bytes of the server requests before compression and as sent
+	UncompressedBytes int64 `json:"uncompressed_bytes"`
+	CompressedBytes   int64 `json:"compressed_bytes"`
+	// Circuit breaker state: closed, open or half-open
+	Circuit string `json:"circuit"`
+	// Hosts in maintenance
+	InMaintenance []string `json:"in_maintenance,omitempty"`
+	// Keys suppressed after being rejected by the server
+	Suppressed []suppressedKey `json:"suppressed,omitempty"`
+	// Batches and bytes in the disk spool
+	SpoolSegments int64 `json:"spool_segments,omitempty"`
+	SpoolBytes    int64 `json:"spool_bytes,omitempty"`
+}
+
+// Host of a metric message, empty if missing.
+func packHost(pack *PipelinePack) string {
+	host, _ := fieldToString("host", pack)
+	return host
 }
 
 type HostActiveKeys map[string]time.Duration
 type HostSeenKeys map[string]time.Time
 
-// ConfigStruct for ZabbixOutputstruct plugin.
+// ConfigStruct for ZabbixOutputstruct plugin. Intervals and timeouts take
+// duration strings like "500ms" or "5m", bare numbers are in the unit given
+// for each setting.
 type ZabbixOutputConfig struct {
-	// Zabbix server address
+	// How data is sent: "trapper" to the server address, "proxy" to the
+	// server address as the active proxy proxy_name, or "api" through
+	// history.push of the api section, Zabbix 7.0 or later. The api mode
+	// ignores the connection settings. The proxy and api modes need
+	// checks_source = "api", the proxy one looks up the item ids through
+	// the api, new items are picked up every item_metadata_interval.
+	Mode string `toml:"mode"`
+	// Name the proxy is registered with on the server, and version it
+	// reports
+	ProxyName    string `toml:"proxy_name"`
+	ProxyVersion string `toml:"proxy_version"`
+	// Request of the data sends: "agent data" or "sender data" like
+	// zabbix_sender, some proxies validate hosts and items differently
+	RequestType string `toml:"request_type"`
+	// Zabbix server address, or a comma separated list of servers to fail
+	// over to. Names are resolved again on every connection, IPv6
+	// addresses go in brackets: [2001:db8::1]:10051
 	Address string `toml:"address"`
-	// Maximum interval between each send
+	// Servers receiving a copy of every batch, e.g. while migrating. Each
+	// one buffers on its own, up to max_key_count records.
+	MirrorAddresses []string `toml:"mirror_addresses"`
+	// How the server list is used: "ordered" sticks to a server until it
+	// fails, "round_robin" spreads requests over all of them
+	FailoverMode string `toml:"failover_mode"`
+	// Seconds between probes of the first server once failed over from it
+	// in ordered mode
+	FailoverProbeInterval DurationSeconds `toml:"failover_probe_interval"`
+	// Maximum interval between each send, in seconds. Only a number, Heka
+	// reads it too.
 	TickerInterval uint `toml:"ticker_interval"`
 	// Time between each update from the zabbix server for key filtering
-	ZabbixChecksPollInterval uint `toml:"zabbix_checks_poll_interval"`
+	ZabbixChecksPollInterval DurationSeconds `toml:"zabbix_checks_poll_interval"`
+	// Percentage of zabbix_checks_poll_interval added or removed at random
+	// between rounds, so instances started together don't all poll the
+	// server at once. The first round is also delayed by up to that much,
+	// at most half of warmup_timeout so the warm-up ends on fetched lists.
+	ZabbixChecksPollJitter uint `toml:"zabbix_checks_poll_jitter"`
+	// Regexps the keys must match one of, when set, and must match none
+	// of, checked before the key lists. They also apply with
+	// zabbix_checks_poll_interval = 0, e.g. for trapper items.
+	KeyAllow []string `toml:"key_allow"`
+	KeyDeny  []string `toml:"key_deny"`
+	// How keys are looked up in the key lists: "exact", "prefix" where a
+	// key matches the listed keys starting with it, or "glob" where the
+	// listed keys may hold * and ? wildcards
+	KeyMatch string `toml:"key_match"`
+	// What to do with the values of a key coming faster than the delay of
+	// its item in the key list: "off" to send them all, "drop" to send one
+	// per delay and "average" to send the average of the numeric values
+	// since the last one sent. Goes by the message timestamps.
+	ItemDelay string `toml:"item_delay"`
+	// What to do with the metrics of a host whose key list isn't known,
+	// new or its server unable to provide one: "discard" them, "pass" them
+	// on unfiltered, or "buffer" them until the list is fetched, up to half
+	// of poolsize for all the hosts, discarding the others.
+	UnknownHostPolicy string `toml:"unknown_host_policy"`
+	// Minimum time between two fetches of the key list of a host seen for
+	// the first time, or whose list couldn't be fetched yet, made right
+	// away rather than on the next zabbix_checks_poll_interval round. The
+	// list fetch backoff and the quiet periods still apply. 0 to wait for
+	// the next round.
+	NewHostFetchInterval DurationSeconds `toml:"new_host_fetch_interval"`
+	// Key lists fetched at once on each zabbix_checks_poll_interval round.
+	ChecksFetchWorkers uint `toml:"checks_fetch_workers"`
+	// File the key lists are saved to after each round, and loaded from at
+	// startup so a restart while the servers are unreachable doesn't
+	// discard every metric. The saved lists older than
+	// checks_cache_max_age are left out, 0 to keep them all.
+	ChecksCacheFile   string          `toml:"checks_cache_file"`
+	ChecksCacheMaxAge DurationSeconds `toml:"checks_cache_max_age"`
+	// Hosts with no metric for that long are forgotten, their key list
+	// isn't fetched anymore until they send again. 0 to keep them all.
+	HostIdleTtl DurationSeconds `toml:"host_idle_ttl"`
+	// Bounds of the key list refresh interval the servers may ask for in
+	// their active checks responses. When both are set, each host is
+	// refreshed as its server asks, or every zabbix_checks_poll_interval
+	// when it doesn't, with rounds run every checks_refresh_min at most.
+	ChecksRefreshMin DurationSeconds `toml:"checks_refresh_min"`
+	ChecksRefreshMax DurationSeconds `toml:"checks_refresh_max"`
+	// Seconds messages are held at startup, without being filtered, until
+	// the key lists of the hosts seen so far were fetched once. Holds at
+	// most half of Heka's poolsize messages. 0 to filter them right away,
+	// the first ones against empty key lists.
+	WarmupTimeout DurationSeconds `toml:"warmup_timeout"`
 	// Maximum key count retained when zabbix doesn't respond
 	MaxKeyCount uint `toml:"max_key_count"`
 	// This many keys will trigger a send
 	SendKeyCount uint `toml:"send_key_count"`
+	// Upper bound in bytes of a data request, batches are split further to
+	// stay below the server limit. 0 to only split by count.
+	MaxBatchBytes uint `toml:"max_batch_bytes"`
+	// Upper bound in bytes of the buffered records, on top of
+	// max_key_count. 0 for no limit.
+	MaxBufferBytes uint `toml:"max_buffer_bytes"`
+	// Directory of the disk spool the metrics over max_key_count or
+	// max_buffer_bytes go to instead of being dropped, drained oldest
+	// first once sends succeed again. Empty to disable.
+	SpoolDir string `toml:"spool_dir"`
+	// Disk space in bytes the spool may use, its oldest segments are
+	// dropped beyond. 0 for no limit.
+	SpoolMaxBytes int64 `toml:"spool_max_bytes"`
+	// Compression of the spool segments: "none", "gzip" or "snappy"
+	SpoolCompression string `toml:"spool_compression"`
+	// AES key file encrypting the spool segments, raw or hex encoded
+	SpoolKeyFile string `toml:"spool_key_file"`
+	// Metrics dropped when the buffer goes over max_key_count or
+	// max_buffer_bytes: "oldest" or "newest", the latter keeps stale values
+	// rather than recent ones
+	Drop string `toml:"drop"`
+	// Stop reading messages while the buffer is over max_key_count or
+	// max_buffer_bytes instead of dropping metrics, Heka's own buffers take
+	// the load and the inputs slow down. Heka only stops once the buffer
+	// went below the limits again. Can't be combined with send_queue_size,
+	// spool_dir or use_buffering.
+	BlockOnFull bool `toml:"block_on_full"`
+	// Filter, encode and batch as usual but log the data requests, or
+	// append them to dry_run_file one per line, instead of sending them.
+	// Nothing is sent to the mirrors, and hosts aren't registered or
+	// created. The key lists are still fetched, set
+	// zabbix_checks_poll_interval = 0 to stay off the servers entirely.
+	DryRun     bool   `toml:"dry_run"`
+	DryRunFile string `toml:"dry_run_file"`
+	// Send a session token and an id per value in agent data requests, so
+	// Zabbix 4.4 or later doesn't store twice the values of a batch sent
+	// again. The session and ids carry on over restarts with
+	// value_ids_file. Needs the values sent in order: no priority lane,
+	// spool, parallel sends or maintenance buffer.
+	ValueIds     bool   `toml:"value_ids"`
+	ValueIdsFile string `toml:"value_ids_file"`
+	// Queue the batches to Heka's checkpointed disk queue, under
+	// base_dir/output_queue, and send them from there so restarts don't
+	// lose them. Batches are retried until the server takes them and the
+	// packs are only recycled once queued, send_key_count must stay below
+	// Heka's poolsize. Replaces send_queue_size, spool_dir and the
+	// in-memory buffer limits.
+	UseBuffering bool `toml:"use_buffering"`
+	// Disk space in bytes of the queue, new batches are dropped beyond.
+	// 0 for no limit.
+	QueueMaxBufferSize uint64 `toml:"queue_max_buffer_size"`
+	// Time in ms the records still buffered when Heka stops are sent for,
+	// the rest goes to the spool_dir spool if set. 0 to spool them right
+	// away.
+	ShutdownTimeout DurationMillis `toml:"shutdown_timeout"`
+	// JSON file re-read on SIGHUP, changing address,
+	// zabbix_checks_poll_interval, send_timeout, receive_timeout and
+	// send_key_count without restarting Heka and losing the buffered
+	// records: {"address": "zabbix2:10051", "send_timeout": "2s"}. Settings
+	// left out keep their value. Empty to disable.
+	ReloadFile string `toml:"reload_file"`
+	// Take the same settings from the payload of zabbix.reload messages,
+	// or re-read reload_file when the payload is empty. The message matcher
+	// must let them in.
+	ReloadMessages bool `toml:"reload_messages"`
+	// Take zabbix.filter.add and zabbix.filter.remove messages adding the
+	// values of their keys field to the key list of their host field, or
+	// removing them, until told otherwise. The message matcher must let
+	// them in.
+	FilterMessages bool `toml:"filter_messages"`
 	// Encoder to use
 	Encoder string `toml:"encoder"`
 	// Read deadline in ms
-	ReceiveTimeout uint `toml:"receive_timeout"`
+	ReceiveTimeout DurationMillis `toml:"receive_timeout"`
 	// Write deadline in ms
-	SendTimeout uint `toml:"send_timeout"`
+	SendTimeout DurationMillis `toml:"send_timeout"`
+	// Dial timeout in ms
+	ConnectTimeout DurationMillis `toml:"connect_timeout"`
+	// Deadline in ms for a whole active check request, 0 to use the
+	// send and receive deadlines
+	ChecksTimeout DurationMillis `toml:"checks_timeout"`
+	// Deadline in ms for a whole data send, 0 to use the send and receive
+	// deadlines
+	DataTimeout DurationMillis `toml:"data_timeout"`
+	// Per server address overrides of the timeouts
+	TargetTimeouts map[string]ZabbixTargetTimeouts `toml:"target_timeouts"`
+	// Encryption of the server connections: "unencrypted", "psk" or "cert"
+	TlsConnect string `toml:"tls_connect"`
+	// PSK identity and file holding the PSK as hex digits
+	TlsPskIdentity string `toml:"tls_psk_identity"`
+	TlsPskFile     string `toml:"tls_psk_file"`
+	// CA, client certificate and key PEM files for "cert"
+	TlsCaFile   string `toml:"tls_ca_file"`
+	TlsCertFile string `toml:"tls_cert_file"`
+	TlsKeyFile  string `toml:"tls_key_file"`
+	// Expected issuer and subject of the server certificate, e.g.
+	// "CN=Zabbix server,O=Example,C=US"
+	TlsServerCertIssuer  string `toml:"tls_server_cert_issuer"`
+	TlsServerCertSubject string `toml:"tls_server_cert_subject"`
+	// Outbound proxy for the server connections: "socks5" or "http" for
+	// HTTP CONNECT, with optional credentials
+	ProxyType     string `toml:"proxy_type"`
+	ProxyAddress  string `toml:"proxy_address"`
+	ProxyUser     string `toml:"proxy_user"`
+	ProxyPassword string `toml:"proxy_password"`
+	// Local IP the server connections are made from, on multi-homed hosts
+	// the trapper items only accept some sender addresses
+	SourceAddress string `toml:"source_address"`
+	// Reuse connections between requests instead of opening one per batch
+	// and per key list fetch, for servers and proxies keeping them open.
+	// Idle connections are closed after connection_idle_timeout seconds.
+	PersistentConnections bool            `toml:"persistent_connections"`
+	ConnectionIdleTimeout DurationSeconds `toml:"connection_idle_timeout"`
+	// TCP keepalive period in seconds, 0 for the system default
+	TcpKeepalive DurationSeconds `toml:"tcp_keepalive"`
+	// Send small writes immediately, the default. When off the kernel
+	// coalesces them, Nagle's algorithm.
+	TcpNoDelay bool `toml:"tcp_no_delay"`
+	// Socket receive and send buffer sizes in bytes, 0 for the system
+	// defaults
+	TcpReadBuffer  uint `toml:"tcp_read_buffer"`
+	TcpWriteBuffer uint `toml:"tcp_write_buffer"`
+	// Compress data requests, needs Zabbix 4.0 or later. Turned off when
+	// the server only accepts uncompressed requests, and tried again every
+	// failover_probe_interval.
+	Compression bool `toml:"compression"`
+	// Smaller data requests are sent uncompressed, compressing them costs
+	// more than it saves
+	CompressMinBytes uint `toml:"compress_min_bytes"`
+	// Failure injection for testing, disabled by default
+	Chaos ZabbixChaosConfig `toml:"chaos"`
+	// Number of recent batch payloads kept for the report, 0 to disable
+	PayloadHistory uint `toml:"payload_history"`
+	// Number of busiest hosts whose counters are reported, 0 to disable
+	HostStats uint `toml:"host_stats"`
+	// Number of host and key pairs most discarded by the filter reported
+	// with their reason and count, 0 to disable. Also injected as a
+	// zabbix.discard.stats message every discard_stats_interval, 0 for
+	// the report only.
+	DiscardStats         uint            `toml:"discard_stats"`
+	DiscardStatsInterval DurationSeconds `toml:"discard_stats_interval"`
+	// Host and key pairs discarded for an unknown host or key, each listed
+	// once as a JSON line appended to discarded_keys_file, moved to
+	// discarded_keys_file.1 past discarded_keys_max_bytes (0 to let it
+	// grow), and/or injected as zabbix.discarded.keys messages every
+	// discarded_keys_interval, e.g. to create the missing items.
+	DiscardedKeysFile     string          `toml:"discarded_keys_file"`
+	DiscardedKeysMaxBytes uint            `toml:"discarded_keys_max_bytes"`
+	DiscardedKeysInterval DurationSeconds `toml:"discarded_keys_interval"`
+	// Assemble the next batch while the previous one is in flight
+	PipelinedSend bool `toml:"pipelined_send"`
+	// Batches queued to a sender goroutine so intake carries on while the
+	// server is slow, intake blocks once the queue is full. 0 to send from
+	// the Run loop.
+	SendQueueSize uint `toml:"send_queue_size"`
+	// Batches sent at once by SendRecords, each on its own connection.
+	// Takes over pipelined_send when above 1.
+	SendWorkers uint `toml:"send_workers"`
+	// Backoff between data sends after failures: initial and max interval
+	// in ms, multiplier and jitter fraction (0-1). The multiplier and the
+	// jitter also apply to the key list fetches, starting at
+	// zabbix_checks_poll_interval up to checks_backoff_max.
+	RetryInitialInterval DurationMillis `toml:"retry_initial_interval"`
+	RetryMaxInterval     DurationMillis `toml:"retry_max_interval"`
+	RetryMultiplier      float64        `toml:"retry_multiplier"`
+	RetryJitter          float64        `toml:"retry_jitter"`
+	// Values sent per second at most, the others stay buffered until the
+	// next send. 0 for no limit, at least send_key_count with spool_dir.
+	MaxValuesPerSecond uint `toml:"max_values_per_second"`
+	// Consecutive failed sends opening the circuit, 0 to disable. While
+	// open, for circuit_breaker_cooldown seconds, records are buffered
+	// without connecting to the servers, then a single send probes them.
+	CircuitBreakerThreshold uint            `toml:"circuit_breaker_threshold"`
+	CircuitBreakerCooldown  DurationSeconds `toml:"circuit_breaker_cooldown"`
+	// Failed sends after which the batch at the head of the buffer is
+	// dropped, and dead-lettered with inject_failed. 0 to retry until the
+	// buffer limits drop it.
+	MaxSendRetries uint `toml:"max_send_retries"`
+	// Failed batches retried per minute at most, over all batches. Beyond
+	// it the failed batch goes to the spool_dir spool, or is dropped and
+	// dead-lettered with inject_failed, so a flapping server doesn't hold
+	// back fresh data. 0 for no limit.
+	MaxRetriesPerMinute uint `toml:"max_retries_per_minute"`
+	// Seconds the keys of unsupported items, from the api key lists, and
+	// the keys the server rejected values of, over the api or as a proxy,
+	// are suppressed for. 0 to keep sending them.
+	UnsupportedTtl DurationSeconds `toml:"unsupported_ttl"`
+	// Times a batch entirely failed by the server is sent again, 0 to drop
+	// it. Partially failed batches are never sent again.
+	RequeueFailed uint `toml:"requeue_failed"`
+	// Keys matching any of these regexps bypass batching and are sent
+	// right away, e.g. heartbeats and items driving triggers
+	PriorityKeys []string `toml:"priority_keys"`
+	// Messages with this severity or a more severe one are sent right away,
+	// -1 to disable
+	PrioritySeverity int32 `toml:"priority_severity"`
 	// Override hostname
 	OverrideHostname string `toml:"override_hostname"`
 	// Clean up key seen beyond that time
-	KeySeenWindow uint `toml:"key_seen_window"`
+	KeySeenWindow DurationSeconds `toml:"key_seen_window"`
+	// Time between the key seen cleanups, 0 for key_seen_window. Each one
+	// goes over the hosts in chunks, a few thousand keys at a time.
+	KeySeenCleanupInterval DurationSeconds `toml:"key_seen_cleanup_interval"`
+	// File key seen is saved to every key_seen_save_interval and on
+	// shutdown, and loaded from at startup, so what's built on it carries
+	// on over restarts
+	KeySeenFile         string          `toml:"key_seen_file"`
+	KeySeenSaveInterval DurationSeconds `toml:"key_seen_save_interval"`
+	// Inject a zabbix.nodata message per host listing its keys in key seen
+	// not seen for that long, checked every nodata_check_interval, and a
+	// zabbix.nodata.ok message when one comes again. Must be below
+	// key_seen_window, 0 to disable.
+	NodataAfter         DurationSeconds `toml:"nodata_after"`
+	NodataCheckInterval DurationSeconds `toml:"nodata_check_interval"`
+	// Interval in ms between sends of the buffered records, independent of
+	// ticker_interval, 0 to only flush on the ticker
+	FlushInterval DurationMillis `toml:"flush_interval"`
+	// Maximum time in ms a batch waits after its first item before being sent
+	MaxBatchLatency DurationMillis `toml:"max_batch_latency_ms"`
+	// Re-inject the records that won't be sent, dropped from the buffer or
+	// failed by the server, as zabbix.failed messages carrying the record
+	// as payload and an error field. The message matcher must not let
+	// them back in.
+	InjectFailed bool `toml:"inject_failed"`
+	// Consecutive failed sends after which a zabbix.output.down message is
+	// injected, with server, error, failures, since and buffered fields,
+	// for other outputs to alert on. A zabbix.output.up message follows
+	// once a send succeeds. 0 to disable.
+	DownAlertFailures uint `toml:"down_alert_failures"`
+	// Re-inject metrics discarded by the active check filter, tagged with
+	// zabbix_filtered=true and zabbix_filtered_reason
+	InjectDiscarded bool `toml:"inject_discarded"`
+	// Inject a zabbix.checks.diff message when the key list of a host
+	// changed, with its added and removed keys in a JSON payload and their
+	// counts as fields
+	InjectChecksDiff bool `toml:"inject_checks_diff"`
+	// Where the per host key list comes from: "active" checks or "api" item.get
+	ChecksSource string `toml:"checks_source"`
+	// Zabbix API access, used when checks_source is "api"
+	Api ZabbixApiConfig `toml:"api"`
+	// Resolve user macros in the keys fetched from the api
+	ResolveMacros bool `toml:"resolve_macros"`
+	// Seconds between each refresh of the item metadata cache from the api
+	ItemMetadataInterval DurationSeconds `toml:"item_metadata_interval"`
+	// Local time windows during which the key lists aren't refreshed and
+	// the cached ones are used, "02:00-03:30" or "sun 04:00-06:00"
+	ChecksQuietPeriods []string `toml:"checks_quiet_periods"`
+	// Maximum seconds between fetch attempts for a host failing repeatedly
+	ChecksBackoffMax DurationSeconds `toml:"checks_backoff_max"`
+	// Seconds between heartbeat values sent for every known host, so
+	// nodata triggers on heartbeat_key tell a stopped pipeline apart
+	// from a host without metrics. 0 to disable.
+	HeartbeatInterval DurationSeconds `toml:"heartbeat_interval"`
+	HeartbeatKey      string          `toml:"heartbeat_key"`
+	// Seconds between the low-level discovery values sent to lld_key of
+	// every host in key_seen, listing its keys seen within key_seen_window
+	// as {"data":[{"{#KEY}":"..."}]} so discovery rules can create their
+	// items. 0 to disable.
+	LldInterval DurationSeconds `toml:"lld_interval"`
+	LldKey      string          `toml:"lld_key"`
+	// Macro the keys are given as
+	LldMacro string `toml:"lld_macro"`
+	// Also give the key name and its parameters, without the brackets, as
+	// {#KEY.NAME} and {#KEY.PARAMS} for lld_macro {#KEY}, so the item
+	// prototypes can be built from them
+	LldSplitKey bool `toml:"lld_split_key"`
+	// Only list the keys not in the key list of their host, the items the
+	// discovery rules are left to create
+	LldUnknownOnly bool `toml:"lld_unknown_only"`
+	// Host metadata of the auto-registration requests sent for hosts the
+	// server doesn't know, with checks_source = "active". Empty to disable.
+	HostMetadata string `toml:"host_metadata"`
+	// Seconds between refreshes from the api of the hosts in maintenance,
+	// 0 to disable. Their metrics are sent anyway with "send", dropped
+	// with "drop" or held with "buffer" until the maintenance is over, up
+	// to max_key_count per host.
+	MaintenanceInterval DurationSeconds `toml:"maintenance_interval"`
+	MaintenancePolicy   string          `toml:"maintenance_policy"`
+	// Create unknown hosts through the Zabbix API
+	CreateHosts bool `toml:"create_hosts"`
+	// Host groups and templates of the created hosts
+	CreateHostGroups    []string `toml:"create_host_groups"`
+	CreateHostTemplates []string `toml:"create_host_templates"`
+	// Optional agent interface of the created hosts
+	CreateHostInterface ZabbixHostInterface `toml:"create_host_interface"`
+	// Create items through the Zabbix API for the keys rejected by the
+	// active check filter on hosts the server knows. Agent data requests
+	// get active agent items polled every create_item_delay seconds,
+	// sender data and the api mode trapper items.
+	CreateItems bool `toml:"create_items"`
+	// Template the items are created on instead of the hosts, it must be
+	// linked to them
+	CreateItemTemplate string `toml:"create_item_template"`
+	// Application of the created items, Zabbix before 5.4
+	CreateItemApplication string `toml:"create_item_application"`
+	// Value type of the created items: float, character, log, unsigned or
+	// text. Empty for float when the first value is numeric, text otherwise.
+	CreateItemValueType string `toml:"create_item_value_type"`
+	CreateItemDelay     string `toml:"create_item_delay"`
 }
 
 func (zo *ZabbixOutput) ConfigStruct() interface{} {
 	return &ZabbixOutputConfig{
 		Encoder:                  "ZabbixEncoder",
+		Mode:                     "trapper",
+		RequestType:              "agent data",
+		ProxyVersion:             "6.0.0",
+		HeartbeatKey:             "heka.heartbeat",
+		LldKey:                   "heka.discovery",
+		LldMacro:                 "{#KEY}",
+		MaintenancePolicy:        "send",
+		Drop:                     "oldest",
+		SpoolMaxBytes:            int64(1024 * 1024 * 1024),
+		SpoolCompression:         "snappy",
+		CircuitBreakerCooldown:   DurationSeconds(60 * time.Second),
+		FailoverMode:             "ordered",
+		FailoverProbeInterval:    DurationSeconds(60 * time.Second),
 		TickerInterval:           uint(15),
-		ZabbixChecksPollInterval: uint(300),
-		ReceiveTimeout:           uint(3),
-		SendTimeout:              uint(1),
+		ZabbixChecksPollInterval: DurationSeconds(300 * time.Second),
+		WarmupTimeout:            DurationSeconds(30 * time.Second),
+		ReceiveTimeout:           DurationMillis(3000 * time.Millisecond),
+		SendTimeout:              DurationMillis(1000 * time.Millisecond),
+		ConnectTimeout:           DurationMillis(3000 * time.Millisecond),
+		ShutdownTimeout:          DurationMillis(5000 * time.Millisecond),
 		SendKeyCount:             uint(1000),
 		MaxKeyCount:              uint(2000),
-		KeySeenWindow:            uint(0),
+		KeySeenWindow:            DurationSeconds(0 * time.Second),
+		KeySeenCleanupInterval:   DurationSeconds(60 * time.Second),
+		KeySeenSaveInterval:      DurationSeconds(300 * time.Second),
+		NodataCheckInterval:      DurationSeconds(60 * time.Second),
+		MaxBatchLatency:          DurationMillis(0 * time.Millisecond),
+		ChecksSource:             "active",
+		KeyMatch:                 "exact",
+		ItemDelay:                "off",
+		UnknownHostPolicy:        "discard",
+		NewHostFetchInterval:     DurationSeconds(60 * time.Second),
+		ChecksFetchWorkers:       uint(4),
+		ChecksBackoffMax:         DurationSeconds(3600 * time.Second),
+		PrioritySeverity:         int32(-1),
+		RetryInitialInterval:     DurationMillis(1000 * time.Millisecond),
+		RetryMaxInterval:         DurationMillis(60000 * time.Millisecond),
+		RetryMultiplier:          float64(2),
+		RetryJitter:              float64(0.2),
+		ConnectionIdleTimeout:    DurationSeconds(60 * time.Second),
+		TcpKeepalive:             DurationSeconds(30 * time.Second),
+		TcpNoDelay:               true,
+		CompressMinBytes:         uint(1024),
+		Api: ZabbixApiConfig{
+			Timeout: DurationSeconds(10 * time.Second),
+		},
+		CreateHostInterface: ZabbixHostInterface{
+			Port: "10050",
+		},
+		CreateItemDelay: "60",
 	}
 }
 
 func (zo *ZabbixOutput) Init(config interface{}) (err error) {
 	zo.conf = config.(*ZabbixOutputConfig)
 
-	zo.zabbix_client, err = active_zabbix.NewZabbixActiveClient(zo.conf.Address, zo.conf.ReceiveTimeout, zo.conf.SendTimeout)
+	if zo.send_retry, err = newRetryPolicy(time.Duration(zo.conf.RetryInitialInterval),
+		zo.conf.RetryMultiplier, time.Duration(zo.conf.RetryMaxInterval), zo.conf.RetryJitter); err != nil {
+		return
+	}
+
+	var (
+		chaos *zabbixChaos
+		tls   *zabbixTLS
+		proxy *zabbixProxy
+	)
+	if chaos, err = newZabbixChaos(zo.conf.Chaos); err != nil {
+		return
+	}
+	if proxy, err = newZabbixProxy(zo.conf.ProxyType, zo.conf.ProxyAddress, zo.conf.ProxyUser,
+		zo.conf.ProxyPassword); err != nil {
+		return
+	}
+	if tls, err = newZabbixTLS(zabbixTLSOptions{
+		connect:       zo.conf.TlsConnect,
+		pskIdentity:   zo.conf.TlsPskIdentity,
+		pskFile:       zo.conf.TlsPskFile,
+		caFile:        zo.conf.TlsCaFile,
+		certFile:      zo.conf.TlsCertFile,
+		keyFile:       zo.conf.TlsKeyFile,
+		serverIssuer:  zo.conf.TlsServerCertIssuer,
+		serverSubject: zo.conf.TlsServerCertSubject,
+	}); err != nil {
+		return
+	}
+	var source *net.TCPAddr
+	if zo.conf.SourceAddress != "" {
+		ip := net.ParseIP(zo.conf.SourceAddress)
+		if ip == nil {
+			return fmt.Errorf("Invalid source_address: %s", zo.conf.SourceAddress)
+		}
+		source = &net.TCPAddr{IP: ip}
+	}
+	newClient := func(address string) (zc *zabbixClient, err error) {
+		if zc, err = newZabbixClient(address, zo.timeouts(address)); err != nil {
+			return
+		}
+		zc.tls = tls
+		zc.proxy = proxy
+		zc.source = source
+		zc.compress = zo.conf.Compression
+		zc.compressMin = int(zo.conf.CompressMinBytes)
+		zc.compressRetry = time.Duration(zo.conf.FailoverProbeInterval)
+		zc.persistent = zo.conf.PersistentConnections
+		if int(zo.conf.SendWorkers) > zc.maxIdle {
+			zc.maxIdle = int(zo.conf.SendWorkers)
+		}
+		zc.idleTimeout = time.Duration(zo.conf.ConnectionIdleTimeout)
+		zc.keepalive = time.Duration(zo.conf.TcpKeepalive)
+		zc.noDelay = zo.conf.TcpNoDelay
+		zc.readBuffer = int(zo.conf.TcpReadBuffer)
+		zc.writeBuffer = int(zo.conf.TcpWriteBuffer)
+		return
+	}
+	switch zo.conf.MaintenancePolicy {
+	case "send", "drop", "buffer":
+	default:
+		return fmt.Errorf("Invalid maintenance_policy: %s, only 'send', 'drop' or 'buffer' allowed.", zo.conf.MaintenancePolicy)
+	}
+	zo.held_records = make(map[string][][]byte)
+	if zo.conf.Drop != "oldest" && zo.conf.Drop != "newest" {
+		return fmt.Errorf("Invalid drop: %s, only 'oldest' or 'newest' allowed.", zo.conf.Drop)
+	}
+	if zo.conf.RequestType != "agent data" && zo.conf.RequestType != "sender data" {
+		return fmt.Errorf("Invalid request_type: %s, only 'agent data' or 'sender data' allowed.", zo.conf.RequestType)
+	}
+	zo.server_client = func(address string) (zc *zabbixClient, err error) {
+		if zc, err = newClient(address); err == nil {
+			zc.chaos = chaos
+			zc.bytes = &zo.server_bytes
+		}
+		return
+	}
+	switch zo.conf.Mode {
+	case "trapper", "proxy":
+		var clients []*zabbixClient
+		for _, address := range parseServerList(zo.conf.Address) {
+			var zc *zabbixClient
+			if zc, err = zo.server_client(address); err != nil {
+				return
+			}
+			clients = append(clients, zc)
+		}
+		if zo.servers, err = newZabbixFailover(clients, zo.conf.FailoverMode,
+			time.Duration(zo.conf.FailoverProbeInterval)); err != nil {
+			return
+		}
+	case "api":
+	default:
+		return fmt.Errorf("Invalid mode: %s, only 'trapper', 'proxy' or 'api' allowed.", zo.conf.Mode)
+	}
+	if zo.conf.Mode != "trapper" && zo.conf.ChecksSource != "api" && zo.conf.ZabbixChecksPollInterval != 0 {
+		return fmt.Errorf("mode = \"%s\" requires checks_source = \"api\"", zo.conf.Mode)
+	}
+	if zo.conf.ValueIds {
+		switch {
+		case zo.conf.Mode == "api" || zo.conf.RequestType != "agent data":
+			return fmt.Errorf("value_ids requires agent data requests in trapper or proxy mode")
+		case len(zo.conf.PriorityKeys) > 0 || zo.conf.PrioritySeverity >= 0 || zo.conf.SpoolDir != "" ||
+			zo.conf.SendWorkers > 1:
+			return fmt.Errorf("value_ids can't be combined with priority_keys, priority_severity, spool_dir or send_workers")
+		case zo.conf.MaintenancePolicy == "buffer":
+			// Held records would come back with lower ids than the ones sent meanwhile
+			return fmt.Errorf("value_ids can't be combined with maintenance_policy = \"buffer\"")
+		}
+		if zo.value_ids, err = newValueIds(zo.conf.ValueIdsFile); err != nil {
+			return
+		}
+	}
+	if zo.conf.Mode == "proxy" {
+		if zo.conf.ProxyName == "" {
+			return fmt.Errorf("proxy_name must be set when mode = \"proxy\"")
+		}
+		zo.proxy_data = newZabbixProxyData(zo.conf.ProxyName, zo.conf.ProxyVersion)
+		zo.item_failures = &itemIdsFailures{until: make(map[string]time.Time)}
+		if zo.value_ids != nil {
+			// The values carry their ids already
+			zo.proxy_data.session = zo.value_ids.session
+		}
+	}
+	if zo.conf.DryRun {
+		if zo.dry_run, err = newDryRunLog(zo.conf.DryRunFile); err != nil {
+			return
+		}
+	}
+	mirrorAddresses := zo.conf.MirrorAddresses
+	if zo.dry_run != nil {
+		mirrorAddresses = nil
+	}
+	for _, address := range mirrorAddresses {
+		var zc *zabbixClient
+		if zc, err = newClient(address); err != nil {
+			return
+		}
+		zo.mirrors = append(zo.mirrors, newZabbixMirror(zc, zo.send_retry, int(zo.conf.SendKeyCount),
+			int(zo.conf.MaxBatchBytes), int(zo.conf.MaxKeyCount),
+			zo.flushInterval(), zo.assembleBatch))
+	}
 	zo.report_chan = make(chan chan reportMsg, 1)
+	zo.history = newPayloadHistory(zo.conf.PayloadHistory)
+	zo.host_stats = newHostStats(zo.conf.HostStats)
+	zo.discard_stats = newDiscardStats(zo.conf.DiscardStats)
+	if zo.conf.DiscardStatsInterval != 0 && zo.discard_stats == nil {
+		return fmt.Errorf("discard_stats_interval requires discard_stats")
+	}
+	if zo.discarded_keys, err = newDiscardedKeys(zo.conf.DiscardedKeysFile, zo.conf.DiscardedKeysMaxBytes,
+		zo.conf.DiscardedKeysInterval != 0); err != nil {
+		return
+	}
 	zo.key_filter = make(map[string]active_zabbix.HostActiveKeys)
+	zo.key_matches = make(map[string]map[string]bool)
+	zo.filter_overrides = make(map[string]map[string]bool)
+	if zo.conf.NewHostFetchInterval != 0 {
+		zo.host_fetches = make(map[string]time.Time)
+		zo.fetch_slots = make(chan struct{}, maxNewHostFetches)
+		zo.checks_fetched = make(chan checksFetch, maxNewHostFetches)
+	}
+	switch zo.conf.KeyMatch {
+	case "exact", "prefix", "glob":
+	default:
+		return fmt.Errorf("Invalid key_match: %s, only 'exact', 'prefix' or 'glob' allowed.", zo.conf.KeyMatch)
+	}
+	switch zo.conf.UnknownHostPolicy {
+	case "discard", "pass", "buffer":
+	default:
+		return fmt.Errorf("Invalid unknown_host_policy: %s, only 'discard', 'pass' or 'buffer' allowed.", zo.conf.UnknownHostPolicy)
+	}
+	switch zo.conf.ItemDelay {
+	case "off":
+	case "drop", "average":
+		zo.item_delays = make(map[string]map[string]*itemDelayWindow)
+	default:
+		return fmt.Errorf("Invalid item_delay: %s, only 'off', 'drop' or 'average' allowed.", zo.conf.ItemDelay)
+	}
+	zo.checks_failures = make(map[string]*checksFailure)
+	zo.checks_times = make(map[string]time.Time)
+	if zo.conf.HostIdleTtl != 0 {
+		zo.host_last_seen = make(map[string]time.Time)
+	}
+	zo.heartbeat_hosts = make(map[string]bool)
+	zo.negative = newNegativeCache(time.Duration(zo.conf.UnsupportedTtl))
+	zo.unsupported = make(map[string]map[string]bool)
+	if zo.conf.SpoolDir != "" {
+		var key []byte
+		if zo.conf.SpoolKeyFile != "" {
+			if key, err = loadSpoolKey(zo.conf.SpoolKeyFile); err != nil {
+				return
+			}
+		}
+		if zo.spool, err = newDiskSpool(zo.conf.SpoolDir, zo.conf.SpoolCompression,
+			zo.conf.SpoolMaxBytes, key); err != nil {
+			return fmt.Errorf("Unable to open spool %s: %s", zo.conf.SpoolDir, err)
+		}
+		zo.spoolUpdated()
+	}
+	if zo.conf.SpoolDir != "" && zo.conf.MaxValuesPerSecond != 0 && zo.conf.MaxValuesPerSecond < zo.conf.SendKeyCount {
+		return fmt.Errorf("max_values_per_second must be >= send_key_count with spool_dir, spool segments are sent whole")
+	}
+	zo.limiter = newTokenBucket(zo.conf.MaxValuesPerSecond)
+	zo.retry_budget = newMinuteBucket(zo.conf.MaxRetriesPerMinute)
+	zo.down_alert = newDownAlert(zo.conf.DownAlertFailures)
+	zo.breaker = newCircuitBreaker(zo.conf.CircuitBreakerThreshold,
+		time.Duration(zo.conf.CircuitBreakerCooldown))
+	if zo.conf.UseBuffering && (zo.conf.SendQueueSize != 0 || zo.conf.SpoolDir != "") {
+		return fmt.Errorf("use_buffering replaces send_queue_size and spool_dir, they can't be combined")
+	}
+	if zo.conf.BlockOnFull && (zo.conf.SendQueueSize != 0 || zo.conf.SpoolDir != "" || zo.conf.UseBuffering) {
+		return fmt.Errorf("block_on_full can't be combined with send_queue_size, spool_dir or use_buffering")
+	}
+	if zo.conf.SendQueueSize != 0 {
+		zo.send_queue = make(chan [][]byte, zo.conf.SendQueueSize)
+		zo.priority_queue = make(chan []byte, zo.conf.SendKeyCount)
+	}
 
-	zo.key_seen_window = time.Duration(zo.conf.KeySeenWindow) * time.Second
+	zo.key_seen_window = time.Duration(zo.conf.KeySeenWindow)
 	zo.key_seen = make(map[string]HostSeenKeys)
+	if zo.conf.KeySeenFile != "" {
+		if zo.conf.KeySeenWindow == 0 || zo.conf.KeySeenSaveInterval == 0 {
+			return fmt.Errorf("key_seen_file requires key_seen_window and key_seen_save_interval")
+		}
+		if err = zo.loadKeySeen(time.Now()); err != nil {
+			return
+		}
+	}
 	if zo.conf.OverrideHostname != "" {
 		zo.key_filter[zo.conf.OverrideHostname] = nil
 	} else {
@@ -85,227 +901,2419 @@ func (zo *ZabbixOutput) Init(config interface{}) (err error) {
 		host, err = os.Hostname()
 		zo.key_filter[host] = nil
 	}
+	if zo.conf.ChecksCacheFile != "" && zo.conf.ZabbixChecksPollInterval != 0 {
+		if _, err = zo.loadChecksCache(time.Now()); err != nil {
+			return
+		}
+	}
+
+	zo.send_key_count = uint32(zo.conf.SendKeyCount)
+	zo.checks_interval = int64(zo.conf.ZabbixChecksPollInterval)
 
 	// A bit of config validation
 	if zo.conf.MaxKeyCount < zo.conf.SendKeyCount || zo.conf.SendKeyCount < 1 {
-		err = fmt.Errorf("Invalid combinason of send_key_count and max_key_count: %d must be <= %d", zo.conf.SendKeyCount, zo.conf.MaxKeyCount)
+		return fmt.Errorf("Invalid combinason of send_key_count and max_key_count: %d must be <= %d", zo.conf.SendKeyCount, zo.conf.MaxKeyCount)
+	}
+
+	if zo.conf.ChecksSource != "active" && zo.conf.ChecksSource != "api" {
+		err = fmt.Errorf("Invalid checks_source: %s, only 'active' or 'api' allowed.", zo.conf.ChecksSource)
+		return
+	}
+	if zo.conf.Mode != "trapper" || zo.conf.ChecksSource == "api" || zo.conf.CreateHosts || zo.conf.CreateItems ||
+		zo.conf.ItemMetadataInterval != 0 || zo.conf.MaintenanceInterval != 0 {
+		if zo.api_client, err = NewZabbixApiClient(zo.conf.Api); err != nil {
+			return
+		}
+	}
+	if zo.quiet_periods, err = parseQuietPeriods(zo.conf.ChecksQuietPeriods); err != nil {
+		return
+	}
+	if zo.conf.ZabbixChecksPollInterval != 0 {
+		if zo.conf.ChecksFetchWorkers < 1 {
+			return fmt.Errorf("checks_fetch_workers must be at least 1")
+		}
+		if zo.conf.ZabbixChecksPollJitter > 100 {
+			return fmt.Errorf("Invalid zabbix_checks_poll_jitter %d, must be between 0 and 100", zo.conf.ZabbixChecksPollJitter)
+		}
+		if zo.conf.ChecksRefreshMin != 0 || zo.conf.ChecksRefreshMax != 0 {
+			min, max := time.Duration(zo.conf.ChecksRefreshMin), time.Duration(zo.conf.ChecksRefreshMax)
+			if min <= time.Duration(zo.conf.ReceiveTimeout) || max < min {
+				return fmt.Errorf("Invalid checks_refresh_min and checks_refresh_max: %s must > receive_timeout and <= %s", min, max)
+			}
+			zo.checks_next = make(map[string]time.Time)
+		}
+		interval := time.Duration(zo.conf.ZabbixChecksPollInterval)
+		maxBackoff := time.Duration(zo.conf.ChecksBackoffMax)
+		if maxBackoff < interval {
+			maxBackoff = interval
+		}
+		if zo.checks_retry, err = newRetryPolicy(interval, zo.conf.RetryMultiplier, maxBackoff, zo.conf.RetryJitter); err != nil {
+			return
+		}
+	}
+	if zo.priority_keys, err = compileRegexps("priority_keys", zo.conf.PriorityKeys); err != nil {
+		return
+	}
+	if zo.key_allow, err = compileRegexps("key_allow", zo.conf.KeyAllow); err != nil {
+		return
+	}
+	if zo.key_deny, err = compileRegexps("key_deny", zo.conf.KeyDeny); err != nil {
+		return
+	}
+	if zo.conf.LldInterval != 0 && (zo.conf.KeySeenWindow == 0 || zo.conf.ZabbixChecksPollInterval == 0) {
+		return fmt.Errorf("lld_interval requires key_seen_window and zabbix_checks_poll_interval")
+	}
+	if zo.conf.LldSplitKey && !(strings.HasPrefix(zo.conf.LldMacro, "{#") && strings.HasSuffix(zo.conf.LldMacro, "}")) {
+		return fmt.Errorf("Invalid lld_macro: %s, lld_split_key needs a {#MACRO}", zo.conf.LldMacro)
+	}
+	if zo.conf.NodataAfter != 0 {
+		switch {
+		case zo.conf.ZabbixChecksPollInterval == 0 || zo.conf.NodataCheckInterval == 0:
+			return fmt.Errorf("nodata_after requires zabbix_checks_poll_interval and nodata_check_interval")
+		case zo.conf.NodataAfter >= zo.conf.KeySeenWindow:
+			return fmt.Errorf("nodata_after must be below key_seen_window")
+		}
+		zo.nodata_reported = make(map[string]map[string]time.Time)
+	}
+	if zo.conf.ResolveMacros && zo.conf.ChecksSource != "api" {
+		return fmt.Errorf("resolve_macros requires checks_source = \"api\"")
+	}
+	if zo.conf.CreateHosts {
+		if len(zo.conf.CreateHostGroups) == 0 {
+			return fmt.Errorf("create_host_groups must be set when create_hosts is enabled")
+		}
+		zo.hosts_created = make(map[string]bool)
+		if zo.dry_run == nil {
+			zo.host_create = make(chan string, 100)
+			zo.hosts_failed = make(chan string, 100)
+		}
+	}
+	if zo.conf.CreateItems {
+		if zo.item_value_type, err = parseValueType(zo.conf.CreateItemValueType); err != nil {
+			return
+		}
+		zo.items_requested = make(map[string]bool)
+		if zo.dry_run == nil {
+			zo.item_create = make(chan itemCreateRequest, 100)
+			zo.items_failed = make(chan string, 100)
+		}
 	}
 
-	if zo.conf.ZabbixChecksPollInterval != 0 && zo.conf.ZabbixChecksPollInterval <= zo.conf.ReceiveTimeout/1000 {
-		err = fmt.Errorf("Invalid combinason of zabbix_checks_poll_interval and receive_timeout: %d must > %d", zo.conf.SendKeyCount, zo.conf.MaxKeyCount)
+	poll, receive := time.Duration(zo.conf.ZabbixChecksPollInterval), time.Duration(zo.conf.ReceiveTimeout)
+	if poll != 0 && poll <= receive {
+		return fmt.Errorf("Invalid combinason of zabbix_checks_poll_interval and receive_timeout: %s must > %s", poll, receive)
 	}
 
 	return
 }
 
-func (zo *ZabbixOutput) SendRecords(records [][]byte) (data_left [][]byte, err error) {
-	//FIXME: Proper json encoding
-	msgHeader := []byte("{\"request\":\"agent data\",\"data\":[")
-	msgHeaderLength := len(msgHeader)
+// Timeouts for a server address, with its overrides applied.
+func (zo *ZabbixOutput) timeouts(address string) zabbixTimeouts {
+	t := zabbixTimeouts{
+		connect: time.Duration(zo.conf.ConnectTimeout),
+		checks:  time.Duration(zo.conf.ChecksTimeout),
+		data:    time.Duration(zo.conf.DataTimeout),
+		send:    time.Duration(zo.conf.SendTimeout),
+		receive: time.Duration(zo.conf.ReceiveTimeout),
+	}
+	if o, found := zo.conf.TargetTimeouts[address]; found {
+		t = t.override(o)
+	}
+	return t
+}
 
-	msgClose := []byte("]}")
-	msgCloseLength := len(msgClose)
+// Interval between flushes of partial batches.
+func (zo *ZabbixOutput) flushInterval() time.Duration {
+	if zo.conf.FlushInterval != 0 {
+		return time.Duration(zo.conf.FlushInterval)
+	}
+	return time.Duration(zo.conf.TickerInterval) * time.Second
+}
 
-	data_left = records
+// Number of records going in the next batch.
+func (zo *ZabbixOutput) batchLength(records [][]byte) int {
+	return batchLength(records, zo.sendKeyCount(), int(zo.conf.MaxBatchBytes))
+}
 
-	for len(data_left) > 0 {
-		length := 0
-		if len(data_left) >= int(zo.conf.SendKeyCount) {
-			length = int(zo.conf.SendKeyCount)
-		} else {
-			length = len(data_left)
+// Room left for the request around the records
+const zabbixBatchOverhead = 64
+
+// Number of records fitting in maxCount and, when not zero, maxBytes. A
+// record larger than maxBytes still goes in a batch of its own.
+func batchLength(records [][]byte, maxCount int, maxBytes int) int {
+	length := len(records)
+	if length > maxCount {
+		length = maxCount
+	}
+	if maxBytes == 0 {
+		return length
+	}
+
+	size := zabbixBatchOverhead
+	for i, record := range records[:length] {
+		if size += len(record) + 1; size > maxBytes && i > 0 {
+			return i
 		}
+	}
+	return length
+}
 
-		joinedRecords := bytes.Join(data_left[:length], []byte(","))
-		msgArray := make([]byte, msgHeaderLength+length+msgCloseLength)
+type zabbixDataBatch struct {
+	Request string            `json:"request"`
+	Session string            `json:"session,omitempty"`
+	Data    []json.RawMessage `json:"data"`
+}
 
-		msgSlice := msgArray[0:0]
-		msgSlice = append(msgSlice, msgHeader...)
-		msgSlice = append(msgSlice, joinedRecords...)
-		msgSlice = append(msgSlice, msgClose...)
+// Wraps encoded records in a data request. Records are checked when
+// accepted, any invalid one left is dropped rather than corrupting the
+// whole request.
+func (zo *ZabbixOutput) assembleBatch(records [][]byte) []byte {
+	batch := zabbixDataBatch{Request: zo.conf.RequestType, Data: make([]json.RawMessage, len(records))}
+	if zo.value_ids != nil {
+		batch.Session = zo.value_ids.session
+	}
+	for i, record := range records {
+		batch.Data[i] = record
+	}
 
-		if err = zo.zabbix_client.ZabbixSendAndForget(msgSlice); err != nil {
-			return data_left, err
+	// Can't fail, records are checked when encoded and when read back
+	// from the spool
+	payload, _ := json.Marshal(batch)
+	return payload
+}
+
+// Sends a batch, the server must confirm it. Safe to call concurrently.
+func (zo *ZabbixOutput) sendBatch(payload []byte) (res zabbixSendResult, err error) {
+	if zo.dry_run != nil {
+		var batch zabbixDataBatch
+		if err = json.Unmarshal(payload, &batch); err != nil {
+			return res, fmt.Errorf("Unable to decode batch: %s", err)
 		}
+		zo.dry_run.write(zo.runner, payload)
+		return zabbixSendResult{Processed: len(batch.Data), Total: len(batch.Data)}, nil
+	}
 
-		// Move down the slice
-		data_left = data_left[length:]
+	switch zo.conf.Mode {
+	case "api":
+		return zo.pushBatch(payload)
+	case "proxy":
+		return zo.sendProxyData(payload)
+	}
+
+	var resp []byte
+	if resp, err = zo.trapperSend(payload); err != nil {
+		return
 	}
+	return parseSendResponse(resp)
+}
 
+// Sends a request to the servers, returning the raw response.
+func (zo *ZabbixOutput) trapperSend(payload []byte) (resp []byte, err error) {
+	err = zo.servers.do(func(zc *zabbixClient) (err error) {
+		req := payload
+		if zo.conf.Mode == "trapper" {
+			// Proxy data requests carry their own clock
+			req = stampRequest(payload, time.Now())
+		}
+		resp, err = zc.Send(req)
+		zo.history.add(zc.address, req, resp, err)
+		return
+	})
 	return
 }
 
-func (zo *ZabbixOutput) Filter(pack *PipelinePack) (discard bool, err error) {
+// Sends an assembled batch as proxy data, the records of unknown items
+// count as failed.
+func (zo *ZabbixOutput) sendProxyData(payload []byte) (res zabbixSendResult, err error) {
 	var (
-		val   interface{}
-		key   string
-		host  string
-		ok    bool
-		found bool
+		req    []byte
+		values int
+		failed []zabbixFailedItem
 	)
+	if req, values, failed, err = zo.proxy_data.build(payload, zo.fetchItemIds, zo.itemId); err != nil {
+		return
+	}
+	if values > 0 {
+		var resp []byte
+		if resp, err = zo.trapperSend(req); err != nil {
+			return
+		}
+		if res, err = parseProxyDataResponse(resp, values); err != nil {
+			return
+		}
+	}
+	res.Failed += len(failed)
+	res.Total += len(failed)
+	for _, f := range failed {
+		res.Errors = append(res.Errors, fmt.Sprintf("%s:%s: %s", f.Host, f.Key, f.Error))
+	}
+	res.FailedItems = append(res.FailedItems, failed...)
+	return
+}
 
-	discard = true
+// Time before fetching again the items of a host whose fetch failed
+const itemIdsRetry = 60 * time.Second
 
-	if val, found = pack.Message.GetFieldValue("key"); !found {
-		err = fmt.Errorf("No Key in message")
-		pack.Recycle()
+// Hosts whose items couldn't be fetched for their ids, and until when they
+// aren't tried again so a down api doesn't hold every batch up. Batches
+// may be built from several sender goroutines.
+type itemIdsFailures struct {
+	lock  sync.Mutex
+	until map[string]time.Time
+}
+
+// Fetches the items of a host missing from the metadata cache, unless it
+// failed within itemIdsRetry.
+func (zo *ZabbixOutput) fetchItemIds(host string) {
+	if itemMetadata.known(host) {
 		return
 	}
-	if key, ok = val.(string); !ok {
-		err = fmt.Errorf("Unable to cast key to string")
-		pack.Recycle()
+	now := time.Now()
+	zo.item_failures.lock.Lock()
+	until := zo.item_failures.until[host]
+	zo.item_failures.lock.Unlock()
+	if now.Before(until) {
 		return
 	}
 
-	if val, found = pack.Message.GetFieldValue("host"); !found {
-		err = fmt.Errorf("No Host in message")
-		pack.Recycle()
+	items, err := zo.api_client.FetchItemMetadata(host)
+	zo.item_failures.lock.Lock()
+	defer zo.item_failures.lock.Unlock()
+	if err != nil {
+		zo.item_failures.until[host] = now.Add(itemIdsRetry)
 		return
 	}
-	if host, ok = val.(string); !ok {
-		err = fmt.Errorf("Unable to cast host to string")
-		pack.Recycle()
-		return
+	delete(zo.item_failures.until, host)
+	itemMetadata.update(host, items)
+}
+
+// Id of an item from the metadata cache.
+func (zo *ZabbixOutput) itemId(host string, key string) string {
+	md, _ := LookupItemMetadata(host, key)
+	return md.ItemId
+}
+
+// Record as written by ZabbixEncoder, the clock may be quoted
+type zabbixDataRecord struct {
+	Id          int64           `json:"id"`
+	Host        string          `json:"host"`
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value"`
+	Clock       json.Number     `json:"clock"`
+	Ns          json.Number     `json:"ns"`
+	LastLogSize *int64          `json:"lastlogsize"`
+	Mtime       *int64          `json:"mtime"`
+	Source      string          `json:"source"`
+	Severity    *int64          `json:"severity"`
+	EventId     *int64          `json:"eventid"`
+}
+
+type zabbixDataRequest struct {
+	Data []zabbixDataRecord `json:"data"`
+}
+
+// Sends an assembled batch through history.push.
+func (zo *ZabbixOutput) pushBatch(payload []byte) (res zabbixSendResult, err error) {
+	var req zabbixDataRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return res, fmt.Errorf("Unable to decode batch: %s", err)
 	}
 
-	// Populate key seen if enabled
-	if zo.conf.KeySeenWindow != 0 {
-		if hs, found := zo.key_seen[host]; !found || hs == nil {
-			zo.key_seen[host] = make(HostSeenKeys, 1)
-		}
-		zo.key_seen[host][key] = time.Now()
+	values := make([]ZabbixHistoryValue, len(req.Data))
+	for i, r := range req.Data {
+		values[i] = ZabbixHistoryValue{Host: r.Host, Key: r.Key, Value: r.Value}
+		values[i].Clock, _ = r.Clock.Int64()
+		values[i].Ns, _ = r.Ns.Int64()
 	}
+	res, err = zo.api_client.PushHistory(values)
+	zo.history.add(zo.conf.Api.Url, payload, nil, err)
+	return
+}
 
-	// Check against active check filter
-	if hc, found_host := zo.key_filter[host]; found_host && hc != nil {
-		if _, found_key := hc[key]; found_key {
-			discard = false
-		}
-	} else {
-		// We have no data on current host, we'll need to fetch it!
-		// Discard by default
-		zo.key_filter[host] = nil
+// Accounts the items processed and failed by the server. Returns an error
+// when it failed all of them and the batch must be sent again, partial
+// failures aren't retried since the response doesn't tell which items
+// failed and the processed ones would be duplicated. Batches failed once
+// out of requeues are dead-lettered.
+func (zo *ZabbixOutput) checkSendResult(res zabbixSendResult, records [][]byte) error {
+	zo.stats_lock.Lock()
+	zo.stats.ItemsProcessed += int64(res.Processed)
+	zo.stats.ItemsFailed += int64(res.Failed)
+	zo.stats_lock.Unlock()
+	zo.item_errors = append(zo.item_errors, res.Errors...)
+	now := time.Now()
+	for _, f := range res.FailedItems {
+		zo.negative.add(f.Host, f.Key, f.Error, now)
 	}
 
-	return
+	if res.Failed > 0 && res.Processed == 0 && zo.requeues < zo.conf.RequeueFailed {
+		zo.requeues++
+		return fmt.Errorf("Zabbix server failed all %d items of the batch, retry %d of %d",
+			res.Failed, zo.requeues, zo.conf.RequeueFailed)
+	}
+	zo.requeues = 0
+	if res.Failed > 0 && res.Processed == 0 {
+		zo.deadLetter(records, fmt.Sprintf("Zabbix server failed all %d items of the batch", res.Failed))
+	}
+	return nil
 }
 
-func (zo *ZabbixOutput) SendMetrics(or OutputRunner, data [][]byte) (new_slice [][]byte, err error) {
-	new_slice = data
-	if new_slice, err = zo.SendRecords(data); err != nil {
-		// If we've hit the max key to send truncate the slice down starting with the oldest
-		if len(new_slice) > int(zo.conf.MaxKeyCount) {
-			copy(data, new_slice)
-			remove_tail := zo.conf.MaxKeyCount - zo.conf.SendKeyCount
-			or.LogError(fmt.Errorf("Truncated %d oldest metrics from in-memory buffer.", zo.conf.SendKeyCount))
-			new_slice = data[:remove_tail]
+func (zo *ZabbixOutput) SendRecords(records [][]byte) (data_left [][]byte, err error) {
+	if zo.conf.SendWorkers > 1 {
+		return zo.sendRecordsParallel(records)
+	}
+	if zo.conf.PipelinedSend {
+		return zo.sendRecordsPipelined(records)
+	}
+
+	data_left = records
+
+	for len(data_left) > 0 {
+		length := zo.batchLength(data_left)
+		var res zabbixSendResult
+		if res, err = zo.sendBatch(zo.assembleBatch(data_left[:length])); err == nil {
+			err = zo.checkSendResult(res, data_left[:length])
 		}
-		return
+		if err != nil {
+			return data_left, err
+		}
+
+		// Move down the slice
+		data_left = data_left[length:]
 	}
 
 	return
 }
 
-func (zo *ZabbixOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+type sendOutcome struct {
+	res zabbixSendResult
+	err error
+}
+
+// Same as SendRecords but the next batch is assembled while the previous
+// one is still in flight.
+func (zo *ZabbixOutput) sendRecordsPipelined(records [][]byte) (data_left [][]byte, err error) {
 	var (
-		ok     = true
-		pack   *PipelinePack
-		inChan = or.InChan()
-		ticker = or.Ticker()
+		done     chan sendOutcome
+		inFlight int
 	)
 
-	updateFilter := make(chan bool, 1)
-	go func() {
-		for zo.conf.ZabbixChecksPollInterval != 0 {
-			updateFilter <- true
-			time.Sleep(time.Duration(zo.conf.ZabbixChecksPollInterval) * time.Second)
-		}
-	}()
+	data_left = records
 
-	keySeenCleanup := make(chan bool, 1)
-	go func() {
-		for zo.conf.KeySeenWindow != 0 {
-			keySeenCleanup <- true
-			time.Sleep(time.Duration(zo.conf.KeySeenWindow) * time.Second)
+	for {
+		var payload []byte
+		length := zo.batchLength(data_left[inFlight:])
+		if length > 0 {
+			payload = zo.assembleBatch(data_left[inFlight : inFlight+length])
 		}
-	}()
 
-	dataArray := make([][]byte, zo.conf.MaxKeyCount)
-	dataSlice := dataArray[0:0]
-	for ok {
-		select {
-		case <-updateFilter:
-			if !ok {
-				break
+		if done != nil {
+			outcome := <-done
+			if err = outcome.err; err == nil {
+				err = zo.checkSendResult(outcome.res, data_left[:inFlight])
 			}
-
-			// FIXME: Move to seperate goroutine so it's non-blocking
-			for host, _ := range zo.key_filter {
-				if hc, localErr := zo.zabbix_client.FetchActiveChecks(host); localErr != nil {
-					// Keep previous list if the server can't refresh the list of checks
-					or.LogError(fmt.Errorf("Zabbix server unable to provide active check list for host %s: %s", host, localErr))
-				} else {
-					zo.key_filter[host] = hc
-				}
+			if err != nil {
+				return
 			}
+			// Move down the slice
+			data_left = data_left[inFlight:]
+		}
+		if payload == nil {
+			return
+		}
 
-		case pack, ok = <-inChan:
-			if !ok {
-				break
-			}
+		done = make(chan sendOutcome, 1)
+		inFlight = length
+		go func(payload []byte, done chan sendOutcome) {
+			res, err := zo.sendBatch(payload)
+			done <- sendOutcome{res, err}
+		}(payload, done)
+	}
+}
 
-			// Skip discard check if disable
-			if zo.conf.ZabbixChecksPollInterval != 0 {
-				if discard, err := zo.Filter(pack); err != nil {
-					or.LogError(err)
-					pack.Recycle()
-					continue
-				} else if discard {
-					pack.Recycle()
-					continue
-				}
-			}
+// Same as SendRecords but up to send_workers batches are sent at once, each
+// on its own connection. The records are reordered so the ones left to
+// send, from the failed batches, come last.
+func (zo *ZabbixOutput) sendRecordsParallel(records [][]byte) (data_left [][]byte, err error) {
+	var batches [][][]byte
+	for left := records; len(left) > 0; {
+		length := zo.batchLength(left)
+		batches = append(batches, left[:length])
+		left = left[length:]
+	}
 
-			if msg, localErr := or.Encode(pack); localErr != nil {
-				or.LogError(fmt.Errorf("Encoder failure: %s", localErr))
-				pack.Recycle()
-				continue
-			} else {
-				dataSlice = append(dataSlice, msg)
-			}
-			pack.Recycle()
+	var (
+		outcomes = make([]sendOutcome, len(batches))
+		workers  = make(chan bool, zo.conf.SendWorkers)
+		wg       sync.WaitGroup
+	)
+	for i, batch := range batches {
+		workers <- true
+		wg.Add(1)
+		go func(i int, payload []byte) {
+			defer wg.Done()
+			outcomes[i].res, outcomes[i].err = zo.sendBatch(payload)
+			<-workers
+		}(i, zo.assembleBatch(batch))
+	}
+	wg.Wait()
 
-			if len(dataSlice) >= int(zo.conf.SendKeyCount) {
-				if dataSlice, err = zo.SendMetrics(or, dataSlice); err != nil {
-					or.LogError(err)
-				}
-			}
+	var sent, failed [][]byte
+	for i, outcome := range outcomes {
+		if outcome.err == nil {
+			outcome.err = zo.checkSendResult(outcome.res, batches[i])
+		}
+		if outcome.err != nil {
+			err = outcome.err
+			failed = append(failed, batches[i]...)
+		} else {
+			sent = append(sent, batches[i]...)
+		}
+	}
+	copy(records, sent)
+	copy(records[len(sent):], failed)
+	return records[len(sent):], err
+}
 
-		case <-ticker:
+// Fetches the list of keys accepted for a host from the configured source.
+// The api also tells the items that are not supported, the servers may
+// tell when to refresh the list.
+func (zo *ZabbixOutput) fetchChecks(host string) (f checksFetch) {
+	f.host = host
+	if zo.conf.ChecksSource == "api" {
+		f.hc, f.unsupported, f.err = zo.api_client.FetchHostItems(host, zo.conf.ResolveMacros)
+		return
+	}
+	f.err = zo.servers.do(func(zc *zabbixClient) (err error) {
+		f.hc, f.refresh, err = zc.FetchActiveChecks(host)
+		return
+	})
+	return
+}
+
+// Refreshes the shared item metadata cache for the given hosts.
+func (zo *ZabbixOutput) refreshItemMetadata(or OutputRunner, hosts []string) {
+	for _, host := range hosts {
+		if items, err := zo.api_client.FetchItemMetadata(host); err != nil {
+			or.LogError(fmt.Errorf("Unable to fetch item metadata for host %s: %s", host, err))
+		} else {
+			itemMetadata.update(host, items)
+		}
+	}
+}
+
+// Consecutive key list fetch failures for a host
+type checksFailure struct {
+	streak int
+	next   time.Time
+}
+
+// Forgets the hosts without metrics for host_idle_ttl. Hosts that never
+// sent one, the local host or those loaded from checks_cache_file, get
+// host_idle_ttl from now.
+func (zo *ZabbixOutput) evictIdleHosts(or OutputRunner, now time.Time) {
+	if zo.host_last_seen == nil {
+		return
+	}
+	ttl := time.Duration(zo.conf.HostIdleTtl)
+	for host, _ := range zo.key_filter {
+		seen, found := zo.host_last_seen[host]
+		if !found {
+			zo.host_last_seen[host] = now
+			continue
+		}
+		if now.Sub(seen) < ttl {
+			continue
+		}
+
+		delete(zo.key_filter, host)
+		delete(zo.key_matches, host)
+		delete(zo.checks_failures, host)
+		delete(zo.checks_times, host)
+		delete(zo.checks_next, host)
+		delete(zo.host_last_seen, host)
+		delete(zo.hosts_created, host)
+		if zo.item_delays != nil {
+			delete(zo.item_delays, host)
+		}
+		if zo.host_fetches != nil {
+			delete(zo.host_fetches, host)
+		}
+		zo.stats.HostsEvicted++
+		or.LogMessage(fmt.Sprintf("Host %s evicted, no metric since %s", host, seen.Format(time.RFC3339)))
+	}
+}
+
+// Known hosts whose key list is due for a refresh. Hosts failing repeatedly
+// are retried less and less often, with a single probe once their backoff
+// expires.
+func (zo *ZabbixOutput) dueHosts(now time.Time) (hosts []string) {
+	for host, _ := range zo.key_filter {
+		cf := zo.checks_failures[host]
+		if cf != nil && now.Before(cf.next) || now.Before(zo.checks_next[host]) {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+// Whether a known host was left out of a round and its key list was never
+// fetched, when it was seen while the round was going on.
+func (zo *ZabbixOutput) unfetchedHost(fetches []checksFetch) bool {
+	fetched := make(map[string]bool, len(fetches))
+	for _, f := range fetches {
+		fetched[f.host] = true
+	}
+	for host, hc := range zo.key_filter {
+		if hc == nil && !fetched[host] && zo.checks_failures[host] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetches the key lists of hosts, up to checks_fetch_workers at once, and
+// hands all the outcomes to the Run loop once done.
+func (zo *ZabbixOutput) fetchRound(hosts []string, done chan<- []checksFetch) {
+	var (
+		fetches = make([]checksFetch, len(hosts))
+		workers = make(chan bool, zo.conf.ChecksFetchWorkers)
+		wg      sync.WaitGroup
+	)
+	for i, host := range hosts {
+		workers <- true
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			fetches[i] = zo.fetchChecks(host)
+			<-workers
+		}(i, host)
+	}
+	wg.Wait()
+	done <- fetches
+}
+
+// Takes the outcome of a key list fetch for a host.
+func (zo *ZabbixOutput) applyChecks(or OutputRunner, f checksFetch, now time.Time) {
+	host, err := f.host, f.err
+	if err != nil {
+		// Keep previous list if the server can't refresh the list of checks
+		or.LogError(fmt.Errorf("Zabbix server unable to provide active check list for host %s: %s", host, err))
+		zo.stats.ChecksErrors++
+
+		if _, notFound := err.(*zabbixHostNotFoundError); notFound && zo.conf.HostMetadata != "" && zo.dry_run == nil {
+			zo.registerHost(or, host)
+		}
+
+		cf := zo.checks_failures[host]
+		if cf == nil {
+			cf = &checksFailure{}
+			zo.checks_failures[host] = cf
+		}
+		cf.streak++
+		backoff := zo.checks_retry.delay(cf.streak)
+		// Leave some slack for the ticker so the probe lands on the right round
+		cf.next = now.Add(backoff - zo.roundInterval()/2)
+		return
+	}
+	zo.updateUnsupported(host, f.hc, f.unsupported, now)
+	zo.applyOverrides(host, f.hc)
+	if zo.conf.InjectChecksDiff {
+		zo.injectChecksDiff(or, host, zo.key_filter[host], f.hc)
+	}
+	zo.key_filter[host] = f.hc
+	delete(zo.key_matches, host)
+	delete(zo.checks_failures, host)
+	zo.checks_times[host] = now
+
+	if zo.checks_next != nil {
+		refresh := zo.checksInterval()
+		if f.refresh != 0 {
+			refresh = f.refresh
+			if min := time.Duration(zo.conf.ChecksRefreshMin); refresh < min {
+				refresh = min
+			}
+			if max := time.Duration(zo.conf.ChecksRefreshMax); refresh > max {
+				refresh = max
+			}
+		}
+		zo.checks_next[host] = now.Add(refresh - zo.roundInterval()/2)
+	}
+}
+
+// Interval between key list rounds: zabbix_checks_poll_interval, or
+// checks_refresh_min when shorter and the hosts are refreshed when the
+// servers ask.
+func (zo *ZabbixOutput) roundInterval() time.Duration {
+	interval := zo.checksInterval()
+	if min := time.Duration(zo.conf.ChecksRefreshMin); zo.checks_next != nil && min < interval {
+		return min
+	}
+	return interval
+}
+
+// Key list fetched for a host, on a round or on demand when seen for the
+// first time
+type checksFetch struct {
+	host        string
+	hc          active_zabbix.HostActiveKeys
+	unsupported []string
+	refresh     time.Duration
+	err         error
+}
+
+// Fetches the key list of a new host right away instead of on the next
+// round, at most once per new_host_fetch_interval for each host. The
+// outcome is taken by the Run loop.
+func (zo *ZabbixOutput) fetchNewHost(host string, now time.Time) {
+	if zo.checks_fetched == nil || now.Sub(zo.host_fetches[host]) < time.Duration(zo.conf.NewHostFetchInterval) {
+		return
+	}
+	if cf := zo.checks_failures[host]; cf != nil && now.Before(cf.next) {
+		return
+	}
+	if inQuietPeriod(zo.quiet_periods, now) {
+		return
+	}
+	select {
+	case zo.fetch_slots <- struct{}{}:
+	default:
+		// As many fetches going as results fit, retried on a later metric
+		return
+	}
+	zo.host_fetches[host] = now
+	go func() {
+		zo.checks_fetched <- zo.fetchChecks(host)
+	}()
+}
+
+// Sends an auto-registration request for a host the server doesn't know,
+// its key list is fetched again with the usual backoff.
+func (zo *ZabbixOutput) registerHost(or OutputRunner, host string) {
+	err := zo.servers.do(func(zc *zabbixClient) error {
+		return zc.Register(host, zo.conf.HostMetadata)
+	})
+	if err != nil {
+		or.LogError(fmt.Errorf("Unable to auto-register host %s: %s", host, err))
+		return
+	}
+	zo.stats.Registrations++
+	or.LogMessage(fmt.Sprintf("Auto-registration requested for host %s", host))
+}
+
+// Keys looked at per key seen cleanup chunk
+const keySeenCleanupChunk = 10000
+
+// Drops the keys not seen within key_seen_window from the first hosts,
+// about keySeenCleanupChunk keys worth of them, returns the hosts left.
+func (zo *ZabbixOutput) cleanupKeySeen(hosts []string, now time.Time) []string {
+	checked := 0
+	for len(hosts) > 0 && checked < keySeenCleanupChunk {
+		host := hosts[0]
+		hosts = hosts[1:]
+
+		hs := zo.key_seen[host]
+		checked += len(hs) + 1
+		for key, t := range hs {
+			if now.After(t.Add(zo.key_seen_window)) {
+				delete(hs, key)
+			}
+		}
+		if hs != nil && len(hs) == 0 {
+			delete(zo.key_seen, host)
+		}
+	}
+	return hosts
+}
+
+// Reasons given for discarded metrics
+const (
+	discardUnknownHost = "unknown host"
+	discardUnknownKey  = "key not in active checks"
+	discardSuppressed  = "item rejected by the server"
+	discardDeniedKey   = "key denied by key_allow or key_deny"
+	discardThrottled   = "value before the item delay elapsed"
+)
+
+// Reason of the keys suppressed from the key lists
+const unsupportedItem = "not supported"
+
+// Suppresses the unsupported keys of a host for another unsupported_ttl,
+// and lets through the ones supported again since the last fetch.
+func (zo *ZabbixOutput) updateUnsupported(host string, hc active_zabbix.HostActiveKeys,
+	unsupported []string, now time.Time) {
+
+	if zo.negative == nil {
+		return
+	}
+	was := zo.unsupported[host]
+	is := make(map[string]bool, len(unsupported))
+	for _, key := range unsupported {
+		is[key] = true
+		zo.negative.add(host, key, unsupportedItem, now)
+	}
+	for key, _ := range was {
+		if !is[key] {
+			zo.negative.remove(host, key, unsupportedItem)
+		}
+	}
+	zo.unsupported[host] = is
+}
+
+func (zo *ZabbixOutput) Filter(pack *PipelinePack) (discard bool, reason string, err error) {
+	var (
+		val   interface{}
+		key   string
+		host  string
+		ok    bool
+		found bool
+	)
+
+	discard = true
+
+	if val, found = pack.Message.GetFieldValue("key"); !found {
+		err = fmt.Errorf("No Key in message")
+		return
+	}
+	if key, ok = val.(string); !ok {
+		err = fmt.Errorf("Unable to cast key to string")
+		return
+	}
+
+	if val, found = pack.Message.GetFieldValue("host"); !found {
+		err = fmt.Errorf("No Host in message")
+		return
+	}
+	if host, ok = val.(string); !ok {
+		err = fmt.Errorf("Unable to cast host to string")
+		return
+	}
+
+	// Static lists first, the keys they drop don't go to key seen
+	if !zo.keyAllowed(key) {
+		reason = discardDeniedKey
+		return
+	}
+	if zo.conf.ZabbixChecksPollInterval == 0 {
+		discard = false
+		return
+	}
+
+	// Read once, this runs for every message
+	now := time.Now()
+	if zo.host_last_seen != nil {
+		zo.host_last_seen[host] = now
+	}
+
+	// Populate key seen if enabled. Only used from the Run loop like
+	// key_filter, no lock needed.
+	if zo.conf.KeySeenWindow != 0 {
+		hs := zo.key_seen[host]
+		if hs == nil {
+			hs = make(HostSeenKeys, 1)
+			zo.key_seen[host] = hs
+		}
+		hs[key] = now
+		if len(zo.nodata_reported) > 0 {
+			zo.nodataSeen(host, key)
+		}
+	}
+
+	// Check against active check filter
+	if hc, found_host := zo.key_filter[host]; found_host && hc != nil {
+		if !zo.keyListed(host, hc, key) {
+			reason = discardUnknownKey
+			zo.requestItem(pack, host, key)
+		} else if zo.negative.suppressed(host, key, now) {
+			reason = discardSuppressed
+		} else if zo.throttled(pack, host, key, hc[key]) {
+			reason = discardThrottled
+		} else {
+			discard = false
+		}
+	} else {
+		// We have no data on current host, we'll need to fetch it!
+		// Discard by default
+		zo.key_filter[host] = nil
+		reason = discardUnknownHost
+		discard = zo.conf.UnknownHostPolicy != "pass"
+		zo.fetchNewHost(host, now)
+
+		if zo.host_create != nil && !zo.hosts_created[host] {
+			select {
+			case zo.host_create <- host:
+				zo.hosts_created[host] = true
+			default:
+				// Creation queue full, retried on the next metric
+			}
+		}
+	}
+
+	return
+}
+
+// Creates the hosts queued by Filter through the Zabbix API. The hosts that
+// couldn't be created are sent back to the Run loop, to queue them again on
+// their next metric.
+func (zo *ZabbixOutput) createHosts(or OutputRunner) {
+	var (
+		groupIds    []string
+		templateIds []string
+		err         error
+	)
+
+	for host := range zo.host_create {
+		if groupIds == nil {
+			if groupIds, err = zo.api_client.HostGroupIds(zo.conf.CreateHostGroups); err == nil {
+				templateIds, err = zo.api_client.TemplateIds(zo.conf.CreateHostTemplates)
+			}
+			if err != nil {
+				groupIds = nil
+				or.LogError(fmt.Errorf("Unable to resolve host groups and templates: %s", err))
+				zo.hostCreateFailed(host)
+				continue
+			}
+		}
+
+		if created, err := zo.api_client.EnsureHost(host, groupIds, templateIds, &zo.conf.CreateHostInterface); err != nil {
+			or.LogError(fmt.Errorf("Unable to create host %s: %s", host, err))
+			zo.hostCreateFailed(host)
+		} else if created {
+			or.LogMessage(fmt.Sprintf("Created host %s", host))
+		}
+	}
+}
+
+func (zo *ZabbixOutput) hostCreateFailed(host string) {
+	select {
+	case zo.hosts_failed <- host:
+	default:
+		// Run loop gone or behind, the host isn't created again until
+		// it's evicted
+	}
+}
+
+// Applies maintenance_policy to a record of a host in maintenance, returns
+// whether the record was dropped or held.
+func (zo *ZabbixOutput) maintenanceHold(host string, record []byte) bool {
+	if !zo.maintenance[host] {
+		return false
+	}
+
+	switch zo.conf.MaintenancePolicy {
+	case "drop":
+		zo.host_stats.count(host, hostFiltered, 1)
+	case "buffer":
+		held := append(zo.held_records[host], record)
+		if len(held) > int(zo.conf.MaxKeyCount) {
+			zo.deadLetter(held[:1], "Dropped from the maintenance buffer")
+			held = held[1:]
+			zo.stats_lock.Lock()
+			zo.stats.MaintenanceDropped++
+			zo.stats_lock.Unlock()
+		}
+		zo.held_records[host] = held
+	default:
+		return false
+	}
+	zo.stats_lock.Lock()
+	zo.stats.Maintenance++
+	zo.stats_lock.Unlock()
+	return true
+}
+
+// Records held for the hosts out of maintenance now.
+func (zo *ZabbixOutput) maintenanceOver() (records [][]byte) {
+	for host, held := range zo.held_records {
+		if !zo.maintenance[host] {
+			records = append(records, held...)
+			delete(zo.held_records, host)
+		}
+	}
+	return
+}
+
+// All the records held, on shutdown. They go with the records left, sent
+// or spooled like them.
+func (zo *ZabbixOutput) maintenanceShutdown() (records [][]byte) {
+	for _, held := range zo.held_records {
+		records = append(records, held...)
+	}
+	zo.held_records = make(map[string][][]byte)
+	return
+}
+
+// Key of a metric the server has no item for, with a value to pick the
+// item value type from
+type itemCreateRequest struct {
+	host  string
+	key   string
+	value string
+}
+
+// Asks for the creation of the item of a rejected key, once.
+func (zo *ZabbixOutput) requestItem(pack *PipelinePack, host string, key string) {
+	id := host + "\x00" + key
+	if zo.item_create == nil || zo.items_requested[id] {
+		return
+	}
+
+	req := itemCreateRequest{host: host, key: key}
+	if v, found := pack.Message.GetFieldValue("value"); found {
+		req.value, _ = formatItemValue(v, ZabbixValueAuto)
+	}
+	select {
+	case zo.item_create <- req:
+		zo.items_requested[id] = true
+	default:
+		// Creation queue full, retried on the next metric
+	}
+}
+
+// Creates the requested items until the channel is closed. They show up in
+// the key lists on the next refresh. The items that couldn't be created are
+// sent back to the Run loop, to request them again on their next metric.
+func (zo *ZabbixOutput) createItems(or OutputRunner) {
+	var (
+		// Ids of the hosts, or of the template, and of their applications
+		ownerIds = make(map[string]string)
+		appIds   = make(map[string]string)
+		created  = make(map[string]bool)
+		err      error
+	)
+	itemType := zabbixItemTypeActiveAgent
+	if zo.conf.Mode == "api" || zo.conf.RequestType == "sender data" {
+		itemType = zabbixItemTypeTrapper
+	}
+
+	for req := range zo.item_create {
+		ownerId, found := ownerIds[req.host]
+		if !found {
+			if zo.conf.CreateItemTemplate != "" {
+				var ids []string
+				if ids, err = zo.api_client.TemplateIds([]string{zo.conf.CreateItemTemplate}); err == nil {
+					ownerId = ids[0]
+				}
+			} else {
+				ownerId, err = zo.api_client.HostId(req.host)
+			}
+			if err == nil && ownerId == "" {
+				err = fmt.Errorf("host not found")
+			}
+			if err != nil {
+				or.LogError(fmt.Errorf("Unable to create item %s:%s: %s", req.host, req.key, err))
+				zo.itemCreateFailed(req)
+				continue
+			}
+			ownerIds[req.host] = ownerId
+		}
+		if created[ownerId+"\x00"+req.key] {
+			continue
+		}
+
+		item := ZabbixItemCreate{HostId: ownerId, Key: req.key, Type: itemType,
+			ValueType: zo.item_value_type, Delay: zo.conf.CreateItemDelay}
+		if item.ValueType == ZabbixValueAuto {
+			item.ValueType = ZabbixValueText
+			if _, localErr := strconv.ParseFloat(req.value, 64); localErr == nil {
+				item.ValueType = ZabbixValueFloat
+			}
+		}
+		if zo.conf.CreateItemApplication != "" {
+			appId, found := appIds[ownerId]
+			if !found {
+				if appId, err = zo.api_client.ApplicationId(ownerId, zo.conf.CreateItemApplication); err != nil {
+					or.LogError(fmt.Errorf("Unable to create item %s:%s: %s", req.host, req.key, err))
+					zo.itemCreateFailed(req)
+					continue
+				}
+				appIds[ownerId] = appId
+			}
+			item.ApplicationIds = []string{appId}
+		}
+
+		if err = zo.api_client.CreateItem(item); err != nil {
+			or.LogError(fmt.Errorf("Unable to create item %s:%s: %s", req.host, req.key, err))
+			zo.itemCreateFailed(req)
+			continue
+		}
+		created[ownerId+"\x00"+req.key] = true
+		or.LogMessage(fmt.Sprintf("Created item %s:%s", req.host, req.key))
+	}
+}
+
+func (zo *ZabbixOutput) itemCreateFailed(req itemCreateRequest) {
+	select {
+	case zo.items_failed <- req.host + "\x00" + req.key:
+	default:
+		// Run loop gone or behind, the item isn't requested again
+	}
+}
+
+// Re-injects a copy of a discarded metric annotated with the discard reason.
+func (zo *ZabbixOutput) injectDiscarded(or OutputRunner, h PluginHelper, pack *PipelinePack, reason string) {
+	// Don't loop on our own messages if the matcher lets them back in
+	if _, found := pack.Message.GetFieldValue("zabbix_filtered"); found {
+		return
+	}
+
+	pack2 := h.PipelinePack(pack.MsgLoopCount)
+	if pack2 == nil {
+		or.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d", h.PipelineConfig().Globals.MaxMsgLoops))
+		return
+	}
+	pack2.Message = message.CopyMessage(pack.Message)
+
+	var (
+		field *message.Field
+		err   error
+	)
+	if field, err = message.NewField("zabbix_filtered", true, ""); err == nil {
+		pack2.Message.AddField(field)
+		field, err = message.NewField("zabbix_filtered_reason", reason, "")
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("Unable to annotate discarded metric: %s", err))
+		pack2.Recycle()
+		return
+	}
+	pack2.Message.AddField(field)
+
+	or.Inject(pack2)
+}
+
+// Type of the dead-lettered records
+const zabbixFailedType = "zabbix.failed"
+
+// Re-injects records failed for good, with inject_failed.
+func (zo *ZabbixOutput) deadLetter(records [][]byte, reason string) {
+	if !zo.conf.InjectFailed || zo.helper == nil {
+		return
+	}
+
+	for _, record := range records {
+		var r zabbixDataRecord
+		if err := json.Unmarshal(record, &r); err != nil {
+			zo.runner.LogError(fmt.Errorf("Unable to dead-letter record %q: %s", record, err))
+			continue
+		}
+		value := string(r.Value)
+		var s string
+		if json.Unmarshal(r.Value, &s) == nil {
+			value = s
+		}
+		ts := time.Now()
+		if clock, err := r.Clock.Int64(); err == nil {
+			ns, _ := r.Ns.Int64()
+			ts = time.Unix(clock, ns)
+		}
+
+		pack, err := newZabbixMetricPack(zo.helper, 0, zabbixFailedType, r.Host, r.Key, value, ts)
+		if err != nil {
+			zo.runner.LogError(fmt.Errorf("Unable to dead-letter record: %s", err))
+			continue
+		}
+		var field *message.Field
+		if field, err = message.NewField("error", reason, ""); err != nil {
+			zo.runner.LogError(fmt.Errorf("Unable to dead-letter record: %s", err))
+			pack.Recycle()
+			continue
+		}
+		pack.Message.AddField(field)
+		pack.Message.SetPayload(string(record))
+		zo.runner.Inject(pack)
+
+		zo.stats_lock.Lock()
+		zo.stats.DeadLettered++
+		zo.stats_lock.Unlock()
+	}
+}
+
+// Whether a metric goes through the priority lane.
+func (zo *ZabbixOutput) isPriority(pack *PipelinePack) bool {
+	if zo.conf.PrioritySeverity >= 0 && pack.Message.GetSeverity() <= zo.conf.PrioritySeverity {
+		return true
+	}
+	if len(zo.priority_keys) == 0 {
+		return false
+	}
+	key, _ := fieldToString("key", pack)
+	return matchAny(zo.priority_keys, key)
+}
+
+// Compiles the regexps of a setting.
+func compileRegexps(setting string, exprs []string) (res []*regexp.Regexp, err error) {
+	for _, expr := range exprs {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("Invalid %s regexp %s: %s", setting, expr, err)
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a key passes key_allow and key_deny.
+func (zo *ZabbixOutput) keyAllowed(key string) bool {
+	if len(zo.key_allow) > 0 && !matchAny(zo.key_allow, key) {
+		return false
+	}
+	return !matchAny(zo.key_deny, key)
+}
+
+// Sends a priority record on its own, returns false when it failed and
+// must go through the normal batching instead.
+func (zo *ZabbixOutput) sendPriority(or OutputRunner, record []byte) bool {
+	if zo.limiter.take(1, time.Now()) == 0 {
+		return false
+	}
+	res, err := zo.sendBatch(zo.assembleBatch([][]byte{record}))
+	if err == nil {
+		err = zo.checkSendResult(res, [][]byte{record})
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("Priority send failed, falling back to batching: %s", err))
+		zo.stats_lock.Lock()
+		zo.stats.SendErrors++
+		zo.stats_lock.Unlock()
+		return false
+	}
+	zo.stats_lock.Lock()
+	zo.stats.Sent++
+	zo.stats.PrioritySent++
+	zo.stats_lock.Unlock()
+	zo.host_stats.countRecords([][]byte{record}, hostSent)
+	return true
+}
+
+func (zo *ZabbixOutput) SendMetrics(or OutputRunner, data [][]byte) (new_slice [][]byte, err error) {
+	new_slice = data
+	if zo.backingOff() {
+		// Don't hammer a failing server, just keep the buffer bounded
+		return zo.truncate(or, data, new_slice), nil
+	}
+
+	// Values over the rate limit wait in the buffer for the next round
+	allowed := zo.limiter.take(len(data), time.Now())
+	if allowed == 0 {
+		return zo.truncate(or, data, new_slice), nil
+	}
+
+	failed := zo.stats.ItemsFailed
+	var left [][]byte
+	left, err = zo.SendRecords(data[:allowed])
+	new_slice = data[allowed-len(left):]
+	if failed != zo.stats.ItemsFailed {
+		or.LogError(fmt.Errorf("Zabbix server failed to process %d items", zo.stats.ItemsFailed-failed))
+	}
+	zo.logItemErrors(or)
+	zo.stats_lock.Lock()
+	zo.stats.Sent += int64(allowed - len(left))
+	if err != nil {
+		zo.stats.SendErrors++
+	}
+	zo.stats_lock.Unlock()
+	zo.host_stats.countRecords(data[:allowed-len(left)], hostSent)
+	zo.recordSend(or, err, len(left)+len(data)-allowed)
+	if err != nil {
+		zo.send_failures++
+		zo.send_retry_at = time.Now().Add(zo.send_retry.delay(zo.send_failures))
+		if length := zo.batchLength(new_slice); zo.retriesExhausted(or, new_slice[:length], err) {
+			new_slice = new_slice[length:]
+		}
+		new_slice = zo.truncate(or, data, new_slice)
+		return
+	}
+	zo.send_failures = 0
+	zo.batch_failures = 0
+	if len(new_slice) == 0 {
+		zo.drainSpool(or)
+	}
+
+	// Rate limited values are kept, within bounds
+	return zo.truncate(or, data, new_slice), nil
+}
+
+// Accounts a failed send of the batch at the head of the buffer, returns
+// true when it failed more than max_send_retries times and is dropped, or
+// it's over the retry budget.
+func (zo *ZabbixOutput) retriesExhausted(or OutputRunner, batch [][]byte, err error) bool {
+	zo.batch_failures++
+	if zo.conf.MaxSendRetries == 0 || zo.batch_failures <= zo.conf.MaxSendRetries {
+		return zo.overRetryBudget(or, batch, err)
+	}
+	or.LogError(fmt.Errorf("Dropping batch of %d metrics after %d failed sends, last error: %s",
+		len(batch), zo.batch_failures, err))
+	zo.deadLetter(batch, fmt.Sprintf("Failed %d sends: %s", zo.batch_failures, err))
+	zo.host_stats.countRecords(batch, hostDropped)
+	zo.batch_failures = 0
+	zo.stats_lock.Lock()
+	zo.stats.RetriesExhausted++
+	zo.stats_lock.Unlock()
+	return true
+}
+
+// Moves a failed batch out of the way once max_retries_per_minute is
+// used up, to the spool when there's one.
+func (zo *ZabbixOutput) overRetryBudget(or OutputRunner, batch [][]byte, err error) bool {
+	if zo.retry_budget.take(1, time.Now()) == 1 {
+		return false
+	}
+	left := batch
+	if zo.spool != nil {
+		left = zo.spoolRecords(or, batch)
+	}
+	if len(left) > 0 {
+		or.LogError(fmt.Errorf("Retry budget used up, dropping batch of %d metrics, last error: %s",
+			len(left), err))
+		zo.deadLetter(left, fmt.Sprintf("Retry budget used up: %s", err))
+		zo.host_stats.countRecords(left, hostDropped)
+	}
+	zo.batch_failures = 0
+	zo.stats_lock.Lock()
+	zo.stats.RetryBudgetExceeded++
+	zo.stats_lock.Unlock()
+	return true
+}
+
+// Logs the item errors of the last sends, up to maxLoggedItemErrors.
+func (zo *ZabbixOutput) logItemErrors(or OutputRunner) {
+	for i, e := range zo.item_errors {
+		if i == maxLoggedItemErrors {
+			or.LogError(fmt.Errorf("%d more item errors", len(zo.item_errors)-i))
+			break
+		}
+		or.LogError(fmt.Errorf("Item failed: %s", e))
+	}
+	zo.item_errors = zo.item_errors[:0]
+}
+
+// Feeds the outcome of a send to the down alert and the circuit breaker,
+// buffered records are the ones still waiting to be sent.
+func (zo *ZabbixOutput) recordSend(or OutputRunner, err error, buffered int) {
+	now := time.Now()
+	if alert, failures, since := zo.down_alert.record(err, now); alert != "" {
+		zo.injectDownAlert(alert, failures, since, err, buffered)
+	}
+
+	switch zo.breaker.record(err, now) {
+	case circuitOpen:
+		or.LogError(fmt.Errorf("Circuit opened after %d failed sends, holding sends for %s",
+			zo.conf.CircuitBreakerThreshold, zo.breaker.cooldown))
+	case circuitClosed:
+		or.LogMessage("Circuit closed, sends resumed")
+	}
+}
+
+// Queues the records to Heka's output queue, a batch per record so each
+// one is sent and checkpointed whole.
+func (zo *ZabbixOutput) queueRecords(or OutputRunner, records [][]byte) {
+	for len(records) > 0 {
+		length := zo.batchLength(records)
+		if err := zo.buffered_out.QueueBytes(zo.assembleBatch(records[:length])); err != nil {
+			or.LogError(fmt.Errorf("Unable to queue %d metrics: %s", length, err))
+			zo.stats_lock.Lock()
+			zo.stats.Truncated += int64(length)
+			zo.stats_lock.Unlock()
+			zo.host_stats.countRecords(records[:length], hostDropped)
+			zo.deadLetter(records[:length], fmt.Sprintf("Unable to queue: %s", err))
+		}
+		records = records[length:]
+	}
+}
+
+// Sends a batch read back from Heka's output queue, which keeps retrying
+// it as long as an error is returned and only moves its checkpoint past
+// the batch once it's sent.
+func (zo *ZabbixOutput) SendRecord(record []byte) (err error) {
+	if zo.breaker.open(time.Now()) {
+		return fmt.Errorf("Circuit open, holding sends")
+	}
+
+	var (
+		batch zabbixDataBatch
+		res   zabbixSendResult
+	)
+	if err = json.Unmarshal(record, &batch); err != nil {
+		zo.runner.LogError(fmt.Errorf("Dropping undecodable queued batch: %s", err))
+		return nil
+	}
+	records := make([][]byte, len(batch.Data))
+	for i, r := range batch.Data {
+		records[i] = r
+	}
+	if res, err = zo.sendBatch(record); err == nil {
+		err = zo.checkSendResult(res, records)
+	}
+	zo.logItemErrors(zo.runner)
+	zo.recordSend(zo.runner, err, len(records))
+	if err != nil {
+		zo.stats_lock.Lock()
+		zo.stats.SendErrors++
+		zo.stats_lock.Unlock()
+		if zo.retriesExhausted(zo.runner, records, err) {
+			return nil
+		}
+		return
+	}
+	zo.batch_failures = 0
+	zo.stats_lock.Lock()
+	zo.stats.Sent += int64(len(records))
+	zo.stats_lock.Unlock()
+	return
+}
+
+// Heartbeat records of the hosts known from the key lists or accepted
+// records.
+func (zo *ZabbixOutput) heartbeats(now time.Time) (records [][]byte) {
+	hosts := make(map[string]bool, len(zo.key_filter)+len(zo.heartbeat_hosts))
+	for host, _ := range zo.key_filter {
+		hosts[host] = true
+	}
+	for host, _ := range zo.heartbeat_hosts {
+		hosts[host] = true
+	}
+
+	clock := fmt.Sprintf("%d", now.Unix())
+	for host, _ := range hosts {
+		zm := active_zabbix.ZabbixMetricKeyJson{Host: host, Key: zo.conf.HeartbeatKey, Value: "1", Clock: clock}
+		if record, err := zo.marshalRecord(zm); err == nil {
+			records = append(records, record)
+		}
+	}
+	return
+}
+
+// Name and parameters of an item key, vfs.fs.size and /,free for
+// vfs.fs.size[/,free]. Keys without parameters have none.
+func splitItemKey(key string) (name string, params string) {
+	if i := strings.IndexByte(key, '['); i > 0 && strings.HasSuffix(key, "]") {
+		return key[:i], key[i+1 : len(key)-1]
+	}
+	return key, ""
+}
+
+// Discovery records of the keys seen per host, leaving out the keys the
+// plugin generates itself.
+func (zo *ZabbixOutput) discoveryRecords(now time.Time) (records [][]byte) {
+	clock := fmt.Sprintf("%d", now.Unix())
+	macro := strings.TrimSuffix(zo.conf.LldMacro, "}")
+	for host, hs := range zo.key_seen {
+		keys := make([]string, 0, len(hs))
+		for key, _ := range hs {
+			if key == zo.conf.LldKey || key == zo.conf.HeartbeatKey {
+				continue
+			}
+			if _, listed := zo.key_filter[host][key]; listed && zo.conf.LldUnknownOnly {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+
+		lld := struct {
+			Data []map[string]string `json:"data"`
+		}{make([]map[string]string, len(keys))}
+		for i, key := range keys {
+			lld.Data[i] = map[string]string{zo.conf.LldMacro: key}
+			if zo.conf.LldSplitKey {
+				name, params := splitItemKey(key)
+				lld.Data[i][macro+".NAME}"] = name
+				lld.Data[i][macro+".PARAMS}"] = params
+			}
+		}
+		value, err := json.Marshal(lld)
+		if err != nil {
+			continue
+		}
+		zm := active_zabbix.ZabbixMetricKeyJson{Host: host, Key: zo.conf.LldKey, Value: string(value), Clock: clock}
+		if record, err := zo.marshalRecord(zm); err == nil {
+			records = append(records, record)
+		}
+	}
+	return
+}
+
+// Encodes a record generated by the plugin, with its id when value_ids
+// is set.
+func (zo *ZabbixOutput) marshalRecord(zm active_zabbix.ZabbixMetricKeyJson) (record []byte, err error) {
+	if record, err = json.Marshal(zm); err == nil && zo.value_ids != nil {
+		record, err = zo.value_ids.tag(record)
+	}
+	return
+}
+
+// Sends the buffered records, or hands them to the sender goroutine.
+// Returns the records left in the buffer.
+func (zo *ZabbixOutput) flush(or OutputRunner, data [][]byte) [][]byte {
+	if zo.send_queue == nil {
+		var err error
+		if data, err = zo.SendMetrics(or, data); err != nil {
+			or.LogError(err)
+		}
+		return data
+	}
+
+	batch := make([][]byte, len(data))
+	copy(batch, data)
+	zo.send_queue <- batch
+	return data[:0]
+}
+
+// Sends the queued batches and priority records until the queue is closed.
+// Records the server didn't take stay pending for the next round.
+func (zo *ZabbixOutput) sender(or OutputRunner, done chan struct{}) {
+	defer close(done)
+
+	var pending [][]byte
+	retry := time.NewTicker(zo.flushInterval())
+	defer retry.Stop()
+
+	send := func() {
+		if len(pending) > 0 {
+			var err error
+			if pending, err = zo.SendMetrics(or, pending); err != nil {
+				or.LogError(err)
+			}
+		} else {
+			zo.drainSpool(or)
+		}
+		atomic.StoreInt64(&zo.send_pending, int64(len(pending)))
+	}
+
+	for {
+		select {
+		case record := <-zo.priority_queue:
+			if zo.backingOff() || !zo.sendPriority(or, record) {
+				pending = append(pending, record)
+				atomic.StoreInt64(&zo.send_pending, int64(len(pending)))
+			}
+		case batch, ok := <-zo.send_queue:
+			if !ok {
+				for len(zo.priority_queue) > 0 {
+					pending = append(pending, <-zo.priority_queue)
+				}
+				zo.shutdownFlush(or, pending)
+				atomic.StoreInt64(&zo.send_pending, 0)
+				return
+			}
+			pending = append(pending, batch...)
+			send()
+		case <-retry.C:
+			send()
+		}
+	}
+}
+
+// Last send of the records left when the input closes, batches are sent
+// until shutdown_timeout is over or one fails. The records left go to the
+// spool when there's one, and are dropped otherwise.
+func (zo *ZabbixOutput) shutdownFlush(or OutputRunner, data [][]byte) {
+	deadline := time.Now().Add(time.Duration(zo.conf.ShutdownTimeout))
+	for len(data) > 0 && time.Now().Before(deadline) && !zo.breaker.open(time.Now()) {
+		length := zo.batchLength(data)
+		res, err := zo.sendBatch(zo.assembleBatch(data[:length]))
+		if err == nil {
+			err = zo.checkSendResult(res, data[:length])
+		}
+		zo.logItemErrors(or)
+		if err != nil {
+			or.LogError(fmt.Errorf("Final send failed: %s", err))
+			zo.stats_lock.Lock()
+			zo.stats.SendErrors++
+			zo.stats_lock.Unlock()
+			break
+		}
+		zo.stats_lock.Lock()
+		zo.stats.Sent += int64(length)
+		zo.stats_lock.Unlock()
+		zo.host_stats.countRecords(data[:length], hostSent)
+		data = data[length:]
+	}
+
+	if zo.spool != nil && len(data) > 0 {
+		spooled := len(data)
+		data = zo.spoolRecords(or, data)
+		or.LogMessage(fmt.Sprintf("Spooled %d metrics on shutdown", spooled-len(data)))
+	}
+	if len(data) > 0 {
+		or.LogError(fmt.Errorf("Dropped %d metrics on shutdown", len(data)))
+		zo.deadLetter(data, "Dropped on shutdown")
+	}
+}
+
+// Whether sends are suspended after failures, by the retry backoff or the
+// circuit breaker.
+func (zo *ZabbixOutput) backingOff() bool {
+	now := time.Now()
+	return (zo.send_failures > 0 && now.Before(zo.send_retry_at)) || zo.breaker.open(now)
+}
+
+// Total size of records.
+func recordsSize(records [][]byte) (size int) {
+	for _, record := range records {
+		size += len(record)
+	}
+	return
+}
+
+func (zo *ZabbixOutput) overBufferBytes(size int) bool {
+	return zo.conf.MaxBufferBytes != 0 && size > int(zo.conf.MaxBufferBytes)
+}
+
+// If we've hit the max key to send, or the max buffer size, truncate the
+// slice down, dropping the oldest or the newest metrics as configured
+func (zo *ZabbixOutput) truncate(or OutputRunner, data [][]byte, new_slice [][]byte) [][]byte {
+	if zo.conf.BlockOnFull {
+		// The Run loop stops reading instead
+		return new_slice
+	}
+	keep := len(new_slice)
+	if keep > int(zo.conf.MaxKeyCount) {
+		keep = int(zo.conf.MaxKeyCount) - zo.sendKeyCount()
+	}
+	if zo.conf.MaxBufferBytes != 0 {
+		keep = zo.fitBufferBytes(new_slice, keep)
+	}
+	if keep == len(new_slice) {
+		return new_slice
+	}
+
+	kept, dropped := new_slice[len(new_slice)-keep:], new_slice[:len(new_slice)-keep]
+	if zo.conf.Drop == "newest" {
+		kept, dropped = new_slice[:keep], new_slice[keep:]
+	}
+	if zo.spool != nil {
+		dropped = zo.spoolRecords(or, dropped)
+	}
+	if len(dropped) > 0 {
+		or.LogError(fmt.Errorf("Truncated %d %s metrics from in-memory buffer.", len(dropped), zo.conf.Drop))
+		zo.stats_lock.Lock()
+		zo.stats.Truncated += int64(len(dropped))
+		zo.stats_lock.Unlock()
+		zo.host_stats.countRecords(dropped, hostDropped)
+		zo.deadLetter(dropped, "Truncated from the in-memory buffer")
+	}
+	copy(data, kept)
+	return data[:keep]
+}
+
+// Writes records to the spool, a batch per segment so each one is sent
+// whole. Returns the records that couldn't be written.
+func (zo *ZabbixOutput) spoolRecords(or OutputRunner, records [][]byte) [][]byte {
+	defer zo.spoolUpdated()
+
+	for len(records) > 0 {
+		length := zo.batchLength(records)
+		dropped, err := zo.spool.Push(records[:length])
+		if err != nil {
+			or.LogError(fmt.Errorf("Unable to write to spool: %s", err))
+			return records
+		}
+		zo.stats_lock.Lock()
+		zo.stats.Spooled += int64(length)
+		zo.stats_lock.Unlock()
+		if dropped > 0 {
+			or.LogError(fmt.Errorf("Spool over %d bytes, dropped its %d oldest batches", zo.conf.SpoolMaxBytes, dropped))
+		}
+		records = records[length:]
+	}
+	return nil
+}
+
+// Batches of the spool sent per drain, so intake isn't held back too long
+const spoolDrainBatches = 10
+
+// Sends the spooled batches, oldest first, until one fails.
+func (zo *ZabbixOutput) drainSpool(or OutputRunner) {
+	if zo.spool == nil || zo.spool.Len() == 0 || zo.backingOff() {
+		return
+	}
+	defer zo.spoolUpdated()
+
+	for i := 0; i < spoolDrainBatches && zo.spool.Len() > 0; i++ {
+		records, err := zo.spool.Peek()
+		if _, corrupt := err.(corruptSegmentError); corrupt {
+			// Can't be read back, don't let it block the others
+			or.LogError(fmt.Errorf("Dropping spool segment: %s", err))
+			zo.spool.Remove()
+			continue
+		} else if err != nil {
+			or.LogError(fmt.Errorf("Unable to read spool segment: %s", err))
+			return
+		}
+		if records = zo.validSpooled(or, records); len(records) == 0 {
+			zo.spool.Remove()
+			continue
+		}
+		// Segments are sent whole, wait until the bucket has room for one
+		if !zo.limiter.takeAll(len(records), time.Now()) {
+			return
+		}
+
+		var res zabbixSendResult
+		if res, err = zo.sendBatch(zo.assembleBatch(records)); err == nil {
+			err = zo.checkSendResult(res, records)
+		}
+		if err != nil {
+			or.LogError(fmt.Errorf("Unable to send spooled batch: %s", err))
+			return
+		}
+		if err = zo.spool.Remove(); err != nil {
+			or.LogError(fmt.Errorf("Unable to remove spool segment: %s", err))
+			return
+		}
+		zo.stats_lock.Lock()
+		zo.stats.Sent += int64(len(records))
+		zo.stats.Unspooled += int64(len(records))
+		zo.stats_lock.Unlock()
+		zo.host_stats.countRecords(records, hostSent)
+	}
+}
+
+// Spooled records that are valid JSON, the others are counted as encode
+// errors. Segments written by older versions or by hand may hold some.
+func (zo *ZabbixOutput) validSpooled(or OutputRunner, records [][]byte) [][]byte {
+	var valid, invalid [][]byte
+	for _, record := range records {
+		if json.Valid(record) {
+			valid = append(valid, record)
+		} else {
+			or.LogError(fmt.Errorf("Dropping invalid JSON record from the spool %q", record))
+			invalid = append(invalid, record)
+		}
+	}
+	if len(invalid) == 0 {
+		return records
+	}
+
+	zo.stats_lock.Lock()
+	zo.stats.EncodeErrors += int64(len(invalid))
+	zo.stats_lock.Unlock()
+	zo.host_stats.countRecords(invalid, hostError)
+	return valid
+}
+
+func (zo *ZabbixOutput) spoolUpdated() {
+	atomic.StoreInt64(&zo.spool_segments, int64(zo.spool.Len()))
+	atomic.StoreInt64(&zo.spool_bytes, zo.spool.Size())
+}
+
+// Number of records, at most keep, fitting in max_buffer_bytes. They're
+// counted from the end of the buffer that is kept.
+func (zo *ZabbixOutput) fitBufferBytes(records [][]byte, keep int) int {
+	size := 0
+	for i := 0; i < keep; i++ {
+		record := records[len(records)-1-i]
+		if zo.conf.Drop == "newest" {
+			record = records[i]
+		}
+		if size += len(record); size > int(zo.conf.MaxBufferBytes) {
+			return i
+		}
+	}
+	return keep
+}
+
+func (zo *ZabbixOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+		ticker = or.Ticker()
+	)
+
+	zo.runner, zo.helper = or, h
+
+	updateFilter := make(chan bool, 1)
+	go func() {
+		jitter := float64(zo.conf.ZabbixChecksPollJitter) / 100
+		if zo.checksInterval() != 0 && jitter > 0 {
+			stagger := time.Duration(rand.Float64() * jitter * float64(zo.checksInterval()))
+			if warmup := time.Duration(zo.conf.WarmupTimeout); warmup != 0 && stagger > warmup/2 {
+				stagger = warmup / 2
+			}
+			time.Sleep(stagger)
+		}
+		for zo.checksInterval() != 0 {
+			updateFilter <- true
+			time.Sleep(jittered(zo.roundInterval(), jitter))
+		}
+	}()
+
+	if zo.host_create != nil {
+		go zo.createHosts(or)
+		defer close(zo.host_create)
+	}
+	if zo.item_create != nil {
+		go zo.createItems(or)
+		defer close(zo.item_create)
+	}
+
+	if zo.servers != nil {
+		defer zo.servers.closeIdle()
+	}
+
+	if len(zo.mirrors) > 0 {
+		stopMirrors := make(chan struct{})
+		mirrorsDone := make([]chan struct{}, len(zo.mirrors))
+		for i, m := range zo.mirrors {
+			mirrorsDone[i] = make(chan struct{})
+			go m.run(or, stopMirrors, mirrorsDone[i])
+		}
+		defer func() {
+			close(stopMirrors)
+			for _, done := range mirrorsDone {
+				<-done
+			}
+		}()
+	}
+
+	if zo.send_queue != nil {
+		senderDone := make(chan struct{})
+		go zo.sender(or, senderDone)
+		defer func() {
+			close(zo.send_queue)
+			<-senderDone
+		}()
+	}
+
+	var flushTicker <-chan time.Time
+	if zo.conf.FlushInterval != 0 {
+		t := time.NewTicker(zo.flushInterval())
+		defer t.Stop()
+		flushTicker = t.C
+	}
+
+	var heartbeatTicker <-chan time.Time
+	if zo.conf.HeartbeatInterval != 0 {
+		t := time.NewTicker(time.Duration(zo.conf.HeartbeatInterval))
+		defer t.Stop()
+		heartbeatTicker = t.C
+	}
+
+	var nodataTicker <-chan time.Time
+	if zo.nodata_reported != nil {
+		t := time.NewTicker(time.Duration(zo.conf.NodataCheckInterval))
+		defer t.Stop()
+		nodataTicker = t.C
+	}
+
+	var keySeenSaveTicker <-chan time.Time
+	if zo.conf.KeySeenFile != "" {
+		t := time.NewTicker(time.Duration(zo.conf.KeySeenSaveInterval))
+		defer t.Stop()
+		keySeenSaveTicker = t.C
+	}
+
+	var discardStatsTicker <-chan time.Time
+	if zo.conf.DiscardStatsInterval != 0 {
+		t := time.NewTicker(time.Duration(zo.conf.DiscardStatsInterval))
+		defer t.Stop()
+		discardStatsTicker = t.C
+	}
+
+	var discardedKeysTicker <-chan time.Time
+	if zo.conf.DiscardedKeysInterval != 0 {
+		t := time.NewTicker(time.Duration(zo.conf.DiscardedKeysInterval))
+		defer t.Stop()
+		discardedKeysTicker = t.C
+	}
+	defer zo.discarded_keys.close()
+
+	var lldTicker <-chan time.Time
+	if zo.conf.LldInterval != 0 {
+		t := time.NewTicker(time.Duration(zo.conf.LldInterval))
+		defer t.Stop()
+		lldTicker = t.C
+	}
+
+	var metadataTicker <-chan time.Time
+	if zo.conf.ItemMetadataInterval != 0 {
+		t := time.NewTicker(time.Duration(zo.conf.ItemMetadataInterval))
+		defer t.Stop()
+		metadataTicker = t.C
+	}
+	metadataRefreshing := make(chan bool, 1)
+
+	maintenanceUpdate := make(chan map[string]bool, 1)
+	go func() {
+		for zo.conf.MaintenanceInterval != 0 {
+			if hosts, err := zo.api_client.MaintenanceHosts(); err != nil {
+				or.LogError(fmt.Errorf("Unable to fetch the hosts in maintenance: %s", err))
+			} else {
+				maintenanceUpdate <- hosts
+			}
+			time.Sleep(time.Duration(zo.conf.MaintenanceInterval))
+		}
+	}()
+
+	keySeenCleanup := make(chan bool, 1)
+	go func() {
+		interval := time.Duration(zo.conf.KeySeenCleanupInterval)
+		if interval == 0 {
+			interval = time.Duration(zo.conf.KeySeenWindow)
+		}
+		for zo.conf.KeySeenWindow != 0 {
+			keySeenCleanup <- true
+			time.Sleep(interval)
+		}
+	}()
+	// Hosts left to clean up in the current key seen cleanup
+	var keySeenPass []string
+
+	var (
+		outputError = make(chan error, 5)
+		outputExit  = make(chan error)
+		queueExited bool
+		// Packs of the records not queued yet with use_buffering
+		held []*PipelinePack
+	)
+	if zo.conf.UseBuffering {
+		if poolSize := h.PipelineConfig().Globals.PoolSize; int(zo.conf.SendKeyCount) >= poolSize {
+			return fmt.Errorf("send_key_count must be below poolsize (%d) with use_buffering", poolSize)
+		}
+		queueDir := h.PipelineConfig().Globals.PrependBaseDir("output_queue")
+		if zo.buffered_out, err = NewBufferedOutput(queueDir, or.Name(), or, h,
+			zo.conf.QueueMaxBufferSize); err != nil {
+			return fmt.Errorf("Unable to open output queue: %s", err)
+		}
+		stopChan := make(chan bool, 1)
+		zo.buffered_out.Start(zo, outputError, outputExit, stopChan)
+		defer func() {
+			if !queueExited {
+				stopChan <- true
+				<-outputExit
+			}
+		}()
+	}
+
+	dataArray := make([][]byte, zo.conf.MaxKeyCount)
+	dataSlice := dataArray[0:0]
+	// Size of the buffered records, tracked for max_buffer_bytes
+	bufferedBytes := 0
+	flush := func() {
+		if zo.buffered_out != nil {
+			zo.queueRecords(or, dataSlice)
+			for _, p := range held {
+				p.Recycle()
+			}
+			held = held[:0]
+			dataSlice = dataSlice[:0]
+		} else {
+			dataSlice = zo.flush(or, dataSlice)
+		}
+		bufferedBytes = recordsSize(dataSlice)
+	}
+
+	// Deadline for the current batch, only armed while data is buffered
+	var (
+		batchTimer    *time.Timer
+		batchDeadline <-chan time.Time
+	)
+	stopBatchDeadline := func() {
+		if batchTimer != nil {
+			batchTimer.Stop()
+			batchTimer, batchDeadline = nil, nil
+		}
+	}
+	resetBatchDeadline := func() {
+		stopBatchDeadline()
+		if zo.conf.MaxBatchLatency != 0 && len(dataSlice) > 0 {
+			batchTimer = time.NewTimer(time.Duration(zo.conf.MaxBatchLatency))
+			batchDeadline = batchTimer.C
+		}
+	}
+	// Armed by the records arriving after a flush, even with records left
+	// by a rate limited or partial one. While sends back off after failures
+	// the ticker retries instead.
+	armBatchDeadline := func() {
+		if batchDeadline == nil && !(zo.send_queue == nil && zo.backingOff()) {
+			resetBatchDeadline()
+		}
+	}
+
+	// Messages held, during the warm-up or for hosts without a key list
+	// yet, leave the inputs half of the pool
+	maxHeld := h.PipelineConfig().Globals.PoolSize / 2
+	if maxHeld < 1 {
+		maxHeld = 1
+	}
+	// Held per host with unknown_host_policy "buffer", until their key list
+	// is fetched
+	var (
+		unknownHeld      = make(map[string][]*PipelinePack)
+		unknownHeldCount int
+	)
+
+	// Filters, encodes and buffers a message
+	accept := func(pack *PipelinePack) {
+		// Skip discard check if disable
+		if zo.conf.ZabbixChecksPollInterval != 0 || len(zo.key_allow) > 0 || len(zo.key_deny) > 0 {
+			if discard, reason, err := zo.Filter(pack); err != nil {
+				or.LogError(err)
+				zo.stats.FilterErrors++
+				zo.host_stats.count(packHost(pack), hostError, 1)
+				pack.Recycle()
+				return
+			} else if discard && reason == discardUnknownHost && zo.conf.UnknownHostPolicy == "buffer" &&
+				unknownHeldCount < maxHeld {
+
+				host := packHost(pack)
+				unknownHeld[host] = append(unknownHeld[host], pack)
+				unknownHeldCount++
+				zo.stats.UnknownHostHeld++
+				return
+			} else if discard {
+				zo.stats.Discarded++
+				zo.host_stats.count(packHost(pack), hostFiltered, 1)
+				if zo.discard_stats != nil || zo.discarded_keys != nil {
+					key, _ := fieldToString("key", pack)
+					zo.discard_stats.count(packHost(pack), key, reason)
+					if reason == discardUnknownKey || reason == discardUnknownHost {
+						if err := zo.discarded_keys.add(packHost(pack), key, reason, time.Now()); err != nil {
+							or.LogError(err)
+						}
+					}
+				}
+				if zo.conf.InjectDiscarded {
+					zo.injectDiscarded(or, h, pack, reason)
+				}
+				pack.Recycle()
+				return
+			}
+		}
+
+		msg, localErr := or.Encode(pack)
+		if localErr == nil && !json.Valid(msg) {
+			localErr = fmt.Errorf("invalid JSON record %q", msg)
+		}
+		if localErr == nil && zo.value_ids != nil {
+			msg, localErr = zo.value_ids.tag(msg)
+		}
+		if localErr != nil {
+			or.LogError(fmt.Errorf("Encoder failure: %s", localErr))
+			// Also written by the sender for spooled records
+			zo.stats_lock.Lock()
+			zo.stats.EncodeErrors++
+			zo.stats_lock.Unlock()
+			zo.host_stats.count(packHost(pack), hostError, 1)
+			pack.Recycle()
+			return
+		} else if zo.maintenanceHold(packHost(pack), msg) {
+			pack.Recycle()
+			return
+		} else {
+			zo.host_stats.count(packHost(pack), hostAccepted, 1)
+			if heartbeatTicker != nil {
+				zo.heartbeat_hosts[packHost(pack)] = true
+			}
+			for _, m := range zo.mirrors {
+				m.push(msg)
+			}
+			if zo.isPriority(pack) && zo.buffered_out != nil {
+				// Queued right away with the records held so far
+				dataSlice = append(dataSlice, msg)
+				held = append(held, pack)
+				flush()
+				stopBatchDeadline()
+				return
+			}
+			if zo.isPriority(pack) {
+				if zo.priority_queue != nil {
+					zo.priority_queue <- msg
+					pack.Recycle()
+					return
+				}
+				if !zo.backingOff() && zo.sendPriority(or, msg) {
+					pack.Recycle()
+					return
+				}
+			}
+			dataSlice = append(dataSlice, msg)
+			bufferedBytes += len(msg)
+		}
+		if zo.buffered_out != nil {
+			held = append(held, pack)
+		} else {
+			pack.Recycle()
+		}
+
+		armBatchDeadline()
+
+		if len(dataSlice) >= zo.sendKeyCount() || zo.overBufferBytes(bufferedBytes) {
+			flush()
+			stopBatchDeadline()
+		}
+	}
+
+	// Takes the messages held for hosts whose key list came in
+	releaseHeld := func() {
+		for host, packs := range unknownHeld {
+			if zo.key_filter[host] == nil {
+				continue
+			}
+			delete(unknownHeld, host)
+			unknownHeldCount -= len(packs)
+			for _, p := range packs {
+				accept(p)
+			}
+		}
+	}
+
+	// Messages are held without being filtered until the key lists of the
+	// hosts known so far were fetched once, or warmup_timeout elapsed. The
+	// lists loaded from checks_cache_file filter them right away.
+	var (
+		warming        = zo.conf.ZabbixChecksPollInterval != 0 && zo.conf.WarmupTimeout != 0 && len(zo.checks_times) == 0
+		warmup         []*PipelinePack
+		warmupTimer    *time.Timer
+		warmupDeadline <-chan time.Time
+	)
+	if warming {
+		warmupTimer = time.NewTimer(time.Duration(zo.conf.WarmupTimeout))
+		warmupDeadline = warmupTimer.C
+	}
+	endWarmup := func() {
+		warming = false
+		warmupTimer.Stop()
+		warmupDeadline = nil
+		for _, p := range warmup {
+			accept(p)
+		}
+		warmup = nil
+	}
+
+	// Set to nil to stop reading with block_on_full
+	input := inChan
+
+	// Key list fetch round going on, nil in between
+	var checksRound chan []checksFetch
+
+	var reloadSignal chan os.Signal
+	if zo.conf.ReloadFile != "" {
+		reloadSignal = make(chan os.Signal, 1)
+		signal.Notify(reloadSignal, syscall.SIGHUP)
+		defer signal.Stop(reloadSignal)
+	}
+
+	for ok {
+		if zo.conf.BlockOnFull {
+			full := len(dataSlice) >= int(zo.conf.MaxKeyCount) || zo.overBufferBytes(bufferedBytes)
+			if full && input != nil {
+				or.LogMessage(fmt.Sprintf("Buffer full with %d metrics, pausing reads", len(dataSlice)))
+				zo.stats.Blocked++
+				input = nil
+			} else if !full && input == nil {
+				or.LogMessage("Buffer below its limits, resuming reads")
+				input = inChan
+			}
+		}
+
+		select {
+		case <-updateFilter:
 			if !ok {
 				break
 			}
 
-			if len(dataSlice) > 0 {
-				if dataSlice, err = zo.SendMetrics(or, dataSlice); err != nil {
+			now := time.Now()
+			if checksRound != nil || inQuietPeriod(zo.quiet_periods, now) {
+				// The previous round is still going, or holding off
+				continue
+			}
+
+			zo.evictIdleHosts(or, now)
+
+			// Fetched aside so intake carries on, the lists are swapped in
+			// once the round is done
+			checksRound = make(chan []checksFetch, 1)
+			go zo.fetchRound(zo.dueHosts(now), checksRound)
+
+		case fetches := <-checksRound:
+			if !ok {
+				break
+			}
+
+			now := time.Now()
+			fetched := false
+			for _, f := range fetches {
+				zo.applyChecks(or, f, now)
+				fetched = fetched || f.err == nil
+			}
+			checksRound = nil
+			releaseHeld()
+			if fetched && zo.conf.ChecksCacheFile != "" {
+				if err := zo.saveChecksCache(); err != nil {
 					or.LogError(err)
 				}
 			}
+			if warming && len(zo.key_filter) > 0 {
+				if zo.unfetchedHost(fetches) {
+					// Seen during the round, fetched on another one
+					select {
+					case updateFilter <- true:
+					default:
+					}
+				} else {
+					endWarmup()
+				}
+			}
 
-		case <-keySeenCleanup:
+		case pack, ok = <-input:
 			if !ok {
 				break
 			}
 
-			for host, hs := range zo.key_seen {
-				for key, t := range hs {
-					if time.Now().After(t.Add(zo.key_seen_window)) {
-						delete(hs, key)
+			if zo.conf.ReloadMessages && pack.Message.GetType() == zabbixReloadType {
+				zo.reloadFrom(or, pack.Message.GetPayload())
+				pack.Recycle()
+				continue
+			}
+			if zo.conf.FilterMessages && (pack.Message.GetType() == zabbixFilterAddType ||
+				pack.Message.GetType() == zabbixFilterRemoveType) {
+
+				zo.filterControl(or, pack)
+				pack.Recycle()
+				releaseHeld()
+				continue
+			}
+			if !warming {
+				accept(pack)
+				continue
+			}
+			if host := packHost(pack); host != "" {
+				if _, known := zo.key_filter[host]; !known {
+					// Fetched right away instead of on the next round
+					zo.key_filter[host] = nil
+					select {
+					case updateFilter <- true:
+					default:
 					}
 				}
-				if len(hs) == 0 {
-					delete(zo.key_seen, host)
+			}
+			warmup = append(warmup, pack)
+			zo.stats.WarmupHeld++
+			if len(warmup) >= maxHeld {
+				or.LogMessage(fmt.Sprintf("Warm-up ended early after holding %d messages", len(warmup)))
+				endWarmup()
+			}
+
+		case f := <-zo.checks_fetched:
+			if !ok {
+				break
+			}
+
+			zo.applyChecks(or, f, time.Now())
+			<-zo.fetch_slots
+			releaseHeld()
+
+		case host := <-zo.hosts_failed:
+			if !ok {
+				break
+			}
+
+			delete(zo.hosts_created, host)
+
+		case id := <-zo.items_failed:
+			if !ok {
+				break
+			}
+
+			delete(zo.items_requested, id)
+
+		case <-reloadSignal:
+			if !ok {
+				break
+			}
+
+			zo.reloadFrom(or, "")
+
+		case <-warmupDeadline:
+			if !ok {
+				break
+			}
+
+			or.LogMessage("Warm-up timed out before the key lists were fetched")
+			endWarmup()
+
+		case now := <-heartbeatTicker:
+			if !ok {
+				break
+			}
+
+			buffered := len(dataSlice)
+			for _, record := range zo.heartbeats(now) {
+				for _, m := range zo.mirrors {
+					m.push(record)
+				}
+				dataSlice = append(dataSlice, record)
+				bufferedBytes += len(record)
+			}
+			if len(dataSlice) >= zo.sendKeyCount() || zo.overBufferBytes(bufferedBytes) {
+				flush()
+				stopBatchDeadline()
+			} else if len(dataSlice) > buffered {
+				armBatchDeadline()
+			}
+
+		case now := <-nodataTicker:
+			if !ok {
+				break
+			}
+
+			zo.checkNodata(now)
+
+		case <-keySeenSaveTicker:
+			if !ok {
+				break
+			}
+
+			if err := zo.saveKeySeen(); err != nil {
+				or.LogError(err)
+			}
+
+		case <-discardStatsTicker:
+			if !ok {
+				break
+			}
+
+			zo.injectDiscardStats(or, h)
+
+		case <-discardedKeysTicker:
+			if !ok {
+				break
+			}
+
+			zo.injectDiscardedKeys(or, h)
+
+		case now := <-lldTicker:
+			if !ok {
+				break
+			}
+
+			buffered := len(dataSlice)
+			for _, record := range zo.discoveryRecords(now) {
+				for _, m := range zo.mirrors {
+					m.push(record)
+				}
+				dataSlice = append(dataSlice, record)
+				bufferedBytes += len(record)
+			}
+			if len(dataSlice) >= zo.sendKeyCount() || zo.overBufferBytes(bufferedBytes) {
+				flush()
+				stopBatchDeadline()
+			} else if len(dataSlice) > buffered {
+				armBatchDeadline()
+			}
+
+		case <-flushTicker:
+			if !ok {
+				break
+			}
+
+			if len(dataSlice) > 0 {
+				flush()
+				stopBatchDeadline()
+			}
+
+		case <-ticker:
+			if !ok {
+				break
+			}
+
+			if len(dataSlice) > 0 {
+				flush()
+				stopBatchDeadline()
+			} else if zo.send_queue == nil {
+				// Nothing new, the spool left from an outage still drains
+				zo.drainSpool(or)
+			}
+
+		case <-batchDeadline:
+			if !ok {
+				break
+			}
+
+			batchTimer, batchDeadline = nil, nil
+			if len(dataSlice) > 0 {
+				flush()
+			}
+
+		case e := <-outputError:
+			or.LogError(e)
+
+		case err = <-outputExit:
+			// The queue stopped on its own, nothing is sent anymore
+			queueExited = true
+			ok = false
+
+		case <-keySeenCleanup:
+			if !ok {
+				break
+			}
+
+			if len(keySeenPass) == 0 {
+				keySeenPass = make([]string, 0, len(zo.key_seen))
+				for host, _ := range zo.key_seen {
+					keySeenPass = append(keySeenPass, host)
+				}
+			}
+			if keySeenPass = zo.cleanupKeySeen(keySeenPass, time.Now()); len(keySeenPass) > 0 {
+				// Next chunk once the messages waiting got their turn
+				select {
+				case keySeenCleanup <- true:
+				default:
+				}
+			}
+
+		case hosts := <-maintenanceUpdate:
+			if !ok {
+				break
+			}
+
+			zo.maintenance = hosts
+			buffered := len(dataSlice)
+			for _, record := range zo.maintenanceOver() {
+				dataSlice = append(dataSlice, record)
+				bufferedBytes += len(record)
+			}
+			if len(dataSlice) >= zo.sendKeyCount() || zo.overBufferBytes(bufferedBytes) {
+				flush()
+				stopBatchDeadline()
+			} else if len(dataSlice) > buffered {
+				armBatchDeadline()
+			}
+
+		case <-metadataTicker:
+			if !ok {
+				break
+			}
+
+			// Skip this round if the previous refresh is still going
+			select {
+			case metadataRefreshing <- true:
+				hosts := make([]string, 0, len(zo.key_filter))
+				for host, _ := range zo.key_filter {
+					hosts = append(hosts, host)
 				}
+				go func() {
+					zo.refreshItemMetadata(or, hosts)
+					<-metadataRefreshing
+				}()
+			default:
 			}
 
 		case rchan := <-zo.report_chan:
@@ -339,10 +3347,112 @@ func (zo *ZabbixOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 				}
 			}
 
+			zo.stats_lock.Lock()
+			zo.stats.Buffered = len(dataSlice) + int(atomic.LoadInt64(&zo.send_pending))
+			zo.stats_lock.Unlock()
+			if js, localErr := json.Marshal(zo.state()); localErr != nil {
+				or.LogError(fmt.Errorf("Unable to encode report state: %s", localErr))
+			} else {
+				rchan <- reportMsg{name: "State", json: js}
+			}
+			if zo.history != nil {
+				if js, localErr := json.Marshal(zo.history.list()); localErr != nil {
+					or.LogError(fmt.Errorf("Unable to encode payload history: %s", localErr))
+				} else {
+					rchan <- reportMsg{name: "PayloadHistory", json: js}
+				}
+			}
+
 			close(rchan)
 		}
 	}
 
+	if warming {
+		endWarmup()
+	}
+	if zo.conf.KeySeenFile != "" {
+		if err := zo.saveKeySeen(); err != nil {
+			or.LogError(err)
+		}
+	}
+	dataSlice = append(dataSlice, zo.maintenanceShutdown()...)
+	for _, packs := range unknownHeld {
+		for _, p := range packs {
+			zo.stats.Discarded++
+			p.Recycle()
+		}
+	}
+	switch {
+	case zo.buffered_out != nil && !queueExited:
+		flush()
+	case zo.buffered_out != nil:
+		for _, p := range held {
+			p.Recycle()
+		}
+	case zo.send_queue != nil:
+		// The sender sends them once the queue is closed
+		if len(dataSlice) > 0 {
+			zo.flush(or, dataSlice)
+		}
+	default:
+		zo.shutdownFlush(or, dataSlice)
+	}
+
+	return
+}
+
+// Snapshot of the filters and counters, only safe to call from the Run loop.
+func (zo *ZabbixOutput) state() (st zabbixOutputState) {
+	st.ActiveChecks = make(map[string][]string, len(zo.key_filter))
+	for host, hc := range zo.key_filter {
+		keys := make([]string, 0, len(hc))
+		for key, _ := range hc {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		st.ActiveChecks[host] = keys
+	}
+
+	st.KeySeen = make(map[string][]string, len(zo.key_seen))
+	for host, hs := range zo.key_seen {
+		keys := make([]string, 0, len(hs))
+		for key, _ := range hs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		st.KeySeen[host] = keys
+	}
+
+	st.ChecksFailures = make(map[string]int, len(zo.checks_failures))
+	for host, cf := range zo.checks_failures {
+		st.ChecksFailures[host] = cf.streak
+	}
+
+	zo.stats_lock.Lock()
+	st.Stats = zo.stats
+	zo.stats_lock.Unlock()
+	st.HostStats = zo.host_stats.topN()
+	st.DiscardStats = zo.discard_stats.topN()
+	if zo.servers != nil {
+		active := zo.servers.active()
+		st.Server = active.address
+		st.Compressing = active.compressing(time.Now())
+		st.UncompressedBytes = atomic.LoadInt64(&zo.server_bytes.uncompressed)
+		st.CompressedBytes = atomic.LoadInt64(&zo.server_bytes.sent)
+	} else {
+		st.Server = zo.conf.Api.Url
+	}
+	for _, m := range zo.mirrors {
+		st.Mirrors = append(st.Mirrors, m.state())
+	}
+	for host, _ := range zo.maintenance {
+		st.InMaintenance = append(st.InMaintenance, host)
+	}
+	sort.Strings(st.InMaintenance)
+	st.Suppressed = zo.negative.list(time.Now())
+	st.Circuit = zo.breaker.state(time.Now())
+	st.SpoolSegments = atomic.LoadInt64(&zo.spool_segments)
+	st.SpoolBytes = atomic.LoadInt64(&zo.spool_bytes)
 	return
 }
 
@@ -358,6 +3468,12 @@ func (zo *ZabbixOutput) ReportMsg(msg *message.Message) error {
 	zo.report_chan <- rchan
 
 	for rm := range rchan {
+		if rm.json != nil {
+			if field, err := message.NewField(rm.name, string(rm.json), "json"); err == nil {
+				msg.AddField(field)
+			}
+			continue
+		}
 		sort.Strings(rm.values)
 		joined_values := strings.Join(rm.values, " ")
 		message.NewStringField(msg, rm.name, joined_values)
@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// Builds the history uploads of an active Zabbix proxy, so the values of a
+// whole fleet of hosts go in as if collected by that proxy. The proxy must
+// be registered on the server and monitor the hosts, their values are sent
+// by item id.
+type zabbixProxyData struct {
+	name    string
+	version string
+	// The server ignores ids it already got in the session, the session
+	// lasts as long as the plugin unless the values come with their own
+	// ids
+	session string
+	lastId  int64
+}
+
+type zabbixProxyHistoryValue struct {
+	Id          int64           `json:"id"`
+	ItemId      json.Number     `json:"itemid"`
+	Clock       int64           `json:"clock"`
+	Ns          int64           `json:"ns"`
+	Value       json.RawMessage `json:"value"`
+	LastLogSize *int64          `json:"lastlogsize,omitempty"`
+	Mtime       *int64          `json:"mtime,omitempty"`
+	Source      string          `json:"source,omitempty"`
+	Severity    *int64          `json:"severity,omitempty"`
+	EventId     *int64          `json:"eventid,omitempty"`
+}
+
+type zabbixProxyDataRequest struct {
+	Request     string                    `json:"request"`
+	Host        string                    `json:"host"`
+	Session     string                    `json:"session"`
+	Version     string                    `json:"version"`
+	HistoryData []zabbixProxyHistoryValue `json:"history_data"`
+	Clock       int64                     `json:"clock"`
+	Ns          int64                     `json:"ns"`
+}
+
+func newZabbixProxyData(name string, version string) *zabbixProxyData {
+	return &zabbixProxyData{
+		name:    name,
+		version: version,
+		session: strings.Replace(uuid.NewRandom().String(), "-", "", -1),
+	}
+}
+
+// Converts an assembled batch to a proxy data request. The item ids of
+// each host are fetched once, before its first record. Records without an
+// item id are left out and returned as failed.
+func (pd *zabbixProxyData) build(payload []byte, fetchIds func(host string),
+	itemId func(host string, key string) string) (req []byte, values int, failed []zabbixFailedItem, err error) {
+
+	var data zabbixDataRequest
+	if err = json.Unmarshal(payload, &data); err != nil {
+		return nil, 0, nil, fmt.Errorf("Unable to decode batch: %s", err)
+	}
+
+	now := time.Now()
+	pr := zabbixProxyDataRequest{
+		Request:     "proxy data",
+		Host:        pd.name,
+		Session:     pd.session,
+		Version:     pd.version,
+		HistoryData: make([]zabbixProxyHistoryValue, 0, len(data.Data)),
+		Clock:       now.Unix(),
+		Ns:          int64(now.Nanosecond()),
+	}
+	fetched := make(map[string]bool)
+	for _, r := range data.Data {
+		if !fetched[r.Host] {
+			fetchIds(r.Host)
+			fetched[r.Host] = true
+		}
+		id := itemId(r.Host, r.Key)
+		if id == "" {
+			failed = append(failed, zabbixFailedItem{r.Host, r.Key, "unknown item"})
+			continue
+		}
+		if r.Id == 0 {
+			r.Id = atomic.AddInt64(&pd.lastId, 1)
+		}
+		hv := zabbixProxyHistoryValue{
+			Id:          r.Id,
+			ItemId:      json.Number(id),
+			Value:       r.Value,
+			LastLogSize: r.LastLogSize,
+			Mtime:       r.Mtime,
+			Source:      r.Source,
+			Severity:    r.Severity,
+			EventId:     r.EventId,
+		}
+		hv.Clock, _ = r.Clock.Int64()
+		hv.Ns, _ = r.Ns.Int64()
+		pr.HistoryData = append(pr.HistoryData, hv)
+	}
+
+	req, err = json.Marshal(pr)
+	return req, len(pr.HistoryData), failed, err
+}
+
+// Servers answer proxy data without the processed counts, all the values
+// are taken then.
+func parseProxyDataResponse(resp []byte, values int) (res zabbixSendResult, err error) {
+	var sr zabbixSendResponse
+	if err = json.Unmarshal(resp, &sr); err != nil {
+		return res, fmt.Errorf("Unable to decode proxy data response: %s", err)
+	}
+	if sr.Response != "success" {
+		return res, fmt.Errorf("Proxy data refused: %s %s", sr.Response, sr.Info)
+	}
+	if sr.Info != "" {
+		return parseSendResponse(resp)
+	}
+	return zabbixSendResult{Processed: values, Total: values}, nil
+}
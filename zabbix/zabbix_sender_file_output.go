@@ -0,0 +1,155 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Output plugin writing metrics in the `zabbix_sender -T -i` input file
+// format so they can be imported later with the standard tooling.
+type ZabbixSenderFileOutput struct {
+	conf     *ZabbixSenderFileOutputConfig
+	rotation time.Duration
+	perm     os.FileMode
+	file     *os.File
+}
+
+type ZabbixSenderFileOutputConfig struct {
+	// Directory where the files are written
+	Path string `toml:"path"`
+	// Prefix of the generated file names
+	Prefix string `toml:"prefix"`
+	// Seconds between each file rotation
+	RotationInterval uint `toml:"rotation_interval"`
+	// Permissions of the created files, in octal
+	Perm string `toml:"perm"`
+}
+
+func (zfo *ZabbixSenderFileOutput) ConfigStruct() interface{} {
+	return &ZabbixSenderFileOutputConfig{
+		Prefix:           "zabbix_sender",
+		RotationInterval: uint(3600),
+		Perm:             "644",
+	}
+}
+
+func (zfo *ZabbixSenderFileOutput) Init(config interface{}) (err error) {
+	zfo.conf = config.(*ZabbixSenderFileOutputConfig)
+
+	if zfo.conf.Path == "" {
+		return fmt.Errorf("path must be set")
+	}
+	if zfo.conf.RotationInterval == 0 {
+		return fmt.Errorf("rotation_interval must be > 0")
+	}
+	zfo.rotation = time.Duration(zfo.conf.RotationInterval) * time.Second
+
+	var perm uint64
+	if perm, err = strconv.ParseUint(zfo.conf.Perm, 8, 32); err != nil {
+		return fmt.Errorf("Invalid perm: %s", zfo.conf.Perm)
+	}
+	zfo.perm = os.FileMode(perm)
+
+	return os.MkdirAll(zfo.conf.Path, 0755)
+}
+
+// Quote a field as zabbix_sender expects it when it contains separators.
+func zabbixSenderQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"\\") {
+		return s
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// Closes the current file, the next one is opened by the first write after.
+func (zfo *ZabbixSenderFileOutput) rotate() {
+	if zfo.file != nil {
+		zfo.file.Close()
+		zfo.file = nil
+	}
+}
+
+func (zfo *ZabbixSenderFileOutput) open(now time.Time) (err error) {
+	name := fmt.Sprintf("%s-%s.txt", zfo.conf.Prefix, now.UTC().Format("20060102150405"))
+	zfo.file, err = os.OpenFile(filepath.Join(zfo.conf.Path, name),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, zfo.perm)
+	return
+}
+
+func (zfo *ZabbixSenderFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok     = true
+		pack   *PipelinePack
+		inChan = or.InChan()
+		host   string
+		key    string
+		value  string
+	)
+
+	defer func() {
+		if zfo.file != nil {
+			zfo.file.Close()
+		}
+	}()
+
+	rotateTicker := time.NewTicker(zfo.rotation)
+	defer rotateTicker.Stop()
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+
+			if key, err = fieldToString("key", pack); err == nil {
+				if host, err = fieldToString("host", pack); err == nil {
+					// Numeric values formatted like ZabbixEncoder does
+					if v, found := pack.Message.GetFieldValue("value"); !found {
+						err = fmt.Errorf("Unable to find fieldname: value")
+					} else if value, err = formatItemValue(v, ZabbixValueAuto); err != nil {
+						err = fmt.Errorf("%s:%s: %s", host, key, err)
+					}
+				}
+			}
+			if err != nil {
+				or.LogError(err)
+				pack.Recycle()
+				continue
+			}
+
+			line := fmt.Sprintf("%s %s %d %s\n", zabbixSenderQuote(host), zabbixSenderQuote(key),
+				time.Unix(0, pack.Message.GetTimestamp()).UTC().Unix(), zabbixSenderQuote(value))
+			pack.Recycle()
+
+			if zfo.file == nil {
+				if err = zfo.open(time.Now()); err != nil {
+					or.LogError(fmt.Errorf("Unable to open file: %s", err))
+					continue
+				}
+			}
+			if _, err = zfo.file.WriteString(line); err != nil {
+				or.LogError(fmt.Errorf("Unable to write to file: %s", err))
+			}
+
+		case <-rotateTicker.C:
+			zfo.rotate()
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	RegisterPlugin("ZabbixSenderFileOutput", func() interface{} {
+		return new(ZabbixSenderFileOutput)
+	})
+}
@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	tlsext "github.com/raff/tls-ext"
+	psk "github.com/raff/tls-psk"
+)
+
+// TLS wrapping of the connections to a Zabbix server. The standard library
+// has no PSK support, tls-ext and tls-psk provide the PSK cipher suites
+// Zabbix accepts.
+type zabbixTLS struct {
+	psk  *tlsext.Config
+	cert *tls.Config
+}
+
+// TLS settings, named after the zabbix_sender options
+type zabbixTLSOptions struct {
+	connect       string
+	pskIdentity   string
+	pskFile       string
+	caFile        string
+	certFile      string
+	keyFile       string
+	serverIssuer  string
+	serverSubject string
+}
+
+// Builds the TLS settings for a tls_connect mode, nil for unencrypted
+// connections.
+func newZabbixTLS(o zabbixTLSOptions) (zt *zabbixTLS, err error) {
+	switch o.connect {
+	case "", "unencrypted":
+		return nil, nil
+
+	case "psk":
+		if o.pskIdentity == "" || o.pskFile == "" {
+			return nil, fmt.Errorf("tls_psk_identity and tls_psk_file must be set when tls_connect = \"psk\"")
+		}
+		var key []byte
+		if key, err = loadPsk(o.pskFile); err != nil {
+			return
+		}
+		zt = &zabbixTLS{psk: &tlsext.Config{
+			CipherSuites: []uint16{psk.TLS_PSK_WITH_AES_128_CBC_SHA, psk.TLS_PSK_WITH_AES_256_CBC_SHA},
+			// PSK suites don't use certificates but the handshake wants one
+			Certificates: []tlsext.Certificate{tlsext.Certificate{}},
+			MinVersion:   tlsext.VersionTLS12,
+			Extra: psk.PSKConfig{
+				GetKey:      func(identity string) ([]byte, error) { return key, nil },
+				GetIdentity: func() string { return o.pskIdentity },
+			},
+		}}
+		return
+
+	case "cert":
+		var conf *tls.Config
+		if conf, err = certTLSConfig(o); err != nil {
+			return
+		}
+		return &zabbixTLS{cert: conf}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid tls_connect: %s, only 'unencrypted', 'psk' or 'cert' allowed.", o.connect)
+}
+
+// Reads a PSK file as written for zabbix_agentd: at least 32 hex digits.
+func loadPsk(path string) (key []byte, err error) {
+	var raw []byte
+	if raw, err = ioutil.ReadFile(path); err != nil {
+		return nil, fmt.Errorf("Unable to read PSK file: %s", err)
+	}
+	s := strings.TrimSpace(string(raw))
+	if len(s) < 32 {
+		return nil, fmt.Errorf("PSK in %s must be at least 32 hex digits", path)
+	}
+	if key, err = hex.DecodeString(s); err != nil {
+		return nil, fmt.Errorf("Invalid PSK in %s: %s", path, err)
+	}
+	return
+}
+
+// Certificate based settings. Like Zabbix the server certificate is checked
+// against the CA and optionally its issuer and subject, not its host name.
+func certTLSConfig(o zabbixTLSOptions) (conf *tls.Config, err error) {
+	if o.caFile == "" || o.certFile == "" || o.keyFile == "" {
+		return nil, fmt.Errorf("tls_ca_file, tls_cert_file and tls_key_file must be set when tls_connect = \"cert\"")
+	}
+
+	var ca []byte
+	if ca, err = ioutil.ReadFile(o.caFile); err != nil {
+		return nil, fmt.Errorf("Unable to read CA file: %s", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificate found in %s", o.caFile)
+	}
+
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(o.certFile, o.keyFile); err != nil {
+		return nil, fmt.Errorf("Unable to load client certificate: %s", err)
+	}
+
+	conf = &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyServerCert(rawCerts, roots, o.serverIssuer, o.serverSubject)
+		},
+	}
+	return
+}
+
+func verifyServerCert(rawCerts [][]byte, roots *x509.CertPool, issuer string, subject string) (err error) {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("Server sent no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		if certs[i], err = x509.ParseCertificate(raw); err != nil {
+			return fmt.Errorf("Invalid server certificate: %s", err)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err = certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("Server certificate verification failed: %s", err)
+	}
+
+	if issuer != "" && certs[0].Issuer.String() != issuer {
+		return fmt.Errorf("Server certificate issuer %q doesn't match %q", certs[0].Issuer.String(), issuer)
+	}
+	if subject != "" && certs[0].Subject.String() != subject {
+		return fmt.Errorf("Server certificate subject %q doesn't match %q", certs[0].Subject.String(), subject)
+	}
+	return
+}
+
+// Wraps a connection, the handshake happens on the first write so it's
+// bound by the request deadlines.
+func (zt *zabbixTLS) client(conn net.Conn) net.Conn {
+	if zt.cert != nil {
+		return tls.Client(conn, zt.cert)
+	}
+	return tlsext.Client(conn, zt.psk)
+}
@@ -0,0 +1,57 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+)
+
+// Decoder for the frames produced by ZstdEncoder, expects a message.proto
+// parser on the input.
+type ZstdDecoder struct {
+	conf    *ZstdDecoderConfig
+	decoder *zstd.Decoder
+}
+
+type ZstdDecoderConfig struct {
+	// Maximum decompressed message size in bytes
+	MaxMessageSize uint64 `toml:"max_message_size"`
+}
+
+func (d *ZstdDecoder) ConfigStruct() interface{} {
+	return &ZstdDecoderConfig{MaxMessageSize: uint64(message.MAX_RECORD_SIZE)}
+}
+
+func (d *ZstdDecoder) Init(config interface{}) (err error) {
+	d.conf = config.(*ZstdDecoderConfig)
+	d.decoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(d.conf.MaxMessageSize),
+		zstd.WithDecoderConcurrency(1))
+	return
+}
+
+func (d *ZstdDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	if !bytes.HasPrefix(pack.MsgBytes, zstdFrameMagic) {
+		return nil, fmt.Errorf("Invalid zstd frame header")
+	}
+
+	var raw []byte
+	if raw, err = d.decoder.DecodeAll(pack.MsgBytes[len(zstdFrameMagic):], nil); err != nil {
+		return nil, fmt.Errorf("Unable to decompress frame: %s", err)
+	}
+	if err = proto.Unmarshal(raw, pack.Message); err != nil {
+		return nil, fmt.Errorf("Unable to deserialize message: %s", err)
+	}
+
+	return []*PipelinePack{pack}, nil
+}
+
+func init() {
+	RegisterPlugin("ZstdDecoder", func() interface{} {
+		return new(ZstdDecoder)
+	})
+}
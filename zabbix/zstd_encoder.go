@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"fmt"
+
+	"code.google.com/p/gogoprotobuf/proto"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/mozilla-services/heka/pipeline"
+)
+
+// Version tag prefixed to every frame produced by ZstdEncoder
+var zstdFrameMagic = []byte("HZ1")
+
+// Encoder compressing protobuf serialized messages with zstd, to forward
+// metric packs between Heka instances. Use with use_framing = true and
+// ZstdDecoder on the receiving side.
+type ZstdEncoder struct {
+	config  *ZstdEncoderConfig
+	encoder *zstd.Encoder
+}
+
+type ZstdEncoderConfig struct {
+	// Compression level: fastest, default, better or best
+	Level string `toml:"level"`
+}
+
+func (ze *ZstdEncoder) ConfigStruct() interface{} {
+	return &ZstdEncoderConfig{Level: "default"}
+}
+
+func (ze *ZstdEncoder) Init(config interface{}) (err error) {
+	ze.config = config.(*ZstdEncoderConfig)
+
+	ok, level := zstd.EncoderLevelFromString(ze.config.Level)
+	if !ok {
+		return fmt.Errorf("Invalid zstd level: %s", ze.config.Level)
+	}
+
+	ze.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	return
+}
+
+func (ze *ZstdEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	var raw []byte
+	if raw, err = proto.Marshal(pack.Message); err != nil {
+		return nil, fmt.Errorf("Unable to serialize message: %s", err)
+	}
+
+	output = make([]byte, len(zstdFrameMagic), len(zstdFrameMagic)+len(raw)/2)
+	copy(output, zstdFrameMagic)
+	return ze.encoder.EncodeAll(raw, output), nil
+}
+
+func init() {
+	pipeline.RegisterPlugin("ZstdEncoder", func() interface{} {
+		return new(ZstdEncoder)
+	})
+}